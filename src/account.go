@@ -0,0 +1,254 @@
+package guestbook
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// Functions about linking login accounts to player profiles. A logged-in user
+// claims a profile, and an admin approves or rejects the claim.
+
+// Status of a ProfileClaim
+const (
+	ClaimPending  = "pending"
+	ClaimApproved = "approved"
+	ClaimRejected = "rejected"
+)
+
+// ProfileClaimWithKey wrapper struct for datastore
+type ProfileClaimWithKey struct {
+	Claim ProfileClaim
+	Key   string
+}
+
+// findProfileByAccount finds the profile linked to a login account
+func findProfileByAccount(ctx context.Context, accountID string) (bool, *datastore.Key, UserProfile, error) {
+	q := datastore.NewQuery("UserProfile").Ancestor(guestbookKey(ctx)).Filter("AccountID =", accountID).Limit(1)
+	var profiles []UserProfile
+	keys, err := q.GetAll(ctx, &profiles)
+	if err != nil {
+		return false, nil, UserProfile{}, err
+	}
+	if len(profiles) == 0 {
+		return false, nil, UserProfile{}, nil
+	}
+	return true, keys[0], profiles[0], nil
+}
+
+// currentUserProfile finds the profile linked to the current login, or to the
+// owner of a personal API token
+func currentUserProfile(ctx context.Context) (bool, *datastore.Key, UserProfile, error) {
+	accountID := currentAccountID(ctx)
+	if accountID == "" {
+		return false, nil, UserProfile{}, nil
+	}
+	return findProfileByAccount(ctx, accountID)
+}
+
+// currentSubmitter is the name stored as Submitter of a match: the owner of
+// the API token, the player name if the login is linked to a profile, or the
+// login otherwise.
+func currentSubmitter(ctx context.Context) string {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.Owner
+	}
+	u := user.Current(ctx)
+	if u == nil {
+		return ""
+	}
+	exist, _, profile, err := findProfileByAccount(ctx, u.ID)
+	if err != nil || !exist {
+		return u.String()
+	}
+	return profile.Name
+}
+
+// checkParticipant checks that the player linked to the current login, or to
+// the owner of a personal API token, is one of the players of a submitted
+// match. Organizers of the tournament, or site-wide if tournamentID is 0, can
+// submit any match, as well as logins without a linked profile and service
+// tokens, which are not known to be a player.
+func checkParticipant(ctx context.Context, tournamentID int64, playerNames []string) error {
+	exist, _, profile, err := currentUserProfile(ctx)
+	if err != nil || !exist || containsString(playerNames, profile.Name) {
+		return err
+	}
+	role, err := currentRole(ctx, tournamentID)
+	if err != nil {
+		return err
+	}
+	if roleLevels[role] < roleLevels[RoleOrganizer] {
+		return permissionDeniedError("%s did not play in the match, only organizers can submit matches of other players", profile.Name)
+	}
+	return nil
+}
+
+// submitProfileClaim creates a pending claim of the current login on a profile
+func submitProfileClaim(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	u := user.Current(ctx)
+	if u == nil {
+		writeAPIError(w, unauthenticatedError("Profiles can only be claimed by a login"))
+		return
+	}
+
+	name := r.FormValue("name")
+	exist, userKey, profile, err := findExistingUser(ctx, name)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	} else if !exist {
+		writeAPIError(w, notFoundError("User %q does not exist", name))
+		return
+	}
+
+	if profile.AccountID != "" {
+		writeAPIError(w, alreadyExistsError("Profile %s is already claimed", name))
+		return
+	}
+
+	linked, _, linkedProfile, err := findProfileByAccount(ctx, u.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	} else if linked {
+		writeAPIError(w, failedPreconditionError("You are already linked to profile %s", linkedProfile.Name))
+		return
+	}
+
+	// Only one pending claim per login
+	pendingKeys, err := datastore.NewQuery("ProfileClaim").Ancestor(guestbookKey(ctx)).
+		Filter("AccountID =", u.ID).
+		Filter("Status =", ClaimPending).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	} else if len(pendingKeys) != 0 {
+		writeAPIError(w, failedPreconditionError("You already have a pending claim"))
+		return
+	}
+
+	claim := ProfileClaim{
+		UserID:       userKey.IntID(),
+		UserName:     name,
+		AccountID:    u.ID,
+		AccountEmail: u.Email,
+		Status:       ClaimPending,
+		RequestTime:  time.Now(),
+	}
+	key := datastore.NewIncompleteKey(ctx, "ProfileClaim", guestbookKey(ctx))
+	if _, err := datastore.Put(ctx, key, &claim); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/profile?user="+name, http.StatusFound)
+}
+
+// requestProfileClaims returns all pending claims
+func requestProfileClaims(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	query := datastore.NewQuery("ProfileClaim").Ancestor(guestbookKey(ctx)).
+		Filter("Status =", ClaimPending)
+	var claims []ProfileClaim
+	keys, err := query.GetAll(ctx, &claims)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	claimWithKeys := make([]ProfileClaimWithKey, len(claims))
+	for i, claim := range claims {
+		claimWithKeys[i] = ProfileClaimWithKey{
+			Claim: claim,
+			Key:   keys[i].Encode(),
+		}
+	}
+
+	writeAPIResponse(w, claimWithKeys, nil)
+}
+
+// reviewProfileClaim approves or rejects a pending claim, approving links the
+// login of the claim to the profile.
+func reviewProfileClaim(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	claimKey, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeAPIError(w, invalidArgumentError("invalid key: %s", err.Error()))
+		return
+	}
+	if claimKey.Kind() != "ProfileClaim" || !claimKey.Parent().Equal(guestbookKey(ctx)) {
+		writeAPIError(w, invalidArgumentError("%s is not a profile claim", claimKey.Kind()))
+		return
+	}
+	approve := r.FormValue("approve") == "true"
+	reviewer := currentLogin(ctx)
+
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		var claim ProfileClaim
+		if err := datastore.Get(ctx, claimKey, &claim); err == datastore.ErrNoSuchEntity {
+			return notFoundError("the claim does not exist")
+		} else if err != nil {
+			return err
+		}
+		if claim.Status != ClaimPending {
+			return failedPreconditionError("claim is already %s", claim.Status)
+		}
+
+		claim.Status = ClaimRejected
+		if approve {
+			claim.Status = ClaimApproved
+
+			linked, _, linkedProfile, err := findProfileByAccount(ctx, claim.AccountID)
+			if err != nil {
+				return err
+			} else if linked {
+				return failedPreconditionError("%s is already linked to %s", claim.AccountEmail, linkedProfile.Name)
+			}
+
+			userKey := datastore.NewKey(ctx, "UserProfile", "", claim.UserID, guestbookKey(ctx))
+			var profile UserProfile
+			if err := datastore.Get(ctx, userKey, &profile); err != nil {
+				return err
+			}
+			if profile.AccountID != "" {
+				return alreadyExistsError("profile %s is already claimed", profile.Name)
+			}
+			profile.AccountID = claim.AccountID
+			profile.AccountEmail = claim.AccountEmail
+			if _, err := datastore.Put(ctx, userKey, &profile); err != nil {
+				return err
+			}
+		}
+
+		claim.Reviewer = reviewer
+		claim.ReviewTime = time.Now()
+		_, err := datastore.Put(ctx, claimKey, &claim)
+		return err
+	}, nil)
+	writeAPIResponse(w, "OK", err)
+}
+
+// myProfile redirects to the profile linked to the current login
+func myProfile(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	exist, _, profile, err := currentUserProfile(ctx)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	} else if !exist {
+		writeAPIError(w, notFoundError("Your login is not linked to a player yet, claim your profile first."))
+		return
+	}
+
+	http.Redirect(w, r, "/profile?user="+profile.Name, http.StatusFound)
+}
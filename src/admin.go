@@ -2,15 +2,15 @@ package guestbook
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"path"
 
 	"cloud.google.com/go/storage"
-	"google.golang.org/appengine"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/file"
-	"google.golang.org/appengine/user"
 )
 
 // Admin page
@@ -20,22 +20,28 @@ func admin(w http.ResponseWriter, r *http.Request) {
 
 // Re-run all matches
 func rerunMatches(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	if err := rerunLegacyMatches(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// rerunLegacyMatches recalculates Elo ratings of all legacy 1v1 matches
+func rerunLegacyMatches(c context.Context) error {
 	// Get users
 	queryUser := datastore.NewQuery("UserProfile").Ancestor(guestbookKey(c))
 	var users []UserProfile
 	keyUsers, err := queryUser.GetAll(c, &users)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	// Get matches
 	queryMatch := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).Order("Date")
 	var matches []Match
 	keyMatches, err := queryMatch.GetAll(c, &matches)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	// Reset ratings
 	for i := range users {
@@ -53,8 +59,8 @@ func rerunMatches(w http.ResponseWriter, r *http.Request) {
 		idxW, existW := mp[m.Winner]
 		idxL, existL := mp[m.Loser]
 		if !existW || !existL {
-			http.Error(w, "Datastore error", http.StatusInternalServerError)
-			return
+			return fmt.Errorf("Datastore error: match %s > %s at %s refers to an unknown player",
+				m.Winner, m.Loser, m.Date)
 		}
 		// Update match
 		matches[i] = createMatch(
@@ -75,47 +81,62 @@ func rerunMatches(w http.ResponseWriter, r *http.Request) {
 	for i, m := range matches {
 		datastore.Put(c, keyMatches[i], &m)
 	}
-	// Clear latest match
-	existLatestMatch = false
+	invalidateTournamentResponses(c, legacyCacheScope)
+	return nil
 }
 
 // Delete a match entry from database
 func deleteMatchEntry(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	encodedString := ""
-	ret := ""
-
-	// Get encoded string
-	keys, ok := r.URL.Query()["key"]
-	if ok && len(keys) == 1 {
-		encodedString = keys[0]
-	}
+	c := newContext(r)
 
-	// Get decoded key
-	key, err := datastore.DecodeKey(encodedString)
+	key, err := datastore.DecodeKey(r.FormValue("key"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		ret = "Error"
-	} else {
-		// Remove the key
-		datastore.Delete(c, key)
-		rerunMatches(w, r) // TODO(music960633): Should we run this here?
-		ret = "OK"
-	}
-
-	js, errJs := json.Marshal(ret)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
+		writeAPIError(w, invalidArgumentError(err.Error()))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	writeAPIResponse(w, "OK", deleteMatch(c, key))
+}
+
+// deleteMatch deletes a legacy or FFA match, then recalculates the ratings
+// of later matches
+func deleteMatch(c context.Context, key *datastore.Key) error {
+	switch key.Kind() {
+	case "Match":
+		if err := authorizeLegacyMatch(c, key); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, key); err != nil {
+			return err
+		}
+		return rerunLegacyMatches(c)
+	case "FFAMatch":
+		match := FFAMatch{}
+		if err := datastore.Get(c, key, &match); err == datastore.ErrNoSuchEntity {
+			return notFoundError("match does not exist")
+		} else if err != nil {
+			return err
+		}
+		if err := authorize(c, RoleOrganizer, match.TournamentID); err != nil {
+			return err
+		}
+		if err := runInTransaction(c, func(c context.Context) error {
+			if err := datastore.Delete(c, key); err != nil {
+				return err
+			}
+			// The scheduled replay does nothing if the one below succeeds
+			return changeTournamentStats(c, match.TournamentID, true)
+		}, nil); err != nil {
+			return err
+		}
+		return replayFFAMatches(c, match.TournamentID)
+	}
+	return invalidArgumentError("%s is not a match", key.Kind())
 }
 
 // Switch winner/loser of a match
 func switchMatchUsers(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	encodedString := ""
 	ret := ""
 
@@ -130,6 +151,9 @@ func switchMatchUsers(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		ret = "Error"
+	} else if err = authorizeLegacyMatch(c, key); err != nil {
+		http.Error(w, err.Error(), authorizationStatus(err))
+		ret = "Error"
 	} else {
 		// Get the entry
 		match := Match{}
@@ -160,8 +184,45 @@ func switchMatchUsers(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
+// authorizeLegacyMatch checks that the current login organizes the tournament
+// of a legacy match. Matches of tournaments without a Tournament entity can
+// only be edited by site admins.
+func authorizeLegacyMatch(c context.Context, key *datastore.Key) error {
+	match := Match{}
+	if err := datastore.Get(c, key, &match); err != nil {
+		return err
+	}
+	exist, tournamentKey, _, err := findExistingTournament(c, match.Tournament)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return authorize(c, RoleAdmin, 0)
+	}
+	return authorize(c, RoleOrganizer, tournamentKey.IntID())
+}
+
+// Delete a FFA match, then replay its tournament
+func deleteFFAMatch(w http.ResponseWriter, r *http.Request) {
+	deleteMatchEntry(w, r)
+}
+
 func submitBadge(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	// Site-wide badges are created by admins, tournament badges by organizers
+	var tournamentID int64
+	if tournamentName := r.FormValue("tournament"); tournamentName != "" {
+		tournamentKey, err := findExistingTournamentKey(c, tournamentName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tournamentID = tournamentKey.IntID()
+	}
+	if err := authorizeBadge(c, tournamentID); err != nil {
+		http.Error(w, err.Error(), authorizationStatus(err))
+		return
+	}
 	// Check if badge already exist
 	badgeName := r.FormValue("name")
 	queryBadge := datastore.NewQuery("Badge").Ancestor(guestbookKey(c)).Filter("Name =", badgeName).KeysOnly()
@@ -207,8 +268,10 @@ func submitBadge(w http.ResponseWriter, r *http.Request) {
 	badge := Badge{
 		Name:        badgeName,
 		Description: r.FormValue("description"),
-		Author:      user.Current(c).String(),
+		Author:      currentLogin(c),
 		Path:        "https://storage.googleapis.com/" + bucketName + "/" + badgeName,
+
+		TournamentID: tournamentID,
 	}
 	key := datastore.NewIncompleteKey(c, "Badge", guestbookKey(c))
 	_, err = datastore.Put(c, key, &badge)
@@ -216,39 +279,45 @@ func submitBadge(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	invalidateAllResponses(c)
 
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 func submitUserBadge(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	if err := giveBadge(c, r.FormValue("user_name"), r.FormValue("badge_name")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// giveBadge gives a badge to a player
+func giveBadge(c context.Context, userName string, badgeName string) error {
 	// Get user
-	userName := r.FormValue("user_name")
 	existU, _, _, errUser := existUser(c, userName)
 	if errUser != nil {
-		http.Error(w, errUser.Error(), http.StatusInternalServerError)
-		return
+		return errUser
 	} else if !existU {
-		http.Error(w, "User "+userName+" does not exist.", http.StatusInternalServerError)
-		return
+		return notFoundError("User %s does not exist.", userName)
 	}
 	// Get badge
-	badgeName := r.FormValue("badge_name")
-	existB, _, _, errBadge := existBadge(c, badgeName)
+	existB, _, badge, errBadge := existBadge(c, badgeName)
 	if errBadge != nil {
-		http.Error(w, errBadge.Error(), http.StatusInternalServerError)
-		return
+		return errBadge
 	} else if !existB {
-		http.Error(w, "Badge "+badgeName+" does not exist.", http.StatusInternalServerError)
-		return
+		return notFoundError("Badge %s does not exist.", badgeName)
+	}
+	if err := authorizeBadge(c, badge.TournamentID); err != nil {
+		return err
 	}
 	// Get UserBadge
 	queryBadge := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(c)).Filter("User =", userName)
 	var userBadges []UserBadge
 	keys, err := queryBadge.GetAll(c, &userBadges)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	key := datastore.Key{}
@@ -264,6 +333,19 @@ func submitUserBadge(w http.ResponseWriter, r *http.Request) {
 		userBadge = userBadges[0]
 	}
 	userBadge.BadgeNames = append(userBadge.BadgeNames, badgeName)
-	datastore.Put(c, &key, &userBadge)
-	http.Redirect(w, r, "/admin", http.StatusFound)
+	if _, err := datastore.Put(c, &key, &userBadge); err != nil {
+		return err
+	}
+	// Badges are shown on the leaderboards of all tournaments
+	invalidateAllResponses(c)
+	return nil
+}
+
+// authorizeBadge checks that the current login can manage badges of a
+// tournament, or site-wide badges if tournamentID is 0
+func authorizeBadge(c context.Context, tournamentID int64) error {
+	if tournamentID == 0 {
+		return authorize(c, RoleAdmin, 0)
+	}
+	return authorize(c, RoleOrganizer, tournamentID)
 }
@@ -0,0 +1,430 @@
+package guestbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Functions about the versioned JSON API under /api/v1. Routes are declared
+// in apiV1Routes, which is also used to generate the OpenAPI document, so the
+// document cannot get out of date. The older /request_* and /submit_* handlers
+// call the same functions as the API.
+
+const apiV1Prefix = "/api/v1"
+
+// Codes of APIError
+const (
+	ErrorCodeInvalidArgument    = "invalid_argument"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeAlreadyExists      = "already_exists"
+	ErrorCodeUnauthenticated    = "unauthenticated"
+	ErrorCodeFailedPrecondition = "failed_precondition"
+	ErrorCodePermissionDenied   = "permission_denied"
+	ErrorCodeMethodNotAllowed   = "method_not_allowed"
+	ErrorCodeInternal           = "internal"
+)
+
+// APIError is an error with a code and HTTP status. It is written to clients
+// as {"Error": {"Code": ..., "Message": ...}}.
+type APIError struct {
+	Status  int `json:"-"`
+	Code    string
+	Message string
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+// APIErrorResponse is the body of every failed API response
+type APIErrorResponse struct {
+	Error APIError
+}
+
+func invalidArgumentError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusBadRequest, Code: ErrorCodeInvalidArgument, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFoundError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusNotFound, Code: ErrorCodeNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func alreadyExistsError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusConflict, Code: ErrorCodeAlreadyExists, Message: fmt.Sprintf(format, args...)}
+}
+
+func failedPreconditionError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusBadRequest, Code: ErrorCodeFailedPrecondition, Message: fmt.Sprintf(format, args...)}
+}
+
+func permissionDeniedError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusForbidden, Code: ErrorCodePermissionDenied, Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthenticatedError(format string, args ...interface{}) error {
+	return APIError{Status: http.StatusUnauthorized, Code: ErrorCodeUnauthenticated, Message: fmt.Sprintf(format, args...)}
+}
+
+// toAPIError converts any error to an APIError. Errors which are not an
+// APIError or an AuthorizationError are internal errors.
+func toAPIError(err error) APIError {
+	switch e := err.(type) {
+	case APIError:
+		return e
+	case AuthorizationError:
+		return APIError{Status: http.StatusForbidden, Code: ErrorCodePermissionDenied, Message: e.Error()}
+	}
+	return APIError{Status: http.StatusInternalServerError, Code: ErrorCodeInternal, Message: err.Error()}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	js, errJs := json.Marshal(APIErrorResponse{Error: apiErr})
+	if errJs != nil {
+		http.Error(w, errJs.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(js)
+}
+
+// writeAPIResponse writes v as JSON, or the error if err is not nil
+func writeAPIResponse(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	js, errJs := json.Marshal(v)
+	if errJs != nil {
+		writeAPIError(w, errJs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// apiRequest is a request matched to an apiRoute
+type apiRequest struct {
+	ctx context.Context
+	r   *http.Request
+	// Values of {name} segments of the route path
+	pathParams map[string]string
+}
+
+// param returns a path parameter, or a query parameter if the path has no
+// parameter with that name
+func (req apiRequest) param(name string) string {
+	if value, ok := req.pathParams[name]; ok {
+		return value
+	}
+	return req.r.FormValue(name)
+}
+
+// header returns a header of the request
+func (req apiRequest) header(name string) string {
+	return req.r.Header.Get(name)
+}
+
+// decodeBody decodes the JSON body of the request into v
+func (req apiRequest) decodeBody(v interface{}) error {
+	if err := json.NewDecoder(req.r.Body).Decode(v); err != nil {
+		return invalidArgumentError("Invalid JSON body: %s", err.Error())
+	}
+	return nil
+}
+
+// apiParam documents a query or header parameter of an apiRoute
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+	// Header parameters are read with apiRequest.header instead of param
+	Header bool
+}
+
+// apiRoute is one operation of the API
+type apiRoute struct {
+	Method string
+	// Path after apiV1Prefix, segments in braces are path parameters
+	Path string
+	// Site-wide role needed to call the route, handlers check tournament roles
+	Role string
+	// Whether Role is needed in at least one tournament instead of site-wide,
+	// for routes working on a tournament, see withTournamentRole
+	TournamentRole bool
+	Summary        string
+	Params         []apiParam
+	// Zero values of the request body and response types, used for the
+	// OpenAPI document. Body is nil for routes without a body.
+	Body     interface{}
+	Response interface{}
+	Handle   func(req apiRequest) (interface{}, error)
+}
+
+// match returns the path parameters if the route matches method and path
+func (route apiRoute) match(method string, path string) (map[string]string, bool) {
+	routeSegments := strings.Split(strings.Trim(route.Path, "/"), "/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(routeSegments) != len(segments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, routeSegment := range routeSegments {
+		if strings.HasPrefix(routeSegment, "{") && strings.HasSuffix(routeSegment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[routeSegment[1:len(routeSegment)-1]] = segments[i]
+		} else if routeSegment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// findAPIRoute finds the route of a request path. The second value is false if
+// the path exists but not with that method.
+func findAPIRoute(routes []apiRoute, method string, path string) (*apiRoute, map[string]string, bool) {
+	pathExists := false
+	for i := range routes {
+		params, ok := routes[i].match(method, path)
+		if !ok {
+			continue
+		}
+		if routes[i].Method == method {
+			return &routes[i], params, true
+		}
+		pathExists = true
+	}
+	return nil, nil, !pathExists
+}
+
+// serveAPIV1 dispatches requests under /api/v1 to apiV1Routes
+func serveAPIV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	path := strings.TrimPrefix(r.URL.Path, apiV1Prefix)
+	route, pathParams, ok := findAPIRoute(apiV1Routes, r.Method, path)
+	if route == nil {
+		if ok {
+			writeAPIError(w, notFoundError("%s is not an API path", r.URL.Path))
+		} else {
+			writeAPIError(w, APIError{
+				Status:  http.StatusMethodNotAllowed,
+				Code:    ErrorCodeMethodNotAllowed,
+				Message: r.Method + " is not allowed on " + r.URL.Path,
+			})
+		}
+		return
+	}
+
+	if route.Role != RolePublic && currentLogin(ctx) == "" {
+		writeAPIError(w, unauthenticatedError("Login or API token is required"))
+		return
+	}
+	tournamentID := int64(0)
+	if route.TournamentRole {
+		tournamentID = anyTournament
+	}
+	if err := authorize(ctx, route.Role, tournamentID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	v, err := route.Handle(apiRequest{ctx: ctx, r: r, pathParams: pathParams})
+	writeAPIResponse(w, v, err)
+}
+
+// generateOpenAPI generates the OpenAPI 3 document of routes
+func generateOpenAPI(routes []apiRoute) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(APIErrorResponse{}), schemas),
+			},
+		},
+	}
+
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		var parameters []interface{}
+		for _, segment := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     segment[1 : len(segment)-1],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, param := range route.Params {
+			in := "query"
+			if param.Header {
+				in = "header"
+			}
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          in,
+				"description": param.Description,
+				"required":    param.Required,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+
+		operation := map[string]interface{}{
+			"summary": route.Summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": jsonSchema(reflect.TypeOf(route.Response), schemas),
+						},
+					},
+				},
+				"default": errorResponse,
+			},
+		}
+		if route.Role != RolePublic && route.TournamentRole {
+			operation["description"] = "Requires the " + route.Role + " role in the tournament."
+		} else if route.Role != RolePublic {
+			operation["description"] = "Requires the " + route.Role + " role."
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if route.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": jsonSchema(reflect.TypeOf(route.Body), schemas),
+					},
+				},
+			}
+		}
+
+		path := apiV1Prefix + route.Path
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path].(map[string]interface{})[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Okbaby rating API",
+			"version": "1",
+		},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"apiToken": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+			"schemas": schemas,
+		},
+		"security": []interface{}{
+			map[string]interface{}{"apiToken": []string{}},
+		},
+		"paths": paths,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the JSON schema of how encoding/json marshals t. Named
+// structs are added to schemas and referenced.
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exist := schemas[t.Name()]; exist {
+			return ref
+		}
+		// Placeholder for recursive types
+		schemas[t.Name()] = nil
+
+		properties := make(map[string]interface{})
+		addSchemaProperties(t, properties, schemas)
+		schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": properties}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// addSchemaProperties adds the properties of the fields of struct t. Like
+// encoding/json, fields of embedded structs without a JSON name are
+// flattened, and fields of t take precedence over them.
+func addSchemaProperties(t reflect.Type, properties map[string]interface{}, schemas map[string]interface{}) {
+	embedded := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && tag == "" && fieldType.Kind() == reflect.Struct {
+			addSchemaProperties(fieldType, embedded, schemas)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag != "" {
+			name = tag
+		}
+		properties[name] = jsonSchema(field.Type, schemas)
+	}
+
+	for name, property := range embedded {
+		if _, exist := properties[name]; !exist {
+			properties[name] = property
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package guestbook
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindAPIRoute(t *testing.T) {
+	routes := []apiRoute{
+		{Method: http.MethodGet, Path: "/players"},
+		{Method: http.MethodGet, Path: "/players/{player}"},
+		{Method: http.MethodGet, Path: "/players/{player}/matches"},
+		{Method: http.MethodPost, Path: "/players"},
+	}
+
+	tests := []struct {
+		method       string
+		path         string
+		wantedPath   string
+		wantedParams map[string]string
+		wantedExists bool
+	}{
+		{http.MethodGet, "/players", "/players", map[string]string{}, true},
+		{http.MethodPost, "/players/", "/players", map[string]string{}, true},
+		{http.MethodGet, "/players/alice", "/players/{player}", map[string]string{"player": "alice"}, true},
+		{http.MethodGet, "/players/alice/matches", "/players/{player}/matches", map[string]string{"player": "alice"}, true},
+		{http.MethodDelete, "/players/alice", "", nil, false},
+		{http.MethodGet, "/players/alice/badges", "", nil, true},
+		{http.MethodGet, "/", "", nil, true},
+	}
+
+	for _, test := range tests {
+		route, params, ok := findAPIRoute(routes, test.method, test.path)
+		if test.wantedPath == "" {
+			if route != nil {
+				t.Errorf("Wanted no route for %s %s, got %s", test.method, test.path, route.Path)
+			}
+			if ok != test.wantedExists {
+				t.Errorf("Wanted %t for %s %s, got %t", test.wantedExists, test.method, test.path, ok)
+			}
+			continue
+		}
+		if route == nil {
+			t.Errorf("Wanted route %s for %s %s, got none", test.wantedPath, test.method, test.path)
+			continue
+		}
+		if route.Path != test.wantedPath || route.Method != test.method {
+			t.Errorf("Wanted route %s %s, got %s %s", test.method, test.wantedPath, route.Method, route.Path)
+		}
+		if !reflect.DeepEqual(params, test.wantedParams) {
+			t.Errorf("Wanted params %v for %s, got %v", test.wantedParams, test.path, params)
+		}
+	}
+}
+
+func TestToAPIError(t *testing.T) {
+	tests := []struct {
+		err          error
+		wantedStatus int
+		wantedCode   string
+	}{
+		{notFoundError("user %s does not exist", "alice"), http.StatusNotFound, ErrorCodeNotFound},
+		{invalidArgumentError("bad"), http.StatusBadRequest, ErrorCodeInvalidArgument},
+		{AuthorizationError{Required: RoleAdmin}, http.StatusForbidden, ErrorCodePermissionDenied},
+		{errors.New("datastore failed"), http.StatusInternalServerError, ErrorCodeInternal},
+	}
+
+	for _, test := range tests {
+		apiErr := toAPIError(test.err)
+		if apiErr.Status != test.wantedStatus || apiErr.Code != test.wantedCode {
+			t.Errorf("Wanted %d %s for %v, got %d %s", test.wantedStatus, test.wantedCode, test.err, apiErr.Status, apiErr.Code)
+		}
+		if apiErr.Message != test.err.Error() {
+			t.Errorf("Wanted message %q, got %q", test.err.Error(), apiErr.Message)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	type inner struct {
+		When time.Time
+	}
+	type outer struct {
+		Name    string
+		Scores  []float64
+		Hidden  string `json:"-"`
+		Renamed int    `json:"renamed"`
+		Inner   inner
+		private int
+	}
+
+	schemas := make(map[string]interface{})
+	schema := jsonSchema(reflect.TypeOf(outer{}), schemas)
+	if schema["$ref"] != "#/components/schemas/outer" {
+		t.Errorf("Wanted a reference to outer, got %v", schema)
+	}
+
+	properties := schemas["outer"].(map[string]interface{})["properties"].(map[string]interface{})
+	wantedProperties := map[string]interface{}{
+		"Name":    map[string]interface{}{"type": "string"},
+		"Scores":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "number"}},
+		"renamed": map[string]interface{}{"type": "integer"},
+		"Inner":   map[string]interface{}{"$ref": "#/components/schemas/inner"},
+	}
+	if !reflect.DeepEqual(properties, wantedProperties) {
+		t.Errorf("Wanted properties %v, got %v", wantedProperties, properties)
+	}
+
+	innerProperties := schemas["inner"].(map[string]interface{})["properties"].(map[string]interface{})
+	wantedWhen := map[string]interface{}{"type": "string", "format": "date-time"}
+	if !reflect.DeepEqual(innerProperties["When"], wantedWhen) {
+		t.Errorf("Wanted %v for time, got %v", wantedWhen, innerProperties["When"])
+	}
+}
+
+func TestJSONSchemaEmbeddedStruct(t *testing.T) {
+	schemas := make(map[string]interface{})
+	jsonSchema(reflect.TypeOf(Tournament{}), schemas)
+
+	properties := schemas["Tournament"].(map[string]interface{})["properties"].(map[string]interface{})
+	for _, name := range []string{"Name", "TrueSkillBeta", "TrueSkillTau", "DrawProbability", "EloK"} {
+		if _, exist := properties[name]; !exist {
+			t.Errorf("Wanted property %s in the schema of Tournament, got %v", name, properties)
+		}
+	}
+	if _, exist := properties["RatingSettings"]; exist {
+		t.Errorf("Wanted RatingSettings flattened into Tournament, got %v", properties)
+	}
+	if _, exist := schemas["RatingSettings"]; exist {
+		t.Errorf("Wanted no schema of RatingSettings, got %v", schemas["RatingSettings"])
+	}
+}
+
+func TestGenerateOpenAPICoversAllRoutes(t *testing.T) {
+	doc := generateOpenAPI(apiV1Routes)
+	paths := doc["paths"].(map[string]interface{})
+	for _, route := range apiV1Routes {
+		operations, ok := paths[apiV1Prefix+route.Path].(map[string]interface{})
+		if !ok {
+			t.Errorf("Wanted path %s in the document", route.Path)
+			continue
+		}
+		if _, ok := operations[map[string]string{
+			http.MethodGet:    "get",
+			http.MethodPost:   "post",
+			http.MethodDelete: "delete",
+		}[route.Method]]; !ok {
+			t.Errorf("Wanted %s %s in the document", route.Method, route.Path)
+		}
+	}
+}
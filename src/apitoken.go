@@ -0,0 +1,304 @@
+package guestbook
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about API tokens, used by bots and scripts which cannot go through
+// the login flow. Tokens are sent in the Authorization header:
+//
+//	Authorization: Bearer okb_...
+//
+// Personal tokens act on behalf of their creator, and never give more than the
+// creator's current role. Service tokens are created by admins for a named
+// service.
+
+// Scopes of an APIToken
+const (
+	APITokenScopeRead   = "read"
+	APITokenScopeSubmit = "submit"
+	APITokenScopeAdmin  = "admin"
+)
+
+// Role given by each scope
+var apiTokenScopeRoles = map[string]string{
+	APITokenScopeRead:   RoleViewer,
+	APITokenScopeSubmit: RolePlayer,
+	APITokenScopeAdmin:  RoleAdmin,
+}
+
+const apiTokenPrefix = "okb_"
+
+// LastUseTime of a token is updated at most once per interval
+const apiTokenLastUseInterval = time.Minute
+
+type contextKey int
+
+// Context key of the *APIToken that authenticated a request
+const apiTokenContextKey contextKey = 0
+
+// APITokenWithKey wrapper struct for datastore
+type APITokenWithKey struct {
+	Token       APIToken
+	Tournaments []string
+	Key         string
+}
+
+// NewAPITokenResponse is returned when a token is created, it is the only time
+// the token is shown
+type NewAPITokenResponse struct {
+	Token string
+	Key   string
+}
+
+func showAPITokens(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, path.Join("static", "api_tokens.html"))
+}
+
+// generateAPIToken returns a new random token
+func generateAPIToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAPIToken is the value stored in APIToken.Hash
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenRole is the role of a token in a tournament, or site-wide if
+// tournamentID is 0. Tokens limited to some tournaments can only read
+// elsewhere.
+func apiTokenRole(token APIToken, tournamentID int64) string {
+	role := apiTokenScopeRoles[token.Scope]
+	if len(token.TournamentIDs) == 0 || roleLevels[role] <= roleLevels[RoleViewer] {
+		return role
+	}
+	for _, id := range token.TournamentIDs {
+		if (id == tournamentID || tournamentID == anyTournament) && tournamentID != 0 {
+			return role
+		}
+	}
+	return RoleViewer
+}
+
+func apiTokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenContextKey).(*APIToken)
+	return token
+}
+
+// authenticateAPIToken finds the token in the Authorization header of a
+// request. The token is nil if the header has a token which is unknown or
+// revoked.
+func authenticateAPIToken(ctx context.Context, r *http.Request) (bool, *APIToken, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return false, nil, nil
+	}
+	const bearer = "Bearer "
+	if !strings.HasPrefix(header, bearer) {
+		return true, nil, nil
+	}
+
+	var tokens []APIToken
+	keys, err := datastore.NewQuery("APIToken").Ancestor(guestbookKey(ctx)).
+		Filter("Hash =", hashAPIToken(strings.TrimSpace(header[len(bearer):]))).
+		Limit(1).
+		GetAll(ctx, &tokens)
+	if err != nil {
+		return true, nil, err
+	}
+	if len(tokens) == 0 || tokens[0].Revoked {
+		return true, nil, nil
+	}
+
+	token := tokens[0]
+	now := time.Now()
+	if now.Sub(token.LastUseTime) > apiTokenLastUseInterval {
+		token.LastUseTime = now
+		if _, err := datastore.Put(ctx, keys[0], &token); err != nil {
+			return true, nil, err
+		}
+	}
+	return true, &token, nil
+}
+
+// createAPIToken stores a new token and returns it with the key of the
+// stored APIToken. Personal tokens are owned by the current login or token
+// owner, service tokens by the service and can only be created by admins.
+// The scope cannot give more than the creator's role.
+func createAPIToken(ctx context.Context, name string, scope string, tournamentIDs []int64, service string) (string, *datastore.Key, error) {
+	scopeRole, ok := apiTokenScopeRoles[scope]
+	if !ok {
+		return "", nil, invalidArgumentError("unknown scope %q", scope)
+	}
+	if scope == APITokenScopeAdmin && len(tournamentIDs) != 0 {
+		return "", nil, invalidArgumentError("admin tokens cannot be limited to tournaments")
+	}
+
+	if service != "" {
+		if err := authorize(ctx, RoleAdmin, 0); err != nil {
+			return "", nil, err
+		}
+	} else if len(tournamentIDs) == 0 {
+		if err := authorize(ctx, scopeRole, 0); err != nil {
+			return "", nil, err
+		}
+	} else {
+		for _, tournamentID := range tournamentIDs {
+			if err := authorize(ctx, scopeRole, tournamentID); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	secret, err := generateAPIToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := APIToken{
+		Name:          name,
+		Hash:          hashAPIToken(secret),
+		Prefix:        secret[:len(apiTokenPrefix)+4],
+		Scope:         scope,
+		TournamentIDs: tournamentIDs,
+		Creator:       currentLogin(ctx),
+		CreationTime:  time.Now(),
+	}
+	if service != "" {
+		token.Owner = service
+		token.Service = true
+	} else {
+		token.Owner = currentSubmitter(ctx)
+		token.OwnerEmail = currentEmail(ctx)
+		token.OwnerAccountID = currentAccountID(ctx)
+		token.OwnerAdmin = currentIsAppAdmin(ctx)
+		if token.OwnerAccountID == "" {
+			return "", nil, failedPreconditionError("personal tokens need a login")
+		}
+	}
+
+	key := datastore.NewIncompleteKey(ctx, "APIToken", guestbookKey(ctx))
+	key, err = datastore.Put(ctx, key, &token)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// submitAPIToken creates a token. Form values are name, scope, tournaments
+// (comma separated names, optional) and service (name of the service for
+// service tokens, optional).
+func submitAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	var tournamentIDs []int64
+	for _, tournamentName := range strings.Split(r.FormValue("tournaments"), ",") {
+		tournamentName = strings.TrimSpace(tournamentName)
+		if tournamentName == "" {
+			continue
+		}
+		tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		tournamentIDs = append(tournamentIDs, tournamentKey.IntID())
+	}
+
+	secret, key, err := createAPIToken(ctx, r.FormValue("name"), r.FormValue("scope"), tournamentIDs,
+		strings.TrimSpace(r.FormValue("service")))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, NewAPITokenResponse{Token: secret, Key: key.Encode()}, nil)
+}
+
+// requestAPITokens returns the tokens owned by the current login, or all
+// tokens for admins
+func requestAPITokens(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	query := datastore.NewQuery("APIToken").Ancestor(guestbookKey(ctx)).
+		Filter("Revoked =", false)
+	if authorize(ctx, RoleAdmin, 0) != nil {
+		query = query.Filter("OwnerAccountID =", currentAccountID(ctx))
+	}
+	var tokens []APIToken
+	keys, err := query.GetAll(ctx, &tokens)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	tournamentNames, err := readTournamentNames(ctx)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	tokenWithKeys := make([]APITokenWithKey, len(tokens))
+	for i, token := range tokens {
+		tournaments := make([]string, len(token.TournamentIDs))
+		for j, tournamentID := range token.TournamentIDs {
+			tournaments[j] = tournamentNames[tournamentID]
+		}
+		tokenWithKeys[i] = APITokenWithKey{
+			Token:       token,
+			Tournaments: tournaments,
+			Key:         keys[i].Encode(),
+		}
+	}
+
+	writeAPIResponse(w, tokenWithKeys, nil)
+}
+
+// revokeAPIToken revokes a token, owners revoke their own tokens and admins
+// any token
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	key, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeAPIError(w, invalidArgumentError("invalid key: %s", err.Error()))
+		return
+	}
+	if key.Kind() != "APIToken" || !key.Parent().Equal(guestbookKey(ctx)) {
+		writeAPIError(w, invalidArgumentError("%s is not an API token", key.Kind()))
+		return
+	}
+	isAdmin := authorize(ctx, RoleAdmin, 0) == nil
+	accountID := currentAccountID(ctx)
+
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		var token APIToken
+		if err := datastore.Get(ctx, key, &token); err == datastore.ErrNoSuchEntity {
+			return notFoundError("the API token does not exist")
+		} else if err != nil {
+			return err
+		}
+		if !isAdmin && (token.Service || token.OwnerAccountID != accountID) {
+			return AuthorizationError{Required: RoleAdmin}
+		}
+		token.Revoked = true
+		_, err := datastore.Put(ctx, key, &token)
+		return err
+	}, nil)
+	writeAPIResponse(w, "OK", err)
+}
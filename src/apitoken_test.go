@@ -0,0 +1,65 @@
+package guestbook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAPITokenRole(t *testing.T) {
+	tests := []struct {
+		token        APIToken
+		tournamentID int64
+		wanted       string
+	}{
+		{APIToken{Scope: APITokenScopeRead}, 0, RoleViewer},
+		{APIToken{Scope: APITokenScopeSubmit}, 0, RolePlayer},
+		{APIToken{Scope: APITokenScopeSubmit}, 5, RolePlayer},
+		{APIToken{Scope: APITokenScopeAdmin}, 5, RoleAdmin},
+		{APIToken{Scope: APITokenScopeSubmit, TournamentIDs: []int64{5}}, 5, RolePlayer},
+		{APIToken{Scope: APITokenScopeSubmit, TournamentIDs: []int64{5}}, 6, RoleViewer},
+		{APIToken{Scope: APITokenScopeSubmit, TournamentIDs: []int64{5}}, 0, RoleViewer},
+		{APIToken{Scope: APITokenScopeRead, TournamentIDs: []int64{5}}, 6, RoleViewer},
+		{APIToken{Scope: APITokenScopeSubmit, TournamentIDs: []int64{5}}, anyTournament, RolePlayer},
+		{APIToken{Scope: "unknown"}, 0, RolePublic},
+	}
+
+	for _, test := range tests {
+		role := apiTokenRole(test.token, test.tournamentID)
+		if role != test.wanted {
+			t.Errorf("Wanted role %q for %v in tournament %d, got %q", test.wanted, test.token, test.tournamentID, role)
+		}
+	}
+}
+
+func TestMinRole(t *testing.T) {
+	if role := minRole(RoleAdmin, RolePlayer); role != RolePlayer {
+		t.Errorf("Wanted role %q, got %q", RolePlayer, role)
+	}
+	if role := minRole(RoleViewer, RoleOrganizer); role != RoleViewer {
+		t.Errorf("Wanted role %q, got %q", RoleViewer, role)
+	}
+}
+
+func TestGenerateAPIToken(t *testing.T) {
+	token, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		t.Errorf("Wanted prefix %s, got %s", apiTokenPrefix, token)
+	}
+
+	other, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other {
+		t.Errorf("Wanted different tokens, got %s twice", token)
+	}
+	if hashAPIToken(token) == hashAPIToken(other) {
+		t.Errorf("Wanted different hashes of %s and %s", token, other)
+	}
+	if hashAPIToken(token) != hashAPIToken(token) {
+		t.Errorf("Wanted the same hash of %s", token)
+	}
+}
@@ -0,0 +1,467 @@
+package guestbook
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Routes of version 1 of the API. Handlers parse the request and call the same
+// functions as the older /request_* and /submit_* handlers.
+
+// Page size of match listings, when the limit parameter is missing
+const apiDefaultLimit = 20
+
+// Largest page size of match listings
+const apiMaxLimit = 100
+
+// PlayerRequest is the body of POST /players
+type PlayerRequest struct {
+	Name string
+}
+
+// TournamentRequest is the body of POST /tournaments
+type TournamentRequest struct {
+	Name string
+}
+
+// FFAMatchRequest is the body of POST /tournaments/{tournament}/matches
+type FFAMatchRequest struct {
+	// Player names from first place to last place
+	Players []string
+	// Draws[i] is true if Players[i] and Players[i+1] are in a draw
+	Draws []bool
+	// Time the match was played, if it was not just played. Stats of later
+	// matches of its players are recalculated.
+	PlayedAt time.Time
+}
+
+// MatchRequest is the body of POST /matches
+type MatchRequest struct {
+	Winner string
+	Loser  string
+	Note   string
+}
+
+// SimulationGamesRequest is the body of POST /simulations and
+// POST /tournaments/{tournament}/simulations
+type SimulationGamesRequest struct {
+	// Games played in order, after the recorded matches
+	Games []HypotheticalGame
+}
+
+// BadgeRequest is the body of POST /players/{player}/badges
+type BadgeRequest struct {
+	Badge string
+}
+
+var matchFilterParams = []apiParam{
+	{Name: "player", Description: "Only matches of this player. For 1v1 matches it is applied to at most 500 matches read per page, so a page can have fewer matches than the limit and still a NextCursor"},
+	{Name: "submitter", Description: "Only matches submitted by this submitter"},
+	{Name: "from", Description: "Only matches played at or after this time, RFC 3339 or YYYY-MM-DD"},
+	{Name: "to", Description: "Only matches played before this time, RFC 3339 or YYYY-MM-DD"},
+	{Name: "limit", Description: "Number of matches, at most 100, 20 by default"},
+	{Name: "cursor", Description: "NextCursor of the previous page"},
+}
+
+var idempotencyKeyParam = apiParam{
+	Name:        "Idempotency-Key",
+	Description: "Unique ID of the submission, a retry with the same ID returns the first result instead of recording the match again",
+	Header:      true,
+}
+
+var apiV1Routes = []apiRoute{
+	// Players
+	{
+		Method:   http.MethodGet,
+		Path:     "/players",
+		Role:     RoleViewer,
+		Summary:  "List players",
+		Response: []UserProfile{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayers(req.ctx)
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/players",
+		Role:     RolePlayer,
+		Summary:  "Register a player",
+		Body:     PlayerRequest{},
+		Response: UserProfile{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body PlayerRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return createPlayer(req.ctx, body.Name)
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/players/{player}",
+		Role:     RoleViewer,
+		Summary:  "Get a player",
+		Response: UserProfile{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayer(req.ctx, req.param("player"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/players/{player}/matches",
+		Role:     RoleViewer,
+		Summary:  "List 1v1 matches of a player, from oldest to newest",
+		Response: []Match{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayerMatches(req.ctx, req.param("player"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/players/{player}/ffa_matches",
+		Role:     RoleViewer,
+		Summary:  "List FFA matches of a player, from oldest to newest",
+		Params:   []apiParam{{Name: "tournament", Description: "Only matches of this tournament"}},
+		Response: []UserFFAMatchEntry{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayerFFAMatches(req.ctx, req.param("player"), req.param("tournament"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/players/{player}/tournaments",
+		Role:     RoleViewer,
+		Summary:  "List stats of a player in every tournament",
+		Response: []UserTournamentSummary{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayerTournamentSummaries(req.ctx, req.param("player"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/players/{player}/badges",
+		Role:     RoleViewer,
+		Summary:  "List badges of a player",
+		Response: []Badge{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPlayerBadges(req.ctx, req.param("player"))
+		},
+	},
+	{
+		Method:         http.MethodPost,
+		Path:           "/players/{player}/badges",
+		Role:           RoleOrganizer,
+		TournamentRole: true,
+		Summary:        "Give a badge to a player, needs the organizer role of the badge's tournament",
+		Body:           BadgeRequest{},
+		Response:       "",
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body BadgeRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return "OK", giveBadge(req.ctx, req.param("player"), body.Badge)
+		},
+	},
+
+	// Tournaments
+	{
+		Method:   http.MethodGet,
+		Path:     "/tournaments",
+		Role:     RoleViewer,
+		Summary:  "List tournaments",
+		Response: []Tournament{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readTournaments(req.ctx)
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/tournaments",
+		Role:     RolePlayer,
+		Summary:  "Create a tournament organized by the caller",
+		Body:     TournamentRequest{},
+		Response: Tournament{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body TournamentRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return createTournament(req.ctx, body.Name)
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/tournaments/{tournament}/stats",
+		Role:    RoleViewer,
+		Summary: "Leaderboard of a tournament, ordered by TrueSkill rating",
+		Params: []apiParam{
+			{Name: "asOf", Description: "Leaderboard as it was at this time, RFC 3339 or YYYY-MM-DD"},
+			{Name: "compareTo", Description: "Include ranks at this time and the rank changes since then"},
+		},
+		Response: []UserProfileToShow{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			asOf, err := parseTimeParam(req.param("asOf"))
+			if err != nil {
+				return nil, err
+			}
+			compareTo, err := parseTimeParam(req.param("compareTo"))
+			if err != nil {
+				return nil, err
+			}
+			return readTournamentLeaderboard(req.ctx, req.param("tournament"), asOf, compareTo)
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tournaments/{tournament}/results",
+		Role:     RoleViewer,
+		Summary:  "Head-to-head results of all players in a tournament",
+		Response: MatchData{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readDetailMatchResults(req.ctx, req.param("tournament"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tournaments/{tournament}/predictions",
+		Role:     RoleViewer,
+		Summary:  "Accuracy and calibration of the TrueSkill predictions of FFA matches, with the biggest upsets",
+		Response: PredictionReport{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPredictionReport(req.ctx, req.param("tournament"))
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tournaments/{tournament}/batch_ratings",
+		Role:     RoleViewer,
+		Summary:  "Latest batch rating job of a tournament, with order-independent Plackett-Luce ratings and 95% confidence intervals",
+		Response: BatchRatings{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readBatchRatings(req.ctx, req.param("tournament"))
+		},
+	},
+	{
+		Method:         http.MethodPost,
+		Path:           "/tournaments/{tournament}/batch_ratings",
+		Role:           RoleOrganizer,
+		TournamentRole: true,
+		Summary:        "Start a batch rating job in the background, needs the organizer role in the tournament",
+		Response:       BatchRatings{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return startBatchRatings(req.ctx, req.param("tournament"))
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/tournaments/{tournament}/matches",
+		Role:    RoleViewer,
+		Summary: "List FFA matches of a tournament, from the last played to the first",
+		Params: append(matchFilterParams,
+			apiParam{Name: "minPlayers", Description: "Only matches with at least this many players. It is applied to at most 500 matches read per page, so a page can have fewer matches than the limit and still a NextCursor"}),
+		Response: FFAMatchPage{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			limit, filter, err := parseAPIMatchListing(req)
+			if err != nil {
+				return nil, err
+			}
+			return readFFAMatchPage(req.ctx, req.param("tournament"), filter, req.param("cursor"), limit)
+		},
+	},
+	{
+		Method:         http.MethodPost,
+		Path:           "/tournaments/{tournament}/matches",
+		Role:           RolePlayer,
+		TournamentRole: true,
+		Summary:        "Submit a FFA match, needs the player role in the tournament",
+		Params:         []apiParam{idempotencyKeyParam},
+		Body:           FFAMatchRequest{},
+		Response:       FFAMatchSubmission{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body FFAMatchRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return submitFFAMatch(req.ctx, FfaMatchResult{
+				Tournament: req.param("tournament"),
+				Players:    body.Players,
+				Draws:      body.Draws,
+				RequestID:  req.header(idempotencyKeyParam.Name),
+				PlayedAt:   body.PlayedAt,
+			})
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/tournaments/{tournament}/simulations",
+		Role:     RoleViewer,
+		Summary:  "Preview TrueSkill ratings and ranks after a sequence of hypothetical FFA matches, nothing is recorded",
+		Body:     SimulationGamesRequest{},
+		Response: []SimulatedGame{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body SimulationGamesRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return simulateGames(req.ctx, SimulationRequest{Tournament: req.param("tournament"), Games: body.Games})
+		},
+	},
+
+	// 1v1 matches of the default tournament
+	{
+		Method:   http.MethodGet,
+		Path:     "/matches",
+		Role:     RoleViewer,
+		Summary:  "List 1v1 matches, from newest to oldest",
+		Params:   matchFilterParams,
+		Response: MatchPage{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			limit, filter, err := parseAPIMatchListing(req)
+			if err != nil {
+				return nil, err
+			}
+			return readMatchPage(req.ctx, "", filter, req.param("cursor"), limit)
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/matches",
+		Role:     RolePlayer,
+		Summary:  "Submit a 1v1 match",
+		Params:   []apiParam{idempotencyKeyParam},
+		Body:     MatchRequest{},
+		Response: Match{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body MatchRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return submitLegacyMatch(req.ctx, body.Winner, body.Loser, body.Note, req.header(idempotencyKeyParam.Name))
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/simulations",
+		Role:     RoleViewer,
+		Summary:  "Preview Elo ratings and ranks after a sequence of hypothetical 1v1 matches, nothing is recorded",
+		Body:     SimulationGamesRequest{},
+		Response: []SimulatedGame{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			var body SimulationGamesRequest
+			if err := req.decodeBody(&body); err != nil {
+				return nil, err
+			}
+			return simulateGames(req.ctx, SimulationRequest{Tournament: "", Games: body.Games})
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/matches/latest",
+		Role:     RoleViewer,
+		Summary:  "Latest 1v1 match submitted by the caller, null if there is none",
+		Response: Match{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readLatestMatch(req.ctx)
+		},
+	},
+	{
+		Method:         http.MethodDelete,
+		Path:           "/matches/{key}",
+		Role:           RoleOrganizer,
+		TournamentRole: true,
+		Summary:        "Delete a 1v1 or FFA match, needs the organizer role in its tournament",
+		Response:       "",
+		Handle: func(req apiRequest) (interface{}, error) {
+			key, err := datastore.DecodeKey(req.param("key"))
+			if err != nil {
+				return nil, invalidArgumentError("invalid match key: %s", err.Error())
+			}
+			return "OK", deleteMatch(req.ctx, key)
+		},
+	},
+	{
+		Method:         http.MethodPost,
+		Path:           "/matches/{key}/retract",
+		Role:           RolePlayer,
+		TournamentRole: true,
+		Summary:        "Retract a FFA match submitted by the caller within the undo window",
+		Response:       FFAMatchRetraction{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			key, err := datastore.DecodeKey(req.param("key"))
+			if err != nil {
+				return nil, invalidArgumentError("invalid match key: %s", err.Error())
+			}
+			return retractFFAMatch(req.ctx, key)
+		},
+	},
+
+	// Stats of the default tournament
+	{
+		Method:   http.MethodGet,
+		Path:     "/stats",
+		Role:     RoleViewer,
+		Summary:  "Elo leaderboard of 1v1 matches",
+		Response: []UserProfileToShow{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readLegacyLeaderboard(req.ctx)
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/stats/results",
+		Role:     RoleViewer,
+		Summary:  "Head-to-head results of 1v1 matches",
+		Response: MatchData{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readLegacyDetailMatchResults(req.ctx)
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/stats/predictions",
+		Role:     RoleViewer,
+		Summary:  "Accuracy and calibration of the Elo predictions of 1v1 matches, with the biggest upsets",
+		Response: PredictionReport{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readPredictionReport(req.ctx, "")
+		},
+	},
+
+	// Badges
+	{
+		Method:   http.MethodGet,
+		Path:     "/badges",
+		Role:     RoleViewer,
+		Summary:  "List badges",
+		Response: []Badge{},
+		Handle: func(req apiRequest) (interface{}, error) {
+			return readBadges(req.ctx)
+		},
+	},
+}
+
+// parseAPIMatchListing reads the limit and filter parameters of a match
+// listing
+func parseAPIMatchListing(req apiRequest) (int, MatchFilter, error) {
+	limit := apiDefaultLimit
+	if limitParam := req.param("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > apiMaxLimit {
+			return 0, MatchFilter{}, invalidArgumentError(
+				"limit must be an integer between 1 and %d, got %s", apiMaxLimit, limitParam)
+		}
+	}
+
+	filter, err := parseMatchFilter(req.r)
+	return limit, filter, err
+}
+
+// serveOpenAPI serves the OpenAPI document of the API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, generateOpenAPI(apiV1Routes), nil)
+}
@@ -0,0 +1,361 @@
+package guestbook
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// Functions about role based permissions. Roles are assigned to login emails,
+// either site-wide or for a single tournament. All handlers check permissions
+// through authorize.
+
+// Roles, from the most to the least privileged
+const (
+	// Site admins can do everything. App Engine admins are always site admins.
+	RoleAdmin = "admin"
+	// Organizers edit matches, settings and badges of their tournaments
+	RoleOrganizer = "organizer"
+	// Players submit match results
+	RolePlayer = "player"
+	// Viewers can only read
+	RoleViewer = "viewer"
+	// Public handlers do not need a login, they authenticate requests in other
+	// ways if needed.
+	RolePublic = ""
+)
+
+// Role of logins without any site-wide RoleAssignment
+const defaultRole = RolePlayer
+
+// Tournament ID checked by withTournamentRole, which stands for the tournament
+// where the current login has its highest role
+const anyTournament int64 = -1
+
+var roleLevels = map[string]int{
+	RolePublic:    0,
+	RoleViewer:    1,
+	RolePlayer:    2,
+	RoleOrganizer: 3,
+	RoleAdmin:     4,
+}
+
+// RoleAssignmentWithKey wrapper struct for datastore
+type RoleAssignmentWithKey struct {
+	Assignment RoleAssignment
+	Tournament string
+	Key        string
+}
+
+// AuthorizationError is returned by authorize when the current login does not
+// have the required role
+type AuthorizationError struct {
+	Required string
+}
+
+func (e AuthorizationError) Error() string {
+	return "Permission denied: " + e.Required + " role is required"
+}
+
+// authorizationStatus is the HTTP status code of an error returned by authorize
+func authorizationStatus(err error) int {
+	if _, ok := err.(AuthorizationError); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// currentRole returns the role of the current login or API token in a
+// tournament, or the site-wide role if tournamentID is 0. A tournament role can
+// only raise the site-wide role. Personal tokens cannot give more than the
+// current role of their owner.
+func currentRole(ctx context.Context, tournamentID int64) (string, error) {
+	if token := apiTokenFromContext(ctx); token != nil {
+		role := apiTokenRole(*token, tournamentID)
+		if token.Service {
+			return role, nil
+		}
+		ownerRole, err := assignedRole(ctx, token.OwnerEmail, token.OwnerAdmin, tournamentID)
+		if err != nil {
+			return RolePublic, err
+		}
+		return minRole(role, ownerRole), nil
+	}
+
+	u := user.Current(ctx)
+	if u == nil {
+		return RolePublic, nil
+	}
+	return assignedRole(ctx, u.Email, u.Admin, tournamentID)
+}
+
+// assignedRole returns the role of a login in a tournament, or the site-wide
+// role if tournamentID is 0, from its role assignments. Admins of the app have
+// the admin role.
+func assignedRole(ctx context.Context, email string, isAdmin bool, tournamentID int64) (string, error) {
+	if isAdmin {
+		return RoleAdmin, nil
+	}
+
+	var assignments []RoleAssignment
+	if _, err := datastore.NewQuery("RoleAssignment").Ancestor(guestbookKey(ctx)).
+		Filter("Email =", strings.ToLower(email)).
+		GetAll(ctx, &assignments); err != nil {
+		return RolePublic, err
+	}
+
+	siteRole := ""
+	tournamentRole := RolePublic
+	for _, assignment := range assignments {
+		if assignment.TournamentID == 0 {
+			if siteRole == "" || roleLevels[assignment.Role] > roleLevels[siteRole] {
+				siteRole = assignment.Role
+			}
+		} else if tournamentID != 0 && (assignment.TournamentID == tournamentID || tournamentID == anyTournament) {
+			if roleLevels[assignment.Role] > roleLevels[tournamentRole] {
+				tournamentRole = assignment.Role
+			}
+		}
+	}
+	if siteRole == "" {
+		siteRole = defaultRole
+	}
+
+	if roleLevels[tournamentRole] > roleLevels[siteRole] {
+		return tournamentRole, nil
+	}
+	return siteRole, nil
+}
+
+// minRole returns the lower of two roles
+func minRole(a string, b string) string {
+	if roleLevels[b] < roleLevels[a] {
+		return b
+	}
+	return a
+}
+
+// authorize checks that the current login has at least the required role in
+// a tournament, or site-wide if tournamentID is 0.
+func authorize(ctx context.Context, required string, tournamentID int64) error {
+	if required == RolePublic {
+		return nil
+	}
+
+	role, err := currentRole(ctx, tournamentID)
+	if err != nil {
+		return err
+	}
+	if roleLevels[role] < roleLevels[required] {
+		return AuthorizationError{Required: required}
+	}
+	return nil
+}
+
+// withRole wraps a handler with a site-wide permission check.
+//
+// Requests are authenticated by the login, or by an API token in the
+// Authorization header. Handlers must create their context with newContext to
+// see the API token.
+func withRole(required string, handler http.HandlerFunc) http.HandlerFunc {
+	return withAuthorization(required, 0, handler)
+}
+
+// withTournamentRole wraps a handler working on a tournament, which needs the
+// required role in at least one tournament. The handler checks the role in
+// its tournament.
+func withTournamentRole(required string, handler http.HandlerFunc) http.HandlerFunc {
+	return withAuthorization(required, anyTournament, handler)
+}
+
+func withAuthorization(required string, tournamentID int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+
+		hasToken, token, err := authenticateAPIToken(ctx, r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		} else if hasToken {
+			if token == nil {
+				writeAPIError(w, unauthenticatedError("Invalid API token"))
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), apiTokenContextKey, token))
+			ctx = context.WithValue(ctx, apiTokenContextKey, token)
+		} else if required != RolePublic && user.Current(ctx) == nil {
+			// Browsers are sent to the login page, scripts need a token
+			if r.Method != http.MethodGet {
+				writeAPIError(w, unauthenticatedError("Login or API token is required"))
+				return
+			}
+			loginURL, err := user.LoginURL(ctx, r.URL.String())
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			http.Redirect(w, r, loginURL, http.StatusFound)
+			return
+		}
+
+		if err := authorize(ctx, required, tournamentID); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// newContext creates the context of a request, carrying the API token that
+// authenticated the request if any, and the cache of profiles and badges for
+// requests which only read
+func newContext(r *http.Request) context.Context {
+	ctx := appengine.NewContext(r)
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		ctx = withReadCache(ctx)
+	}
+	if token, ok := r.Context().Value(apiTokenContextKey).(*APIToken); ok {
+		ctx = context.WithValue(ctx, apiTokenContextKey, token)
+	}
+	return ctx
+}
+
+// currentLogin is the name of the current login, or the owner of the API
+// token. It is empty for anonymous requests.
+func currentLogin(ctx context.Context) string {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.Owner
+	}
+	if u := user.Current(ctx); u != nil {
+		return u.String()
+	}
+	return ""
+}
+
+// currentEmail is the email of the current login, or of the owner of a
+// personal API token. It is empty for service tokens and anonymous requests.
+func currentEmail(ctx context.Context) string {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.OwnerEmail
+	}
+	if u := user.Current(ctx); u != nil {
+		return u.Email
+	}
+	return ""
+}
+
+// currentIsAppAdmin is whether the current login, or the owner of a personal
+// API token, is an admin of the app
+func currentIsAppAdmin(ctx context.Context) bool {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.OwnerAdmin
+	}
+	u := user.Current(ctx)
+	return u != nil && u.Admin
+}
+
+// currentAccountID is the ID of the current login, or of the owner of a
+// personal API token. It is empty for service tokens and anonymous requests.
+func currentAccountID(ctx context.Context) string {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.OwnerAccountID
+	}
+	if u := user.Current(ctx); u != nil {
+		return u.ID
+	}
+	return ""
+}
+
+// assignRole gives a role to a login email, in a tournament if tournamentID is
+// not 0
+func assignRole(ctx context.Context, email string, role string, tournamentID int64) error {
+	if _, ok := roleLevels[role]; !ok || role == RolePublic {
+		return invalidArgumentError("unknown role %q", role)
+	}
+	if role == RoleAdmin && tournamentID != 0 {
+		return invalidArgumentError("%s role can only be assigned site-wide", RoleAdmin)
+	}
+
+	assignment := RoleAssignment{
+		Email:        strings.ToLower(strings.TrimSpace(email)),
+		Role:         role,
+		TournamentID: tournamentID,
+	}
+	if assignment.Email == "" {
+		return invalidArgumentError("email is missing")
+	}
+
+	key := datastore.NewIncompleteKey(ctx, "RoleAssignment", guestbookKey(ctx))
+	_, err := datastore.Put(ctx, key, &assignment)
+	return err
+}
+
+func submitRole(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	var tournamentID int64
+	if tournamentName := r.FormValue("tournament"); tournamentName != "" {
+		tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		tournamentID = tournamentKey.IntID()
+	}
+
+	if err := assignRole(ctx, r.FormValue("email"), r.FormValue("role"), tournamentID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+func deleteRole(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	key, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeAPIError(w, invalidArgumentError("invalid key: %s", err.Error()))
+		return
+	}
+	// Only role assignments can be deleted with this handler
+	if key.Kind() != "RoleAssignment" || !key.Parent().Equal(guestbookKey(ctx)) {
+		writeAPIError(w, invalidArgumentError("%s is not a role assignment", key.Kind()))
+		return
+	}
+	err = datastore.Delete(ctx, key)
+	writeAPIResponse(w, "OK", err)
+}
+
+func requestRoles(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	var assignments []RoleAssignment
+	keys, err := datastore.NewQuery("RoleAssignment").Ancestor(guestbookKey(ctx)).GetAll(ctx, &assignments)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	tournamentNames, err := readTournamentNames(ctx)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	assignmentWithKeys := make([]RoleAssignmentWithKey, len(assignments))
+	for i, assignment := range assignments {
+		assignmentWithKeys[i] = RoleAssignmentWithKey{
+			Assignment: assignment,
+			Tournament: tournamentNames[assignment.TournamentID],
+			Key:        keys[i].Encode(),
+		}
+	}
+
+	writeAPIResponse(w, assignmentWithKeys, nil)
+}
@@ -0,0 +1,335 @@
+package guestbook
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+)
+
+// Functions about batch ratings, which fit a Plackett-Luce model to the whole
+// FFA match history of a tournament at once. Unlike Elo and TrueSkill they do
+// not depend on the order of matches. Each match is a sequence of choices: the
+// first place is chosen among all players, the second place among the others,
+// and so on. Players in a draw are all chosen among the players placed with or
+// after them (Breslow's approximation). The strengths are fitted with the MM
+// algorithm of Hunter (2004), with one virtual win and one virtual loss of
+// every player against a player of initial rating, so that players who never
+// won or never lost have a finite rating.
+//
+// Fitting runs as a background task, and its results are stored in one
+// BatchRatings entity per tournament.
+
+// States of a batch rating job
+const (
+	BatchRatingsRunning = "running"
+	BatchRatingsDone    = "done"
+	BatchRatingsFailed  = "failed"
+)
+
+// A running job can be started again after this duration, in case its task
+// was lost
+const batchRatingsTimeout = 10 * time.Minute
+
+// The fit stops when no log-strength changes more than this, or after
+// batchRatingsMaxIterations
+const (
+	batchRatingsTolerance     = 1e-9
+	batchRatingsMaxIterations = 10000
+)
+
+// Z-score of the 95% confidence intervals
+const batchRatingsZScore = 1.96
+
+// Ratings are on the Elo scale: a difference of 400 points means odds of 10
+// to 1
+var batchRatingsScale = 400 / math.Ln10
+
+// BatchRatings is the latest batch rating job of a tournament
+type BatchRatings struct {
+	TournamentID int64
+	// Not stored
+	Tournament string `datastore:"-"`
+	// One of BatchRatingsRunning, BatchRatingsDone and BatchRatingsFailed
+	Status         string
+	Error          string `datastore:",noindex"`
+	RequestTime    time.Time
+	CompletionTime time.Time
+	// Number of matches and iterations of the last completed fit
+	Matches    int
+	Iterations int
+	// JSON of Ratings, which has too many values to be stored as properties
+	RatingsJSON []byte `json:"-"`
+
+	// Ratings of the last completed fit, from the best
+	Ratings []BatchRating `datastore:"-"`
+}
+
+// BatchRating is the rating of a player fitted on all matches of a tournament,
+// with a 95% confidence interval
+type BatchRating struct {
+	UserID int64
+	// Not stored
+	Name   string `json:",omitempty"`
+	Games  int
+	Rating float64
+	Lower  float64
+	Upper  float64
+}
+
+// plackettLuceStage is a choice of one or more players in a match: the players
+// of a placement are chosen among the players placed with or after them
+type plackettLuceStage struct {
+	// Indexes of the players who can be chosen
+	candidates []int
+	// Number of players chosen
+	chosen int
+}
+
+func batchRatingsKey(ctx context.Context, tournamentID int64) *datastore.Key {
+	return datastore.NewKey(ctx, "BatchRatings", "", tournamentID, guestbookKey(ctx))
+}
+
+// fitPlackettLuce fits the ratings of all players of the matches. It returns
+// ratings ordered from the best, and the number of iterations of the fit.
+func fitPlackettLuce(matches []FFAMatch) ([]BatchRating, int) {
+	indexes := make(map[int64]int)
+	var ratings []BatchRating
+	var wins []float64
+	var stages []plackettLuceStage
+	for _, match := range matches {
+		players := make([]int, len(match.Players))
+		for i, userID := range match.Players {
+			index, exist := indexes[userID]
+			if !exist {
+				index = len(ratings)
+				indexes[userID] = index
+				ratings = append(ratings, BatchRating{UserID: userID})
+				wins = append(wins, 0)
+			}
+			ratings[index].Games++
+			players[i] = index
+		}
+
+		// The last placement is not a choice, since nobody is placed after
+		for start := 0; start < len(players); {
+			end := start + 1
+			for end < len(players) && match.Draws[end-1] {
+				end++
+			}
+			if end == len(players) {
+				break
+			}
+			for _, index := range players[start:end] {
+				wins[index]++
+			}
+			stages = append(stages, plackettLuceStage{candidates: players[start:], chosen: end - start})
+			start = end
+		}
+	}
+
+	// Strengths relative to the virtual player, whose strength is 1
+	strengths := make([]float64, len(ratings))
+	for i := range strengths {
+		strengths[i] = 1
+	}
+	denominators := make([]float64, len(ratings))
+	iterations := 0
+	for iterations < batchRatingsMaxIterations {
+		iterations++
+		for i, strength := range strengths {
+			denominators[i] = 2 / (strength + 1)
+		}
+		for _, stage := range stages {
+			sum := 0.0
+			for _, index := range stage.candidates {
+				sum += strengths[index]
+			}
+			for _, index := range stage.candidates {
+				denominators[index] += float64(stage.chosen) / sum
+			}
+		}
+
+		change := 0.0
+		for i := range strengths {
+			strength := (wins[i] + 1) / denominators[i]
+			change = math.Max(change, math.Abs(math.Log(strength/strengths[i])))
+			strengths[i] = strength
+		}
+		if change < batchRatingsTolerance {
+			break
+		}
+	}
+
+	// Confidence intervals use the diagonal of the Fisher information of the
+	// log-strengths, which ignores the covariance between players
+	information := make([]float64, len(ratings))
+	for i, strength := range strengths {
+		p := strength / (strength + 1)
+		information[i] = 2 * p * (1 - p)
+	}
+	for _, stage := range stages {
+		sum := 0.0
+		for _, index := range stage.candidates {
+			sum += strengths[index]
+		}
+		for _, index := range stage.candidates {
+			p := strengths[index] / sum
+			information[index] += float64(stage.chosen) * p * (1 - p)
+		}
+	}
+
+	for i, strength := range strengths {
+		rating := &ratings[i]
+		rating.Rating = InitialRating + batchRatingsScale*math.Log(strength)
+		margin := batchRatingsZScore * batchRatingsScale / math.Sqrt(information[i])
+		rating.Lower = rating.Rating - margin
+		rating.Upper = rating.Rating + margin
+	}
+	sort.SliceStable(ratings, func(i, j int) bool {
+		return ratings[i].Rating > ratings[j].Rating
+	})
+	return ratings, iterations
+}
+
+var computeBatchRatingsLater = delay.Func("computeBatchRatings", computeBatchRatings)
+
+// computeBatchRatings fits the batch ratings of a tournament and stores them,
+// it runs as a background task started by startBatchRatings. Failures are
+// stored in the job instead of retrying the task.
+func computeBatchRatings(ctx context.Context, tournamentID int64) error {
+	var matches []FFAMatch
+	_, fitErr := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		GetAll(ctx, &matches)
+
+	var ratings []BatchRating
+	var iterations int
+	var ratingsJSON []byte
+	if fitErr == nil {
+		ratings, iterations = fitPlackettLuce(matches)
+		ratingsJSON, fitErr = json.Marshal(ratings)
+	}
+
+	return runInTransaction(ctx, func(ctx context.Context) error {
+		key := batchRatingsKey(ctx, tournamentID)
+		var job BatchRatings
+		if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		job.TournamentID = tournamentID
+		job.CompletionTime = time.Now()
+		if fitErr != nil {
+			job.Status = BatchRatingsFailed
+			job.Error = fitErr.Error()
+		} else {
+			job.Status = BatchRatingsDone
+			job.Error = ""
+			job.Matches = len(matches)
+			job.Iterations = iterations
+			job.RatingsJSON = ratingsJSON
+		}
+		_, err := datastore.Put(ctx, key, &job)
+		return err
+	}, nil)
+}
+
+// startBatchRatings starts a batch rating job of a tournament in the
+// background. Ratings of the previous job are kept until the new one is done.
+func startBatchRatings(ctx context.Context, tournamentName string) (BatchRatings, error) {
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return BatchRatings{}, err
+	}
+	tournamentID := tournamentKey.IntID()
+	if err := authorize(ctx, RoleOrganizer, tournamentID); err != nil {
+		return BatchRatings{}, err
+	}
+
+	var job BatchRatings
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		key := batchRatingsKey(ctx, tournamentID)
+		job = BatchRatings{}
+		if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		if job.Status == BatchRatingsRunning && now.Sub(job.RequestTime) < batchRatingsTimeout {
+			return failedPreconditionError("batch ratings of %s are already running", tournamentName)
+		}
+
+		job.TournamentID = tournamentID
+		job.Status = BatchRatingsRunning
+		job.Error = ""
+		job.RequestTime = now
+		if _, err := datastore.Put(ctx, key, &job); err != nil {
+			return err
+		}
+		// The task is only added if the transaction commits
+		return computeBatchRatingsLater.Call(ctx, tournamentID)
+	}, nil)
+	if err != nil {
+		return BatchRatings{}, err
+	}
+
+	job.Tournament = tournamentName
+	job.Ratings = []BatchRating{}
+	return job, nil
+}
+
+// readBatchRatings reads the latest batch rating job of a tournament, with the
+// ratings of its last completed fit
+func readBatchRatings(ctx context.Context, tournamentName string) (BatchRatings, error) {
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return BatchRatings{}, err
+	}
+
+	var job BatchRatings
+	if err := datastore.Get(ctx, batchRatingsKey(ctx, tournamentKey.IntID()), &job); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return BatchRatings{}, notFoundError("batch ratings of %s were never computed", tournamentName)
+		}
+		return BatchRatings{}, err
+	}
+	job.Tournament = tournamentName
+
+	job.Ratings = []BatchRating{}
+	if len(job.RatingsJSON) > 0 {
+		if err := json.Unmarshal(job.RatingsJSON, &job.Ratings); err != nil {
+			return BatchRatings{}, err
+		}
+	}
+	userIDs := make([]int64, len(job.Ratings))
+	for i, rating := range job.Ratings {
+		userIDs[i] = rating.UserID
+	}
+	profiles, err := readUserIDAndProfileMapping(ctx, userIDs)
+	if err != nil {
+		return BatchRatings{}, err
+	}
+	for i := range job.Ratings {
+		job.Ratings[i].Name = profiles[job.Ratings[i].UserID].Name
+	}
+	return job, nil
+}
+
+// runBatchRatings starts the batch rating job of a tournament, which needs the
+// organizer role in it
+func runBatchRatings(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, err := startBatchRatings(ctx, r.FormValue("tournament"))
+	writeAPIResponse(w, job, err)
+}
+
+// requestBatchRatings responds the latest batch rating job of a tournament
+func requestBatchRatings(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, err := readBatchRatings(ctx, r.FormValue("tournament"))
+	writeAPIResponse(w, job, err)
+}
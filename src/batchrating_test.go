@@ -0,0 +1,66 @@
+package guestbook
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitPlackettLuce(t *testing.T) {
+	matches := []FFAMatch{
+		{Players: []int64{10, 11, 12}, Draws: []bool{false, false}},
+		{Players: []int64{10, 12, 11}, Draws: []bool{false, false}},
+		{Players: []int64{11, 10, 12}, Draws: []bool{false, false}},
+		{Players: []int64{10, 11}, Draws: []bool{false}},
+		{Players: []int64{12, 13}, Draws: []bool{true}},
+	}
+
+	ratings, iterations := fitPlackettLuce(matches)
+	if iterations >= batchRatingsMaxIterations {
+		t.Errorf("Wanted the fit to converge, got %d iterations", iterations)
+	}
+	if len(ratings) != 4 {
+		t.Fatalf("Wanted 4 ratings, got %d", len(ratings))
+	}
+	ratingMap := make(map[int64]BatchRating)
+	for _, rating := range ratings {
+		ratingMap[rating.UserID] = rating
+	}
+	if ratings[0].UserID != 10 || ratings[0].Games != 4 || ratingMap[11].Rating <= ratingMap[12].Rating {
+		t.Errorf("Wanted player 10 with 4 games first and player 11 above player 12, got %+v", ratings)
+	}
+	for _, rating := range ratings {
+		if !(rating.Lower < rating.Rating && rating.Rating < rating.Upper) {
+			t.Errorf("Wanted the rating within its interval, got %+v", rating)
+		}
+		// A draw of two players is not a choice
+		if rating.UserID == 13 && (math.Abs(rating.Rating-InitialRating) > 1e-3 || rating.Games != 1) {
+			t.Errorf("Wanted the initial rating of a player who only drew, got %+v", rating)
+		}
+	}
+
+	// Ratings do not depend on the order of matches
+	reversed := make([]FFAMatch, len(matches))
+	for i, match := range matches {
+		reversed[len(matches)-1-i] = match
+	}
+	reversedRatings, _ := fitPlackettLuce(reversed)
+	for i, rating := range reversedRatings {
+		if rating.UserID != ratings[i].UserID || math.Abs(rating.Rating-ratings[i].Rating) > 1e-6 {
+			t.Errorf("Wanted %+v, got %+v", ratings[i], rating)
+		}
+	}
+}
+
+func TestFitPlackettLuceDraws(t *testing.T) {
+	matches := []FFAMatch{
+		{Players: []int64{10, 11, 12}, Draws: []bool{true, false}},
+	}
+
+	ratings, _ := fitPlackettLuce(matches)
+	if math.Abs(ratings[0].Rating-ratings[1].Rating) > 1e-6 || ratings[2].UserID != 12 {
+		t.Errorf("Wanted equal ratings of players 10 and 11 above player 12, got %+v", ratings)
+	}
+	if ratings[1].Rating <= InitialRating || ratings[2].Rating >= InitialRating {
+		t.Errorf("Wanted winners above and the loser below the initial rating, got %+v", ratings)
+	}
+}
@@ -0,0 +1,169 @@
+package guestbook
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about the request-scoped cache of player profiles and badges.
+// Leaderboards show the profile and badges of every player, which are read in
+// a few batches instead of a few reads per player. Only requests which do not
+// change data have a cache, and transactions never use it, so that a cached
+// profile or badge is never written back or checked against.
+
+type readCacheContextKeyType struct{}
+
+var readCacheContextKey = readCacheContextKeyType{}
+
+// profileLoader reads profiles and badges in batches. Requests use
+// datastoreProfileLoader, tests and benchmarks use an in-memory loader.
+type profileLoader interface {
+	// loadProfiles reads profiles in the order of userIDs
+	loadProfiles(ctx context.Context, userIDs []int64) ([]UserProfile, error)
+	// loadBadges reads every Badge and UserBadge
+	loadBadges(ctx context.Context) ([]Badge, []UserBadge, error)
+}
+
+type datastoreProfileLoader struct{}
+
+func (datastoreProfileLoader) loadProfiles(ctx context.Context, userIDs []int64) ([]UserProfile, error) {
+	keys := make([]*datastore.Key, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = datastore.NewKey(ctx, "UserProfile", "", userID, guestbookKey(ctx))
+	}
+
+	profiles := make([]UserProfile, len(userIDs))
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(keys))
+		if err := datastore.GetMulti(ctx, keys[start:end], profiles[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+func (datastoreProfileLoader) loadBadges(ctx context.Context) ([]Badge, []UserBadge, error) {
+	var badges []Badge
+	if _, err := datastore.NewQuery("Badge").Ancestor(guestbookKey(ctx)).GetAll(ctx, &badges); err != nil {
+		return nil, nil, err
+	}
+	var userBadges []UserBadge
+	if _, err := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(ctx)).GetAll(ctx, &userBadges); err != nil {
+		return nil, nil, err
+	}
+	return badges, userBadges, nil
+}
+
+// readCache caches profiles and badges read during a request
+type readCache struct {
+	loader profileLoader
+
+	mutex    sync.Mutex
+	profiles map[int64]UserProfile
+	// Badges by name and badge names by user name, nil until loaded
+	badges     map[string]Badge
+	userBadges map[string][]string
+}
+
+func newReadCache(loader profileLoader) *readCache {
+	return &readCache{
+		loader:   loader,
+		profiles: make(map[int64]UserProfile),
+	}
+}
+
+// withReadCache returns a context carrying a new readCache
+func withReadCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readCacheContextKey, newReadCache(datastoreProfileLoader{}))
+}
+
+// withoutReadCache returns a context whose reads bypass the cache
+func withoutReadCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readCacheContextKey, (*readCache)(nil))
+}
+
+// runInTransaction is datastore.RunInTransaction without the request cache,
+// transactions read what they write from datastore
+func runInTransaction(ctx context.Context, f func(ctx context.Context) error, opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(withoutReadCache(ctx), f, opts)
+}
+
+// requestReadCache returns the cache of the request, or a cache used only by
+// the caller if the context has none
+func requestReadCache(ctx context.Context) *readCache {
+	if cache, ok := ctx.Value(readCacheContextKey).(*readCache); ok && cache != nil {
+		return cache
+	}
+	return newReadCache(datastoreProfileLoader{})
+}
+
+// readProfiles returns profiles in the order of userIDs, reading the ones
+// which are not cached yet in one batch
+func (c *readCache) readProfiles(ctx context.Context, userIDs []int64) ([]UserProfile, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var missingIDs []int64
+	missing := make(map[int64]bool)
+	for _, userID := range userIDs {
+		if _, cached := c.profiles[userID]; !cached && !missing[userID] {
+			missing[userID] = true
+			missingIDs = append(missingIDs, userID)
+		}
+	}
+
+	if len(missingIDs) != 0 {
+		profiles, err := c.loader.loadProfiles(ctx, missingIDs)
+		if err != nil {
+			return nil, err
+		}
+		for i, profile := range profiles {
+			c.profiles[missingIDs[i]] = profile
+		}
+	}
+
+	profiles := make([]UserProfile, len(userIDs))
+	for i, userID := range userIDs {
+		profiles[i] = c.profiles[userID]
+	}
+	return profiles, nil
+}
+
+// readUserBadges returns the badges of a player. It is empty if one of the
+// badges of the player does not exist anymore.
+func (c *readCache) readUserBadges(ctx context.Context, userName string) ([]Badge, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.badges == nil {
+		badges, userBadges, err := c.loader.loadBadges(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.badges = make(map[string]Badge)
+		for _, badge := range badges {
+			if _, exist := c.badges[badge.Name]; !exist {
+				c.badges[badge.Name] = badge
+			}
+		}
+		c.userBadges = make(map[string][]string)
+		for _, userBadge := range userBadges {
+			if _, exist := c.userBadges[userBadge.User]; !exist {
+				c.userBadges[userBadge.User] = userBadge.BadgeNames
+			}
+		}
+	}
+
+	badgeNames := c.userBadges[userName]
+	badges := make([]Badge, len(badgeNames))
+	for i, badgeName := range badgeNames {
+		badge, exist := c.badges[badgeName]
+		if !exist {
+			return []Badge{}, nil
+		}
+		badges[i] = badge
+	}
+	return badges, nil
+}
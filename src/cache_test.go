@@ -0,0 +1,141 @@
+package guestbook
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// memoryProfileLoader is an in-memory profileLoader counting its round trips
+type memoryProfileLoader struct {
+	profiles   map[int64]UserProfile
+	badges     []Badge
+	userBadges []UserBadge
+	roundTrips int
+}
+
+func (l *memoryProfileLoader) loadProfiles(ctx context.Context, userIDs []int64) ([]UserProfile, error) {
+	l.roundTrips++
+	profiles := make([]UserProfile, len(userIDs))
+	for i, userID := range userIDs {
+		profiles[i] = l.profiles[userID]
+	}
+	return profiles, nil
+}
+
+func (l *memoryProfileLoader) loadBadges(ctx context.Context) ([]Badge, []UserBadge, error) {
+	l.roundTrips++
+	return l.badges, l.userBadges, nil
+}
+
+// newMemoryProfileLoader creates players with IDs 1 to numPlayers, each with
+// two badges
+func newMemoryProfileLoader(numPlayers int) (*memoryProfileLoader, []int64) {
+	l := &memoryProfileLoader{
+		profiles: make(map[int64]UserProfile),
+		badges:   []Badge{{Name: "champion"}, {Name: "rookie"}},
+	}
+	userIDs := make([]int64, numPlayers)
+	for i := range userIDs {
+		userIDs[i] = int64(i + 1)
+		name := fmt.Sprintf("player%d", i+1)
+		l.profiles[userIDs[i]] = UserProfile{Name: name}
+		l.userBadges = append(l.userBadges, UserBadge{User: name, BadgeNames: []string{"champion", "rookie"}})
+	}
+	return l, userIDs
+}
+
+// readLeaderboardRows reads what a leaderboard shows of every player
+func readLeaderboardRows(ctx context.Context, cache *readCache, userIDs []int64) error {
+	profiles, err := cache.readProfiles(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+	for _, profile := range profiles {
+		if _, err := cache.readUserBadges(ctx, profile.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestReadCacheRoundTrips(t *testing.T) {
+	ctx := context.Background()
+	loader, userIDs := newMemoryProfileLoader(40)
+	cache := newReadCache(loader)
+
+	if err := readLeaderboardRows(ctx, cache, userIDs); err != nil {
+		t.Fatal(err)
+	}
+	if loader.roundTrips != 2 {
+		t.Errorf("Wanted 2 round trips for 40 players, got %d", loader.roundTrips)
+	}
+
+	// A second leaderboard in the same request is cached
+	if err := readLeaderboardRows(ctx, cache, userIDs); err != nil {
+		t.Fatal(err)
+	}
+	if loader.roundTrips != 2 {
+		t.Errorf("Wanted no more round trips for cached players, got %d", loader.roundTrips)
+	}
+}
+
+func TestReadCacheUserBadges(t *testing.T) {
+	ctx := context.Background()
+	loader, _ := newMemoryProfileLoader(1)
+	loader.userBadges = append(loader.userBadges, UserBadge{User: "deleted", BadgeNames: []string{"champion", "gone"}})
+	cache := newReadCache(loader)
+
+	badges, err := cache.readUserBadges(ctx, "player1")
+	if err != nil || len(badges) != 2 || badges[0].Name != "champion" || badges[1].Name != "rookie" {
+		t.Errorf("Wanted champion and rookie badges, got %v, %v", badges, err)
+	}
+	if badges, _ := cache.readUserBadges(ctx, "deleted"); len(badges) != 0 {
+		t.Errorf("Wanted no badges when one does not exist, got %v", badges)
+	}
+	if badges, _ := cache.readUserBadges(ctx, "nobody"); len(badges) != 0 {
+		t.Errorf("Wanted no badges of a player without badges, got %v", badges)
+	}
+}
+
+func TestWithoutReadCache(t *testing.T) {
+	ctx := withReadCache(context.Background())
+	if requestReadCache(ctx) != requestReadCache(ctx) {
+		t.Errorf("Wanted the same cache for the whole request")
+	}
+
+	// As in transactions
+	ctx = withoutReadCache(ctx)
+	if requestReadCache(ctx) == requestReadCache(ctx) {
+		t.Errorf("Wanted a cache for every read without the request cache")
+	}
+}
+
+func BenchmarkReadLeaderboardRows(b *testing.B) {
+	ctx := context.Background()
+	loader, userIDs := newMemoryProfileLoader(40)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := readLeaderboardRows(ctx, newReadCache(loader), userIDs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadLeaderboardRowsUncached reads every row with its own cache, as
+// reads were before the request cache
+func BenchmarkReadLeaderboardRowsUncached(b *testing.B) {
+	ctx := context.Background()
+	loader, userIDs := newMemoryProfileLoader(40)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, userID := range userIDs {
+			if err := readLeaderboardRows(ctx, newReadCache(loader), []int64{userID}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
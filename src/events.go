@@ -0,0 +1,194 @@
+package guestbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about the per-tournament Server-Sent Events stream.
+//
+// The go1 runtime buffers whole responses, so the stream is a long poll: a
+// request polls datastore for changes since the last event, and returns as
+// soon as it has found some, or before App Engine's deadline. EventSource then
+// reconnects and resumes with the Last-Event-ID header.
+//
+// A match event is sent for every new match. A stats event is sent whenever
+// the StatsVersion of the tournament changes, which includes retractions,
+// deletions and replays, and tells clients to read the leaderboard again. The
+// event ID is "<time>.<version>": the submission time in nanoseconds of the
+// last match sent, and the last StatsVersion sent. Every response sets it,
+// even without events, so that a reconnection misses nothing.
+
+const (
+	// A request without changes returns before App Engine's 60 seconds
+	// deadline
+	eventStreamDuration     = 50 * time.Second
+	eventStreamPollInterval = 2 * time.Second
+	// Milliseconds the browser should wait before reconnecting
+	eventStreamRetry = 1000
+)
+
+// Names of the events sent on the tournament stream
+const (
+	eventMatch = "match"
+	eventStats = "stats"
+	eventError = "error"
+)
+
+// StatsEvent is the data of a stats event
+type StatsEvent struct {
+	StatsVersion int64
+}
+
+func streamTournamentEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	tournamentName := r.FormValue("tournament")
+	if tournamentName == "" {
+		http.Error(w, "tournament parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	exist, tournamentKey, tournament, err := findExistingTournament(ctx, tournamentName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !exist {
+		http.Error(w, "tournament "+tournamentName+" does not exist", http.StatusBadRequest)
+		return
+	}
+
+	// Resume after the last event the client has received, or start with
+	// changes from now on.
+	lastEventTime := time.Now()
+	lastVersion := tournament.StatsVersion
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue("lastEventId")
+	}
+	if lastEventID != "" {
+		lastEventTime, lastVersion, err = parseEventID(lastEventID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n", eventStreamRetry)
+	fmt.Fprintf(w, "id: %s\n\n", formatEventID(lastEventTime, lastVersion))
+
+	deadline := time.Now().Add(eventStreamDuration)
+	for {
+		// The version is read before the matches, so that a match submitted
+		// in between is sent with the next stats event
+		var tournament Tournament
+		if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+			writeEvent(w, "", eventError, err.Error())
+			return
+		}
+		matchWithKeys, err := readFFAMatchesSince(ctx, tournamentKey.IntID(), lastEventTime)
+		if err != nil {
+			writeEvent(w, "", eventError, err.Error())
+			return
+		}
+
+		for _, matchWithKey := range matchWithKeys {
+			lastEventTime = matchWithKey.Match.SubmissionTime
+			if err := writeEvent(w, formatEventID(lastEventTime, lastVersion), eventMatch, matchWithKey); err != nil {
+				return
+			}
+		}
+		if tournament.StatsVersion != lastVersion {
+			lastVersion = tournament.StatsVersion
+			writeEvent(w, formatEventID(lastEventTime, lastVersion), eventStats, StatsEvent{StatsVersion: lastVersion})
+			return
+		}
+		if len(matchWithKeys) > 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			// EventSource reconnects when the response ends
+			fmt.Fprintf(w, ": no changes\nid: %s\n\n", formatEventID(lastEventTime, lastVersion))
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventStreamPollInterval):
+		}
+	}
+}
+
+func formatEventID(lastEventTime time.Time, version int64) string {
+	return fmt.Sprintf("%d.%d", lastEventTime.UnixNano(), version)
+}
+
+// parseEventID is the reverse of formatEventID. IDs sent before stats events
+// only had the time, those resume without a stats version, which sends one.
+func parseEventID(id string) (time.Time, int64, error) {
+	parts := strings.SplitN(id, ".", 2)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid last event ID %s", id)
+	}
+	version := int64(-1)
+	if len(parts) == 2 {
+		version, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid last event ID %s", id)
+		}
+	}
+	return time.Unix(0, nanos), version, nil
+}
+
+// readFFAMatchesSince reads matches of a tournament submitted after the given
+// time, from oldest to newest.
+func readFFAMatchesSince(ctx context.Context, tournamentID int64, since time.Time) ([]FFAMatchWithKey, error) {
+	query := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		Filter("SubmissionTime >", since).
+		Order("SubmissionTime")
+	var matches []FFAMatch
+	keys, err := query.GetAll(ctx, &matches)
+	if err != nil {
+		return nil, err
+	}
+
+	matchWithKeys := make([]FFAMatchWithKey, len(matches))
+	for i, m := range matches {
+		matchWithKeys[i] = FFAMatchWithKey{
+			Match: m,
+			Key:   keys[i].Encode(),
+		}
+	}
+
+	if err := fillInFFAMatchPlayerNames(ctx, matchWithKeys); err != nil {
+		return nil, err
+	}
+	return matchWithKeys, nil
+}
+
+// writeEvent writes one Server-Sent Event with JSON encoded data
+func writeEvent(w http.ResponseWriter, id string, event string, data interface{}) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	return err
+}
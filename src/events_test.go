@@ -0,0 +1,30 @@
+package guestbook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEventID(t *testing.T) {
+	at := time.Unix(1500000000, 123)
+	gotTime, gotVersion, err := parseEventID(formatEventID(at, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(at) || gotVersion != 7 {
+		t.Errorf("Wanted %v and version 7, got %v and %d", at, gotTime, gotVersion)
+	}
+
+	// IDs without a stats version resume with an unknown version
+	gotTime, gotVersion, err = parseEventID("1500000000000000123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(at) || gotVersion != -1 {
+		t.Errorf("Wanted %v and version -1, got %v and %d", at, gotTime, gotVersion)
+	}
+
+	if _, _, err := parseEventID("1500000000000000123.x"); err == nil {
+		t.Errorf("Wanted an error for an invalid version")
+	}
+}
@@ -0,0 +1,341 @@
+package guestbook
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about Atom feeds of match results. A feed is site-wide by default,
+// and can be narrowed down with the "tournament" and "user" parameters:
+//
+//   /feed
+//   /feed?tournament=Catan
+//   /feed?user=alice
+//
+// FFAMatch and legacy Match records are included, as well as FFA matches
+// retracted by their submitter. Feeds are public, so submitters who are not a
+// player or a service are shown as feedRedactedAuthor.
+
+// Maximum number of entries in a feed
+const feedSize = 50
+
+// Author of entries whose submitter is stored as a login
+const feedRedactedAuthor = "Unlinked account"
+
+// AtomFeed is the root element of an Atom feed (RFC 4287)
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+// AtomEntry is a match result in an Atom feed
+type AtomEntry struct {
+	Title    string        `xml:"title"`
+	ID       string        `xml:"id"`
+	Updated  string        `xml:"updated"`
+	Author   AtomPerson    `xml:"author"`
+	Category *AtomCategory `xml:"category,omitempty"`
+	Content  AtomContent   `xml:"content"`
+
+	// Used to sort entries from different kinds of matches
+	time time.Time
+}
+
+// AtomLink is a link element of a feed or an entry
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// AtomPerson is the author of an entry
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+// AtomCategory is the tournament of an entry
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// AtomContent is the text content of an entry
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func requestFeed(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	tournamentName := r.FormValue("tournament")
+	userName := r.FormValue("user")
+
+	tournamentNames, err := readTournamentNames(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// FFA matches
+	ffaQuery := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx))
+	retractionQuery := datastore.NewQuery("FFAMatchRetraction").Ancestor(guestbookKey(ctx))
+	// Legacy 1v1 matches, by winner and by loser if filtered by user
+	matchQueries := []*datastore.Query{datastore.NewQuery("Match").Ancestor(guestbookKey(ctx))}
+
+	if tournamentName != "" {
+		tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ffaQuery = ffaQuery.Filter("TournamentID =", tournamentKey.IntID())
+		retractionQuery = retractionQuery.Filter("TournamentID =", tournamentKey.IntID())
+		matchQueries[0] = matchQueries[0].Filter("Tournament =", tournamentName)
+	}
+
+	if userName != "" {
+		userKey, err := findUserKey(ctx, userName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ffaQuery = ffaQuery.Filter("Players =", userKey.IntID())
+		retractionQuery = retractionQuery.Filter("Players =", userKey.IntID())
+		matchQueries = []*datastore.Query{
+			matchQueries[0].Filter("Winner =", userName),
+			matchQueries[0].Filter("Loser =", userName),
+		}
+	}
+
+	idPrefix := fmt.Sprintf("tag:%s.appspot.com,2018:", appengine.AppID(ctx))
+	var entries []AtomEntry
+
+	var ffaMatches []FFAMatch
+	ffaKeys, err := ffaQuery.Order("-SubmissionTime").Limit(feedSize).GetAll(ctx, &ffaMatches)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	matchWithKeys := make([]FFAMatchWithKey, len(ffaMatches))
+	for i, m := range ffaMatches {
+		matchWithKeys[i] = FFAMatchWithKey{Match: m}
+	}
+	if err := fillInFFAMatchPlayerNames(ctx, matchWithKeys); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, m := range matchWithKeys {
+		entries = append(entries, createFFAMatchFeedEntry(
+			idPrefix+ffaKeys[i].Encode(), m.Match, tournamentNames[m.Match.TournamentID]))
+	}
+
+	var retractions []FFAMatchRetraction
+	retractionKeys, err := retractionQuery.Order("-RetractionTime").Limit(feedSize).GetAll(ctx, &retractions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, retraction := range retractions {
+		entries = append(entries, createRetractionFeedEntry(
+			idPrefix+retractionKeys[i].Encode(), retraction, tournamentNames[retraction.TournamentID]))
+	}
+
+	for _, query := range matchQueries {
+		var matches []Match
+		keys, err := query.Order("-Date").Limit(feedSize).GetAll(ctx, &matches)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, m := range matches {
+			entries = append(entries, createMatchFeedEntry(idPrefix+keys[i].Encode(), m))
+		}
+	}
+
+	// Newest first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].time.After(entries[j].time)
+	})
+	if len(entries) > feedSize {
+		entries = entries[:feedSize]
+	}
+	if err := redactFeedAuthors(ctx, entries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	title := "Match results"
+	feedID := idPrefix + "feed"
+	if tournamentName != "" {
+		title += " in " + tournamentName
+		feedID += "/tournament/" + tournamentName
+	}
+	if userName != "" {
+		title += " of " + userName
+		feedID += "/user/" + userName
+	}
+
+	feed := AtomFeed{
+		Title:   title,
+		ID:      feedID,
+		Updated: formatFeedTime(time.Now()),
+		Links: []AtomLink{
+			{Href: "https://" + r.Host + r.URL.RequestURI(), Rel: "self"},
+			{Href: feedPageURL(r.Host, tournamentName, userName), Rel: "alternate"},
+		},
+		Entries: entries,
+	}
+	if len(entries) != 0 {
+		feed.Updated = entries[0].Updated
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// createFFAMatchFeedEntry creates a feed entry of a FFA match, PlayerNames of
+// the match must be filled in.
+func createFFAMatchFeedEntry(id string, match FFAMatch, tournamentName string) AtomEntry {
+	content := ""
+	for i, name := range match.PlayerNames {
+		content += fmt.Sprintf("%d. %s: %s\n",
+			placement(match.Draws, i), name,
+			formatRatingChange(match.PreGameTrueSkillRating[i], match.PostGameTrueSkillRating[i]))
+	}
+	content += fmt.Sprintf("Outcome probability: %.1f%%", 100*match.OutcomeProbability)
+
+	entry := AtomEntry{
+		Title:   generateFFAMatchNote(match.PlayerNames, match.Draws),
+		ID:      id,
+		Updated: formatFeedTime(match.SubmissionTime),
+		Author:  AtomPerson{Name: match.Submitter},
+		Content: AtomContent{Type: "text", Body: content},
+		time:    match.SubmissionTime,
+	}
+	if tournamentName != "" {
+		entry.Category = &AtomCategory{Term: tournamentName}
+	}
+	return entry
+}
+
+// createRetractionFeedEntry creates a feed entry of a retracted FFA match
+func createRetractionFeedEntry(id string, retraction FFAMatchRetraction, tournamentName string) AtomEntry {
+	entry := AtomEntry{
+		Title:   "Retracted: " + retraction.Note,
+		ID:      id,
+		Updated: formatFeedTime(retraction.RetractionTime),
+		Author:  AtomPerson{Name: retraction.Submitter},
+		Content: AtomContent{
+			Type: "text",
+			Body: fmt.Sprintf("The match submitted at %s was retracted by its submitter, ratings were reverted.",
+				formatFeedTime(retraction.SubmissionTime)),
+		},
+		time: retraction.RetractionTime,
+	}
+	if tournamentName != "" {
+		entry.Category = &AtomCategory{Term: tournamentName}
+	}
+	return entry
+}
+
+// createMatchFeedEntry creates a feed entry of a legacy 1v1 match
+func createMatchFeedEntry(id string, match Match) AtomEntry {
+	content := fmt.Sprintf("1. %s: %s\n2. %s: %s",
+		match.Winner, formatRatingChange(match.WinnerRatingBefore, match.WinnerRatingAfter),
+		match.Loser, formatRatingChange(match.LoserRatingBefore, match.LoserRatingAfter))
+	if match.Note != "" {
+		content += "\n" + match.Note
+	}
+
+	return AtomEntry{
+		Title:    generateFFAMatchNote([]string{match.Winner, match.Loser}, []bool{false}),
+		ID:       id,
+		Updated:  formatFeedTime(match.Date),
+		Author:   AtomPerson{Name: match.Submitter},
+		Category: &AtomCategory{Term: match.Tournament},
+		Content:  AtomContent{Type: "text", Body: content},
+		time:     match.Date,
+	}
+}
+
+// redactFeedAuthors replaces authors of entries, which are submitters of
+// matches, unless they are the name of a player, of a service token, or of a
+// slash command user. Other submitters are logins that are not linked to a
+// profile, or personal API tokens of them.
+func redactFeedAuthors(ctx context.Context, entries []AtomEntry) error {
+	var serviceTokens []APIToken
+	_, err := datastore.NewQuery("APIToken").Ancestor(guestbookKey(ctx)).
+		Filter("Service =", true).
+		GetAll(ctx, &serviceTokens)
+	if err != nil {
+		return err
+	}
+	authors := make(map[string]string)
+	for _, token := range serviceTokens {
+		authors[token.Owner] = token.Owner
+	}
+
+	for i := range entries {
+		submitter := entries[i].Author.Name
+		author, found := authors[submitter]
+		if !found {
+			author = feedRedactedAuthor
+			if strings.HasSuffix(submitter, slashCommandSubmitter("")) {
+				author = submitter
+			} else if exist, _, _, err := findExistingUser(ctx, submitter); err != nil {
+				return err
+			} else if exist {
+				author = submitter
+			}
+			authors[submitter] = author
+		}
+		entries[i].Author.Name = author
+	}
+	return nil
+}
+
+// placement returns the 1-based placement of the i-th player, players in a
+// draw share the same placement.
+func placement(draws []bool, i int) int {
+	for i > 0 && draws[i-1] {
+		i--
+	}
+	return i + 1
+}
+
+func formatRatingChange(before float64, after float64) string {
+	return fmt.Sprintf("%.2f ➨ %.2f (%+.2f)", before, after, after-before)
+}
+
+func formatFeedTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func feedPageURL(host string, tournamentName string, userName string) string {
+	if userName != "" {
+		return "https://" + host + "/profile?user=" + url.QueryEscape(userName)
+	}
+	if tournamentName != "" {
+		return "https://" + host + "/tournament/" + url.PathEscape(tournamentName)
+	}
+	return "https://" + host + "/"
+}
@@ -8,13 +8,10 @@ import (
 	"net/http"
 	"path"
 	"sort"
-	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/user"
 
 	trueskill "github.com/mafredri/go-trueskill"
 )
@@ -107,6 +104,28 @@ func Generate1v1MatchResults(numPlayers int) []MathcResult1v1 {
 	return results
 }
 
+// adjustFFAElo returns the Elo ratings of the players of a FFA match after
+// the emulated 1v1 games of Generate1v1MatchResults with the K-factor k, given
+// their ratings before the match. Players are ordered from first place to last
+// place, and players in a draw score half a point against each other.
+func adjustFFAElo(k float64, preGameRatings []float64, draws []bool) []float64 {
+	ratings := make([]float64, len(preGameRatings))
+	copy(ratings, preGameRatings)
+
+	for _, result := range Generate1v1MatchResults(len(ratings)) {
+		winner, loser := result.winner, result.loser
+		score := 1.0
+		if placement(draws, winner) == placement(draws, loser) {
+			score = 0.5
+		}
+		expected := expectedScore(ratings[winner], ratings[loser])
+		ratings[winner], ratings[loser] =
+			newElo(k, ratings[winner], expected, score),
+			newElo(k, ratings[loser], 1-expected, 1-score)
+	}
+	return ratings
+}
+
 // FfaMatchResult represents an FFA game match result, which will be in json
 // format within the http post request this should match the format in
 // add_ffa_match_result.js
@@ -118,54 +137,146 @@ type FfaMatchResult struct {
 	Tournament string
 	Players    []string // player name from first place to last place
 	Draws      []bool
+	// Idempotency key, a retry with the same key is not recorded twice
+	RequestID string
+	// Time the match was played, zero if it was just played
+	PlayedAt time.Time
 }
 
+// Matches with the same result recorded in the same tournament within this
+// duration are reported as possible duplicates
+const duplicateFFAMatchWindow = 5 * time.Minute
+
 func submitFfaMatchResult(w http.ResponseWriter, req *http.Request) {
-	ctx := appengine.NewContext(req)
+	ctx := newContext(req)
 
 	decoder := json.NewDecoder(req.Body)
 	var matchResult FfaMatchResult
 	err := decoder.Decode(&matchResult)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeAPIError(w, invalidArgumentError(err.Error()))
 		return
 	}
 
+	submission, err := submitFFAMatch(ctx, matchResult)
+	writeAPIResponse(w, submission, err)
+}
+
+// submitFFAMatch validates a FFA match result submitted by the current login,
+// and records it
+func submitFFAMatch(ctx context.Context, matchResult FfaMatchResult) (FFAMatchSubmission, error) {
 	log.Printf("Received matchResult: %+v\n", matchResult)
 
 	// length of players and draws must be different by 1
 	if len(matchResult.Players)-1 != len(matchResult.Draws) {
-		http.Error(w,
-			fmt.Sprintf("Request contains %d Players and %d Draws, it should be N and N-1 instead.",
-				len(matchResult.Players), len(matchResult.Draws)),
-			http.StatusUnprocessableEntity)
-		return
+		return FFAMatchSubmission{}, invalidArgumentError(
+			"Request contains %d Players and %d Draws, it should be N and N-1 instead.",
+			len(matchResult.Players), len(matchResult.Draws))
+	}
+
+	if matchResult.PlayedAt.After(time.Now()) {
+		return FFAMatchSubmission{}, invalidArgumentError("PlayedAt should not be in the future")
 	}
 
 	tournamentKey, err := findExistingTournamentKey(ctx, matchResult.Tournament)
 	if err != nil {
-		http.Error(w,
-			fmt.Sprintf("Failed to find tournament %s: %s",
-				matchResult.Tournament, err.Error()),
-			http.StatusUnprocessableEntity)
-		return
+		return FFAMatchSubmission{}, err
 	}
 	tournamentID := tournamentKey.IntID()
 
+	if err := authorize(ctx, RolePlayer, tournamentID); err != nil {
+		return FFAMatchSubmission{}, err
+	}
+	if err := checkParticipant(ctx, tournamentID, matchResult.Players); err != nil {
+		return FFAMatchSubmission{}, err
+	}
+
 	// Additional information to be stored in match history
-	submitter := user.Current(ctx).String()
+	submitter := currentSubmitter(ctx)
+
+	match, replayed, replayScheduled, err := recordFFAMatch(ctx, tournamentID, matchResult, submitter)
+	if err != nil {
+		return FFAMatchSubmission{}, err
+	}
+	submission := FFAMatchSubmission{Match: match, Replayed: replayed, Warnings: []string{}}
+	if replayed {
+		return submission, nil
+	}
+	if replayScheduled {
+		submission.Warnings = append(submission.Warnings,
+			"Later matches of these players were already recorded, ratings are being recalculated in the background.")
+	}
+
+	warning, err := duplicateFFAMatchWarning(ctx, match)
+	if err != nil {
+		return FFAMatchSubmission{}, err
+	}
+	if warning != "" {
+		submission.Warnings = append(submission.Warnings, warning)
+	}
+	return submission, nil
+}
+
+// duplicateFFAMatchWarning returns a warning if the same result as match was
+// recently recorded in its tournament, or an empty string
+func duplicateFFAMatchWarning(ctx context.Context, match FFAMatch) (string, error) {
+	count, err := countRecentDuplicateFFAMatches(ctx, match, duplicateFFAMatchWindow)
+	if err != nil || count == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%s was already recorded %d time(s) in the last %d minutes, delete this match if it was submitted twice.",
+		match.Note, count, int(duplicateFFAMatchWindow.Minutes())), nil
+}
+
+// recordFFAMatch runs the TrueSkill update for a FFA match result, then stores
+// the FFAMatch and the post-game stats of all players in one transaction. The
+// caller is responsible for validating the match result and resolving the
+// tournament. If submitter already recorded a match with the request ID of the
+// result, that match is returned instead and the second value is true. A match
+// played before later matches of its players is rated from the current stats
+// first, and a replay of the tournament is scheduled in the same transaction,
+// the third value is then true.
+func recordFFAMatch(
+	ctx context.Context,
+	tournamentID int64,
+	matchResult FfaMatchResult,
+	submitter string) (FFAMatch, bool, bool, error) {
+
 	note := generateFFAMatchNote(matchResult.Players, matchResult.Draws)
 
-	// TrueSkill game config
-	ts, err := createTrueSkillConfig()
+	// TrueSkill game config of the tournament
+	settings, err := readRatingSettings(ctx, tournamentID)
+	if err != nil {
+		return FFAMatch{}, false, false, err
+	}
+	ts, err := settings.trueSkillConfig()
 
 	if err != nil {
-		http.Error(w, "Failed to create TrueSkill config: "+err.Error(), http.StatusInternalServerError)
-		return
+		return FFAMatch{}, false, false, fmt.Errorf("Failed to create TrueSkill config: %s", err.Error())
 	}
 
+	var ffaMatch FFAMatch
+	replayed := false
+	needsReplay := false
+
 	// do all updates within a transaction to avoid race conditions
-	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		needsReplay = false
+
+		// a retry of a recorded submission must not update stats again, the
+		// lookup is in the transaction so concurrent retries conflict
+		if matchResult.RequestID != "" {
+			existingMatch, err := readFFAMatchByRequestID(ctx, submitter, matchResult.RequestID)
+			if err != nil {
+				return err
+			}
+			replayed = existingMatch != nil
+			if replayed {
+				ffaMatch = *existingMatch
+				return nil
+			}
+		}
+
 		// read all user stats or create new entries if they do not exist yet
 		userStatsKeys, preGameUserStatsList, err := readOrCreateUserTournamentStats(
 			ctx, tournamentID, matchResult.Players)
@@ -174,54 +285,21 @@ func submitFfaMatchResult(w http.ResponseWriter, req *http.Request) {
 			return err
 		}
 
-		var userStatsIDs []int64
-		for _, userStatsKey := range userStatsKeys {
-			userStatsIDs = append(userStatsIDs, userStatsKey.IntID())
-		}
-
-		// prepare Player objects for TrueSkill calculation
-		var preGamePlayers []trueskill.Player
-		for _, userStats := range preGameUserStatsList {
-			preGamePlayers = append(
-				preGamePlayers,
-				trueskill.NewPlayer(userStats.TrueSkillMu, userStats.TrueSkillSigma))
+		submissionTime := time.Now()
+		playedAt := matchResult.PlayedAt
+		if playedAt.IsZero() || playedAt.After(submissionTime) {
+			playedAt = submissionTime
 		}
+		postGameUserStatsList, outcomeProbability := adjustFFAStats(
+			ts, settings.eloK(), preGameUserStatsList, matchResult.Draws, playedAt)
 
-		// run actual TrueSkill update calculation
-		postGamePlayers, outcomeProbability := ts.AdjustSkillsWithDraws(preGamePlayers, matchResult.Draws)
-
-		// prepare post-game user stats
-		postGameUserStatsList := make([]UserTournamentStats, len(preGameUserStatsList))
-
-		// copy from pre-game stats to post-game stats
-		copy(postGameUserStatsList, preGameUserStatsList)
-
-		for i := range postGameUserStatsList {
-			mu := postGamePlayers[i].Mu()
-			sigma := postGamePlayers[i].Sigma()
-			postGameUserStatsList[i].TrueSkillMu = mu
-			postGameUserStatsList[i].TrueSkillSigma = sigma
-			postGameUserStatsList[i].TrueSkillRating = calculateTrueSkillRating(mu, sigma)
-		}
-
-		// First players (potentially tied) will get one more FFAWins
-		for i := range postGameUserStatsList {
-			postGameUserStatsList[i].FFAWins++
-
-			// If not draw with next player, break
-			if matchResult.Draws[i] == false {
-				break
-			}
-		}
-
-		userKeys, err := findUserKeys(ctx, matchResult.Players)
-		userIDs := make([]int64, len(userKeys))
-		for i := range userKeys {
-			userIDs[i] = userKeys[i].IntID()
+		userIDs := make([]int64, len(postGameUserStatsList))
+		for i, stats := range postGameUserStatsList {
+			userIDs[i] = stats.UserID
 		}
 
 		// create FFAMatch Object to store in Datastore
-		ffaMatch := createFFAMatch(
+		ffaMatch = createFFAMatch(
 			tournamentID,
 			userIDs,
 			matchResult.Draws,
@@ -230,11 +308,29 @@ func submitFfaMatchResult(w http.ResponseWriter, req *http.Request) {
 			outcomeProbability,
 			note,
 			submitter,
-			time.Now())
+			submissionTime,
+			playedAt)
+		ffaMatch.RequestID = matchResult.RequestID
+
+		needsReplay, err = hasLaterFFAMatchOfPlayers(ctx, ffaMatch)
+		if err != nil {
+			return err
+		}
+
+		// head-to-head results are read before the match is stored, since
+		// tournaments without them yet build them from stored matches
+		headToHead, _, err := readHeadToHead(ctx, tournamentID)
+		if err != nil {
+			return err
+		}
+		headToHead.addMatch(ffaMatch, matchResult.Players)
+		if err := putHeadToHead(ctx, &headToHead); err != nil {
+			return err
+		}
 
 		// store FFAMatch into datastore
 		if err := insertFFAMatch(ctx, ffaMatch); err != nil {
-			return nil
+			return err
 		}
 
 		// Update user stats for each user
@@ -244,15 +340,113 @@ func submitFfaMatchResult(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		return nil
+		// Replays write every stats row of the tournament, which may not fit
+		// in the transaction, so they run as a task
+		return changeTournamentStats(ctx, tournamentID, needsReplay)
 	}, nil)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return FFAMatch{}, false, false, err
 	}
+	invalidateTournamentResponses(ctx, tournamentID)
 
-	// return nothing if successful
+	if replayed {
+		matchWithKeys := []FFAMatchWithKey{{Match: ffaMatch}}
+		if err := fillInFFAMatchPlayerNames(ctx, matchWithKeys); err != nil {
+			return FFAMatch{}, false, false, err
+		}
+		return matchWithKeys[0].Match, true, false, nil
+	}
+
+	ffaMatch.PlayerNames = matchResult.Players
+	return ffaMatch, false, needsReplay, nil
+}
+
+// adjustFFAStats runs the TrueSkill and Elo updates of a FFA match, with the
+// Elo K-factor eloK, and returns the post-game stats of the players together
+// with the probability of the result.
+func adjustFFAStats(
+	ts trueskill.Config,
+	eloK float64,
+	preGameUserStatsList []UserTournamentStats,
+	draws []bool,
+	playedAt time.Time) ([]UserTournamentStats, float64) {
+
+	// prepare Player objects for TrueSkill calculation
+	var preGamePlayers []trueskill.Player
+	for _, userStats := range preGameUserStatsList {
+		preGamePlayers = append(
+			preGamePlayers,
+			trueskill.NewPlayer(userStats.TrueSkillMu, userStats.TrueSkillSigma))
+	}
+
+	// run actual TrueSkill update calculation
+	postGamePlayers, outcomeProbability := ts.AdjustSkillsWithDraws(preGamePlayers, draws)
+
+	// prepare post-game user stats
+	postGameUserStatsList := make([]UserTournamentStats, len(preGameUserStatsList))
+
+	// copy from pre-game stats to post-game stats
+	copy(postGameUserStatsList, preGameUserStatsList)
+
+	for i := range postGameUserStatsList {
+		mu := postGamePlayers[i].Mu()
+		sigma := postGamePlayers[i].Sigma()
+		postGameUserStatsList[i].TrueSkillMu = mu
+		postGameUserStatsList[i].TrueSkillSigma = sigma
+		postGameUserStatsList[i].TrueSkillRating = calculateTrueSkillRating(mu, sigma)
+	}
+
+	// Elo ratings are updated by emulated 1v1 games
+	preGameRatings := make([]float64, len(preGameUserStatsList))
+	for i, userStats := range preGameUserStatsList {
+		preGameRatings[i] = userStats.Rating
+	}
+	for i, rating := range adjustFFAElo(eloK, preGameRatings, draws) {
+		postGameUserStatsList[i].Rating = rating
+	}
+
+	tallyFFAMatch(postGameUserStatsList, draws, playedAt, 1)
+
+	return postGameUserStatsList, outcomeProbability
+}
+
+// Placements counted as podiums
+const podiumPlacements = 3
+
+// tallyFFAMatch adds a FFA match played at playedAt to the tallies of its
+// players, from first place to last place, or removes it if delta is -1.
+// LastPlayed is only changed when adding a match.
+func tallyFFAMatch(userStatsList []UserTournamentStats, draws []bool, playedAt time.Time, delta int) {
+	for i := range userStatsList {
+		stats := &userStatsList[i]
+		place := placement(draws, i)
+
+		stats.Games += delta
+		stats.PlacementSum += delta * place
+		if place == 1 {
+			stats.FFAWins += delta
+		}
+		if place <= podiumPlacements {
+			stats.Podiums += delta
+		}
+		for j := range userStatsList {
+			otherPlace := placement(draws, j)
+			if j == i {
+				continue
+			} else if otherPlace > place {
+				stats.Wins += delta
+			} else if otherPlace < place {
+				stats.Losses += delta
+			} else {
+				stats.Draws += delta
+			}
+		}
+
+		if delta > 0 {
+			stats.LastPlayed = playedAt
+		}
+	}
 }
 
 func generateFFAMatchNote(players []string, draws []bool) string {
@@ -277,7 +471,7 @@ func generateFFAMatchNote(players []string, draws []bool) string {
 
 // readOrCreateUserTournamentStats will try to read users' stats for a given
 // tournament, if the specified user have no record in the specified tournament,
-// a new record with default values will be created.
+// default values are returned with the key of the new record.
 func readOrCreateUserTournamentStats(
 	ctx context.Context,
 	tournamentID int64,
@@ -304,55 +498,74 @@ func readOrCreateUserTournamentStats(
 }
 
 func requestRecentFFAMatches(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	// Get number of matches to retrieve
 	// If the number is not a positive integer, return nil
-	limit := -1
-	limitParam := r.FormValue("num")
-	if limitParam != "" {
-		newLimit, err := strconv.Atoi(limitParam)
-		if err == nil && newLimit > 0 {
-			limit = newLimit
-		}
+	limit := parseLimitParam(r)
+
+	filter, err := parseMatchFilter(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
 	}
 
-	tournamentName := r.FormValue("tournament")
+	scope, err := tournamentCacheScope(ctx, r.FormValue("tournament"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	// Matches the login can retract depend on the login
+	writeCachedResponse(w, r, ctx, scope, true, func() (interface{}, error) {
+		return readFFAMatchPage(ctx, r.FormValue("tournament"), filter, r.FormValue("cursor"), limit)
+	})
+}
+
+// readFFAMatchPage reads a page of FFA matches of a tournament with player
+// names filled in, limit -1 returns an empty page
+func readFFAMatchPage(
+	ctx context.Context,
+	tournamentName string,
+	filter MatchFilter,
+	cursor string,
+	limit int) (FFAMatchPage, error) {
+
 	if tournamentName == "" {
 		tournamentName = "Default"
 	}
 
 	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
 	if err != nil {
-		http.Error(w, "Cannot find tournament "+tournamentName+": "+err.Error(), http.StatusUnprocessableEntity)
-		return
+		return FFAMatchPage{}, err
 	}
 
-	tournamentID := tournamentKey.IntID()
-
-	matchWithKeys := []FFAMatchWithKey{}
+	page := FFAMatchPage{Matches: []FFAMatchWithKey{}}
 	if limit != -1 {
-		query := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
-			Filter("TournamentID = ", tournamentID).
-			Order("-SubmissionTime").
-			Limit(limit)
-		var matches []FFAMatch
-		keys, err := query.GetAll(ctx, &matches)
+		page.Matches, page.NextCursor, err = queryFFAMatchPage(ctx, tournamentKey.IntID(), filter, cursor, limit)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		matchWithKeys = make([]FFAMatchWithKey, len(matches))
-		for i, m := range matches {
-			matchWithKeys[i] = FFAMatchWithKey{
-				Match: m,
-				Key:   keys[i].Encode(),
-			}
+			return FFAMatchPage{}, err
 		}
 	}
 
-	// ========= translate player id to player name
+	if err := fillInFFAMatchPlayerNames(ctx, page.Matches); err != nil {
+		return FFAMatchPage{}, fmt.Errorf("Failed to translate player id to names: %s", err.Error())
+	}
+
+	page.RetractableKeys = []string{}
+	submitter := currentSubmitter(ctx)
+	now := time.Now()
+	window := undoWindow()
+	for _, matchWithKey := range page.Matches {
+		if canRetractFFAMatch(matchWithKey.Match, submitter, now, window) {
+			page.RetractableKeys = append(page.RetractableKeys, matchWithKey.Key)
+		}
+	}
+	return page, nil
+}
 
+// fillInFFAMatchPlayerNames translates player IDs of the matches to player
+// names, so the frontend can display them.
+func fillInFFAMatchPlayerNames(ctx context.Context, matchWithKeys []FFAMatchWithKey) error {
 	playerIDMap := make(map[int64]bool)
 	for _, matchWithKey := range matchWithKeys {
 		for _, playerID := range matchWithKey.Match.Players {
@@ -370,8 +583,7 @@ func requestRecentFFAMatches(w http.ResponseWriter, r *http.Request) {
 	playerProfileMap, err := readUserIDAndProfileMapping(ctx, playerIDs)
 
 	if err != nil {
-		http.Error(w, "Failed to translate player id to names: "+err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	for i := range matchWithKeys {
@@ -380,15 +592,5 @@ func requestRecentFFAMatches(w http.ResponseWriter, r *http.Request) {
 			matchWithKeys[i].Match.PlayerNames[j] = playerProfileMap[playerID].Name
 		}
 	}
-
-	// === END of translating id to names
-
-	js, errJs := json.Marshal(matchWithKeys)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return nil
 }
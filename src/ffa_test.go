@@ -1,6 +1,10 @@
 package guestbook
 
-import "testing"
+import (
+	"math"
+	"testing"
+	"time"
+)
 
 func TestGenerate1v1MatchResults(t *testing.T) {
 	// wanted match results generated for 4 player game
@@ -35,3 +39,102 @@ func TestGenerate1v1MatchResults(t *testing.T) {
 		}
 	}
 }
+
+func TestIsSameFFAResult(t *testing.T) {
+	match := FFAMatch{Players: []int64{1, 2, 3}, Draws: []bool{false, true}}
+
+	if !isSameFFAResult(match, FFAMatch{Players: []int64{1, 2, 3}, Draws: []bool{false, true}}) {
+		t.Errorf("Wanted same result for the same players and draws")
+	}
+	if isSameFFAResult(match, FFAMatch{Players: []int64{2, 1, 3}, Draws: []bool{false, true}}) {
+		t.Errorf("Wanted different result for a different order")
+	}
+	if isSameFFAResult(match, FFAMatch{Players: []int64{1, 2, 3}, Draws: []bool{false, false}}) {
+		t.Errorf("Wanted different result for different draws")
+	}
+	if isSameFFAResult(match, FFAMatch{Players: []int64{1, 2}, Draws: []bool{false}}) {
+		t.Errorf("Wanted different result for different players")
+	}
+}
+
+func TestAdjustFFAElo(t *testing.T) {
+	// Two players are a 1v1 match
+	winnerRating, loserRating := newRatings(1300, 1200)
+	ratings := adjustFFAElo(DefaultEloK, []float64{1300, 1200}, []bool{false})
+	if ratings[0] != winnerRating || ratings[1] != loserRating {
+		t.Errorf("Wanted %f and %f, got %v", winnerRating, loserRating, ratings)
+	}
+
+	// Even players in a draw keep their ratings
+	ratings = adjustFFAElo(DefaultEloK, []float64{1200, 1200, 1200}, []bool{true, true})
+	for i, rating := range ratings {
+		if rating != 1200 {
+			t.Errorf("Wanted player %d to keep 1200, got %f", i, rating)
+		}
+	}
+
+	// Points are only moved between players, from the last places to the
+	// first places
+	preGameRatings := []float64{1200, 1250, 1100, 1300}
+	ratings = adjustFFAElo(DefaultEloK, preGameRatings, []bool{false, true, false})
+	total := 0.0
+	for i := range ratings {
+		total += ratings[i] - preGameRatings[i]
+	}
+	if math.Abs(total) > 1e-9 {
+		t.Errorf("Wanted ratings to sum to the same total, got a change of %f", total)
+	}
+	if ratings[0] <= preGameRatings[0] || ratings[3] >= preGameRatings[3] {
+		t.Errorf("Wanted the first place to gain and the last place to lose, got %v", ratings)
+	}
+	if preGameRatings[0] != 1200 {
+		t.Errorf("Wanted pre-game ratings to be unchanged, got %v", preGameRatings)
+	}
+}
+
+func TestTallyFFAMatch(t *testing.T) {
+	playedAt := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	statsList := []UserTournamentStats{{}, {}, {}, {}}
+	// 1st > 2nd = 3rd > 4th
+	draws := []bool{false, true, false}
+	tallyFFAMatch(statsList, draws, playedAt, 1)
+
+	want := []UserTournamentStats{
+		{Games: 1, FFAWins: 1, Podiums: 1, PlacementSum: 1, Wins: 3, LastPlayed: playedAt},
+		{Games: 1, Podiums: 1, PlacementSum: 2, Wins: 1, Draws: 1, Losses: 1, LastPlayed: playedAt},
+		{Games: 1, Podiums: 1, PlacementSum: 2, Wins: 1, Draws: 1, Losses: 1, LastPlayed: playedAt},
+		{Games: 1, PlacementSum: 4, Losses: 3, LastPlayed: playedAt},
+	}
+	for i := range want {
+		if statsList[i] != want[i] {
+			t.Errorf("Wanted %+v, got %+v", want[i], statsList[i])
+		}
+	}
+
+	tallyFFAMatch(statsList, draws, time.Time{}, -1)
+	for i := range statsList {
+		if statsList[i] != (UserTournamentStats{LastPlayed: playedAt}) {
+			t.Errorf("Wanted tallies to be removed, got %+v", statsList[i])
+		}
+	}
+}
+
+func TestSortFFAMatchesByPlayedAt(t *testing.T) {
+	submitted := time.Date(2019, 1, 8, 12, 0, 0, 0, time.UTC)
+	// Matches in the order of their submission, the last one was played a
+	// week before and the first one has no PlayedAt
+	matches := []FFAMatch{
+		{Note: "a", SubmissionTime: submitted.Add(-2 * time.Hour)},
+		{Note: "b", SubmissionTime: submitted.Add(-time.Hour), PlayedAt: submitted.Add(-time.Hour)},
+		{Note: "c", SubmissionTime: submitted, PlayedAt: submitted.AddDate(0, 0, -7)},
+	}
+	if !playedAfter(matches[1], matches[2]) || playedAfter(matches[2], matches[0]) {
+		t.Errorf("Wanted c played before a and b")
+	}
+
+	sortFFAMatchesByPlayedAt(matches, nil)
+	notes := matches[0].Note + matches[1].Note + matches[2].Note
+	if notes != "cab" {
+		t.Errorf("Wanted matches in the order cab, got %s", notes)
+	}
+}
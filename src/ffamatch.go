@@ -1,6 +1,7 @@
 package guestbook
 
 import (
+	"sort"
 	"time"
 
 	"golang.org/x/net/context"
@@ -24,20 +25,35 @@ func createFFAMatch(
 	outcomeProbability float64,
 	note string,
 	submitter string,
-	submissionTime time.Time) FFAMatch {
+	submissionTime time.Time,
+	playedAt time.Time) FFAMatch {
 
 	ffaMatch := FFAMatch{
 		TournamentID: tournamentID,
 		Players:      players,
 		Draws:        draws,
 
-		OutcomeProbability: outcomeProbability,
 		// Additional information
 		Note:           note,
 		Submitter:      submitter,
 		SubmissionTime: submissionTime,
+		PlayedAt:       playedAt,
 	}
 
+	setFFAMatchStats(&ffaMatch, preGameUserStatsList, postGameUserStatsList, outcomeProbability)
+
+	return ffaMatch
+}
+
+// setFFAMatchStats fills in pre-game and post-game stats of a FFAMatch
+func setFFAMatchStats(
+	ffaMatch *FFAMatch,
+	preGameUserStatsList []UserTournamentStats,
+	postGameUserStatsList []UserTournamentStats,
+	outcomeProbability float64) {
+
+	ffaMatch.OutcomeProbability = outcomeProbability
+
 	// Fill in pre-game stats
 	ffaMatch.PreGameTrueSkillMu,
 		ffaMatch.PreGameTrueSkillSigma,
@@ -48,7 +64,82 @@ func createFFAMatch(
 		ffaMatch.PostGameTrueSkillSigma,
 		ffaMatch.PostGameTrueSkillRating = getMuSigmaRating(postGameUserStatsList)
 
-	return ffaMatch
+	ffaMatch.PreGameEloRating = getEloRating(preGameUserStatsList)
+	ffaMatch.PostGameEloRating = getEloRating(postGameUserStatsList)
+}
+
+// playedAt returns the time a match was played, which is its submission time
+// if it has no PlayedAt
+func (m FFAMatch) playedAt() time.Time {
+	if m.PlayedAt.IsZero() {
+		return m.SubmissionTime
+	}
+	return m.PlayedAt
+}
+
+// playedAfter reports whether m1 is rated after m2: it was played later, or
+// at the same time and submitted later
+func playedAfter(m1 FFAMatch, m2 FFAMatch) bool {
+	if m1.playedAt().Equal(m2.playedAt()) {
+		return m1.SubmissionTime.After(m2.SubmissionTime)
+	}
+	return m1.playedAt().After(m2.playedAt())
+}
+
+// sortFFAMatchesByPlayedAt orders matches, read in the order of their
+// submission, from the first played. keys of the matches are ordered along if
+// they are not nil. PlayedAt is not queried since older matches do not have
+// it.
+func sortFFAMatchesByPlayedAt(matches []FFAMatch, keys []*datastore.Key) {
+	order := make([]int, len(matches))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return matches[order[i]].playedAt().Before(matches[order[j]].playedAt())
+	})
+
+	sortedMatches := make([]FFAMatch, len(matches))
+	for i, index := range order {
+		sortedMatches[i] = matches[index]
+	}
+	copy(matches, sortedMatches)
+	if keys != nil {
+		sortedKeys := make([]*datastore.Key, len(keys))
+		for i, index := range order {
+			sortedKeys[i] = keys[index]
+		}
+		copy(keys, sortedKeys)
+	}
+}
+
+// hasLaterFFAMatchOfPlayers reports whether a match of the tournament of match,
+// played after it, has a player in common with it. Stats of its players then
+// depend on the match, which cannot be added or removed without a replay.
+// Matches are never played after their submission, so only later submissions
+// are read.
+func hasLaterFFAMatchOfPlayers(ctx context.Context, match FFAMatch) (bool, error) {
+	var laterMatches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", match.TournamentID).
+		Filter("SubmissionTime >=", match.playedAt()).
+		GetAll(ctx, &laterMatches); err != nil {
+		return false, err
+	}
+	for _, laterMatch := range laterMatches {
+		if playedAfter(laterMatch, match) && sharesPlayer(laterMatch, match) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func getEloRating(userStatsList []UserTournamentStats) []float64 {
+	rating := make([]float64, len(userStatsList))
+	for i, stats := range userStatsList {
+		rating[i] = stats.Rating
+	}
+	return rating
 }
 
 func getMuSigmaRating(userStatsList []UserTournamentStats) ([]float64, []float64, []float64) {
@@ -60,3 +151,60 @@ func getMuSigmaRating(userStatsList []UserTournamentStats) ([]float64, []float64
 	}
 	return mu, sigma, rating
 }
+
+// readFFAMatchByRequestID reads the FFA match submitted by submitter with an
+// idempotency key, nil if there is none
+func readFFAMatchByRequestID(ctx context.Context, submitter string, requestID string) (*FFAMatch, error) {
+	var matches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("Submitter =", submitter).
+		Filter("RequestID =", requestID).
+		Limit(1).
+		GetAll(ctx, &matches); err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return &matches[0], nil
+}
+
+// isSameFFAResult reports whether two FFA matches have the same players in
+// the same order, with the same draws
+func isSameFFAResult(m1 FFAMatch, m2 FFAMatch) bool {
+	if len(m1.Players) != len(m2.Players) || len(m1.Draws) != len(m2.Draws) {
+		return false
+	}
+	for i := range m1.Players {
+		if m1.Players[i] != m2.Players[i] {
+			return false
+		}
+	}
+	for i := range m1.Draws {
+		if m1.Draws[i] != m2.Draws[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// countRecentDuplicateFFAMatches counts the matches with the same result as
+// match, recorded in its tournament less than window before it
+func countRecentDuplicateFFAMatches(ctx context.Context, match FFAMatch, window time.Duration) (int, error) {
+	var recentMatches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", match.TournamentID).
+		Filter("SubmissionTime >", match.SubmissionTime.Add(-window)).
+		Filter("SubmissionTime <", match.SubmissionTime).
+		GetAll(ctx, &recentMatches); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, recentMatch := range recentMatches {
+		if isSameFFAResult(recentMatch, match) {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,240 @@
+package guestbook
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about the head-to-head results of a tournament. They are stored in
+// one HeadToHead entity per tournament, which is updated in the transaction of
+// every FFA match and rebuilt by replays, so reading them costs one read.
+
+// HeadToHead is the head-to-head results of all players of a tournament
+type HeadToHead struct {
+	TournamentID int64
+	// Players in the order of their first match
+	UserIDs   []int64  `datastore:",noindex"`
+	Usernames []string `datastore:",noindex"`
+	// JSON of Results, which has too many values to be stored as properties
+	ResultsJSON []byte
+
+	// Results[i][j] is the result of UserIDs[i] against UserIDs[j]
+	Results [][]HeadToHeadResult `datastore:"-"`
+}
+
+// HeadToHeadResult is the result of a player against another player
+type HeadToHeadResult struct {
+	Wins   int
+	Draws  int
+	Losses int
+}
+
+func headToHeadKey(ctx context.Context, tournamentID int64) *datastore.Key {
+	return datastore.NewKey(ctx, "HeadToHead", "", tournamentID, guestbookKey(ctx))
+}
+
+// forEachFFAPair calls f for every pair of players of a match, where i placed
+// before j or is in a draw with j
+func forEachFFAPair(match FFAMatch, f func(i int, j int, isDraw bool)) {
+	for i := range match.Players {
+		isDraw := true
+		for j := i + 1; j < len(match.Players); j++ {
+			isDraw = isDraw && match.Draws[j-1]
+			f(i, j, isDraw)
+		}
+	}
+}
+
+// playerIndex returns the index of a player, adding the player if needed
+func (h *HeadToHead) playerIndex(userID int64, name string) int {
+	for i, id := range h.UserIDs {
+		if id == userID {
+			return i
+		}
+	}
+
+	h.UserIDs = append(h.UserIDs, userID)
+	h.Usernames = append(h.Usernames, name)
+	for i := range h.Results {
+		h.Results[i] = append(h.Results[i], HeadToHeadResult{})
+	}
+	h.Results = append(h.Results, make([]HeadToHeadResult, len(h.UserIDs)))
+	return len(h.UserIDs) - 1
+}
+
+// updateMatch adds the results of a match, or removes them if delta is -1.
+// names are the player names of the match.
+func (h *HeadToHead) updateMatch(match FFAMatch, names []string, delta int) {
+	indexes := make([]int, len(match.Players))
+	for i, userID := range match.Players {
+		indexes[i] = h.playerIndex(userID, names[i])
+	}
+
+	forEachFFAPair(match, func(i int, j int, isDraw bool) {
+		winner, loser := indexes[i], indexes[j]
+		if isDraw {
+			h.Results[winner][loser].Draws += delta
+			h.Results[loser][winner].Draws += delta
+		} else {
+			h.Results[winner][loser].Wins += delta
+			h.Results[loser][winner].Losses += delta
+		}
+	})
+}
+
+// addMatch adds the results of a match with the given player names
+func (h *HeadToHead) addMatch(match FFAMatch, names []string) {
+	h.updateMatch(match, names, 1)
+}
+
+// removeMatch removes the results of a match which was added before. Players
+// without any other match are removed.
+func (h *HeadToHead) removeMatch(match FFAMatch) {
+	h.updateMatch(match, make([]string, len(match.Players)), -1)
+
+	var kept []int
+	for i := range h.UserIDs {
+		for _, result := range h.Results[i] {
+			if result != (HeadToHeadResult{}) {
+				kept = append(kept, i)
+				break
+			}
+		}
+	}
+
+	userIDs := make([]int64, len(kept))
+	usernames := make([]string, len(kept))
+	results := make([][]HeadToHeadResult, len(kept))
+	for i, row := range kept {
+		userIDs[i] = h.UserIDs[row]
+		usernames[i] = h.Usernames[row]
+		results[i] = make([]HeadToHeadResult, len(kept))
+		for j, column := range kept {
+			results[i][j] = h.Results[row][column]
+		}
+	}
+	h.UserIDs, h.Usernames, h.Results = userIDs, usernames, results
+}
+
+// rename changes the name of a player, returns false if the player has no
+// match in the tournament
+func (h *HeadToHead) rename(userID int64, name string) bool {
+	for i, id := range h.UserIDs {
+		if id == userID {
+			h.Usernames[i] = name
+			return true
+		}
+	}
+	return false
+}
+
+// matchData returns the head-to-head results as shown on the tournament page
+func (h HeadToHead) matchData() MatchData {
+	resultTable := make([][]DetailMatchResultEntry, len(h.UserIDs))
+	for i := range resultTable {
+		resultTable[i] = make([]DetailMatchResultEntry, len(h.UserIDs))
+		for j := range resultTable[i] {
+			result := h.Results[i][j]
+			resultTable[i][j] = DetailMatchResultEntry{
+				Wins:   result.Wins,
+				Draws:  result.Draws,
+				Losses: result.Losses,
+				Color: getColor(
+					UserProfile{Name: h.Usernames[i]}, UserProfile{Name: h.Usernames[j]},
+					result.Wins, result.Losses),
+			}
+		}
+	}
+
+	usernames := h.Usernames
+	if usernames == nil {
+		usernames = []string{}
+	}
+	return MatchData{
+		Usernames:   usernames,
+		ResultTable: resultTable,
+	}
+}
+
+// buildHeadToHead computes the head-to-head results of a tournament from its
+// matches, ordered from oldest to newest
+func buildHeadToHead(ctx context.Context, tournamentID int64, matches []FFAMatch) (HeadToHead, error) {
+	playerIDMap := make(map[int64]bool)
+	for _, match := range matches {
+		for _, playerID := range match.Players {
+			playerIDMap[playerID] = true
+		}
+	}
+	var playerIDs []int64
+	for id := range playerIDMap {
+		playerIDs = append(playerIDs, id)
+	}
+	playerProfileMap, err := readUserIDAndProfileMapping(ctx, playerIDs)
+	if err != nil {
+		return HeadToHead{}, err
+	}
+
+	h := HeadToHead{TournamentID: tournamentID}
+	for _, match := range matches {
+		names := make([]string, len(match.Players))
+		for i, playerID := range match.Players {
+			names[i] = playerProfileMap[playerID].Name
+		}
+		h.addMatch(match, names)
+	}
+	return h, nil
+}
+
+// readHeadToHead reads the head-to-head results of a tournament. Results of
+// tournaments without a HeadToHead yet are built from their matches.
+func readHeadToHead(ctx context.Context, tournamentID int64) (HeadToHead, bool, error) {
+	var h HeadToHead
+	err := datastore.Get(ctx, headToHeadKey(ctx, tournamentID), &h)
+	if err == nil {
+		return h, true, json.Unmarshal(h.ResultsJSON, &h.Results)
+	} else if err != datastore.ErrNoSuchEntity {
+		return HeadToHead{}, false, err
+	}
+
+	var matches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		Order("SubmissionTime").
+		GetAll(ctx, &matches); err != nil {
+		return HeadToHead{}, false, err
+	}
+	h, err = buildHeadToHead(ctx, tournamentID, matches)
+	return h, false, err
+}
+
+func putHeadToHead(ctx context.Context, h *HeadToHead) error {
+	var err error
+	h.ResultsJSON, err = json.Marshal(h.Results)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(ctx, headToHeadKey(ctx, h.TournamentID), h)
+	return err
+}
+
+// renameInHeadToHeads changes the name of a player in the head-to-head
+// results of every tournament
+func renameInHeadToHeads(ctx context.Context, userID int64, name string) error {
+	var headToHeads []HeadToHead
+	keys, err := datastore.NewQuery("HeadToHead").Ancestor(guestbookKey(ctx)).GetAll(ctx, &headToHeads)
+	if err != nil {
+		return err
+	}
+	for i := range headToHeads {
+		h := &headToHeads[i]
+		if !h.rename(userID, name) {
+			continue
+		}
+		if _, err := datastore.Put(ctx, keys[i], h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
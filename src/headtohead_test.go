@@ -0,0 +1,42 @@
+package guestbook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeadToHeadAddMatch(t *testing.T) {
+	var h HeadToHead
+	// alice = bob > carol
+	h.addMatch(FFAMatch{Players: []int64{1, 2, 3}, Draws: []bool{true, false}}, []string{"alice", "bob", "carol"})
+	// carol > alice
+	h.addMatch(FFAMatch{Players: []int64{3, 1}, Draws: []bool{false}}, []string{"carol", "alice"})
+
+	if !reflect.DeepEqual(h.Usernames, []string{"alice", "bob", "carol"}) {
+		t.Errorf("Wanted players in order of first match, got %v", h.Usernames)
+	}
+	wanted := [][]HeadToHeadResult{
+		{{}, {Draws: 1}, {Wins: 1, Losses: 1}},
+		{{Draws: 1}, {}, {Wins: 1}},
+		{{Wins: 1, Losses: 1}, {Losses: 1}, {}},
+	}
+	if !reflect.DeepEqual(h.Results, wanted) {
+		t.Errorf("Wanted results %v, got %v", wanted, h.Results)
+	}
+}
+
+func TestHeadToHeadRemoveMatch(t *testing.T) {
+	var h HeadToHead
+	first := FFAMatch{Players: []int64{1, 2}, Draws: []bool{false}}
+	second := FFAMatch{Players: []int64{3, 1}, Draws: []bool{false}}
+	h.addMatch(first, []string{"alice", "bob"})
+	h.addMatch(second, []string{"carol", "alice"})
+
+	h.removeMatch(second)
+
+	var wanted HeadToHead
+	wanted.addMatch(first, []string{"alice", "bob"})
+	if !reflect.DeepEqual(h, wanted) {
+		t.Errorf("Wanted %+v after removing the last match, got %+v", wanted, h)
+	}
+}
@@ -2,6 +2,7 @@ package guestbook
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -12,52 +13,91 @@ import (
 	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/user"
 )
 
 func init() {
+	// Permissions are checked by withRole. Handlers working on a tournament
+	// are registered with withTournamentRole, and check the role in that
+	// tournament.
+
 	// Main page
-	http.HandleFunc("/", root)
+	http.HandleFunc("/", withRole(RoleViewer, root))
 	// Child pages
-	http.HandleFunc("/admin", admin)
-	http.HandleFunc("/add_user", addUser)
-	http.HandleFunc("/tournament", showTournaments)
-	http.HandleFunc("/tournament/", showTournamentStats)
-	http.HandleFunc("/add_match_result", addMatchResult)
-	http.HandleFunc("/add_ffa_match_result", showAddFfaMatchResult)
-	http.HandleFunc("/add_tta_match_result", showAddTtaMatchResult)
-	http.HandleFunc("/profile", profile)
+	http.HandleFunc("/admin", withRole(RoleViewer, admin))
+	http.HandleFunc("/add_user", withRole(RolePlayer, addUser))
+	http.HandleFunc("/tournament", withRole(RoleViewer, showTournaments))
+	http.HandleFunc("/tournament/", withRole(RoleViewer, showTournamentStats))
+	http.HandleFunc("/add_match_result", withRole(RolePlayer, addMatchResult))
+	http.HandleFunc("/add_ffa_match_result", withRole(RolePlayer, showAddFfaMatchResult))
+	http.HandleFunc("/add_tta_match_result", withRole(RolePlayer, showAddTtaMatchResult))
+	http.HandleFunc("/profile", withRole(RoleViewer, profile))
+	http.HandleFunc("/my_profile", withRole(RoleViewer, myProfile))
+	http.HandleFunc("/api_tokens", withRole(RoleViewer, showAPITokens))
 
 	// Submit data
-	http.HandleFunc("/submit_greeting", submitGreeting)
-	http.HandleFunc("/submit_user", submitUser)
-	http.HandleFunc("/submit_match_result", submitMatchResult)
-	http.HandleFunc("/submit_badge", submitBadge)
-	http.HandleFunc("/submit_user_badge", submitUserBadge)
-	http.HandleFunc("/submit_tournament", submitTournament)
-	http.HandleFunc("/submit_ffa_match_result", submitFfaMatchResult)
+	http.HandleFunc("/submit_greeting", withRole(RolePlayer, submitGreeting))
+	http.HandleFunc("/submit_user", withRole(RolePlayer, submitUser))
+	http.HandleFunc("/submit_match_result", withRole(RolePlayer, submitMatchResult))
+	http.HandleFunc("/submit_badge", withTournamentRole(RoleOrganizer, submitBadge))
+	http.HandleFunc("/submit_user_badge", withTournamentRole(RoleOrganizer, submitUserBadge))
+	http.HandleFunc("/submit_tournament", withRole(RolePlayer, submitTournament))
+	http.HandleFunc("/submit_tournament_settings", withTournamentRole(RoleOrganizer, submitTournamentSettings))
+	http.HandleFunc("/submit_ffa_match_result", withTournamentRole(RolePlayer, submitFfaMatchResult))
+	// Requests are signed by the chat service
+	http.HandleFunc("/submit_slash_command", withRole(RolePublic, submitSlashCommand))
+	http.HandleFunc("/submit_profile_claim", withRole(RolePlayer, submitProfileClaim))
+	http.HandleFunc("/submit_api_token", withRole(RoleViewer, submitAPIToken))
+	http.HandleFunc("/revoke_api_token", withRole(RoleViewer, revokeAPIToken))
 
 	// Requests
-	http.HandleFunc("/request_users", requestUsers)
-	http.HandleFunc("/request_latest_match", requestLatestMatch)
-	http.HandleFunc("/request_user_profiles", requestUserProfiles)
-	http.HandleFunc("/request_tournament_stats", requestTournamentStats)
-	http.HandleFunc("/request_detail_results", requestDetailMatchResults)
-	http.HandleFunc("/request_legacy_detail_results", requestLegacyDetailMatchResults)
-	http.HandleFunc("/request_greetings", requestGreetings)
-	http.HandleFunc("/request_recent_matches", requestRecentMatches)
-	http.HandleFunc("/request_recent_ffa_matches", requestRecentFFAMatches)
-	http.HandleFunc("/request_user_matches", requestUserMatches)
-	http.HandleFunc("/request_all_badges", requestAllBadges)
-	http.HandleFunc("/request_user_badges", requestUserBadges)
-	http.HandleFunc("/request_tournaments", requestTournaments)
+	http.HandleFunc("/request_users", withRole(RoleViewer, requestUsers))
+	http.HandleFunc("/request_latest_match", withRole(RoleViewer, requestLatestMatch))
+	http.HandleFunc("/request_user_profiles", withRole(RoleViewer, requestUserProfiles))
+	http.HandleFunc("/request_tournament_stats", withRole(RoleViewer, requestTournamentStats))
+	http.HandleFunc("/request_detail_results", withRole(RoleViewer, requestDetailMatchResults))
+	http.HandleFunc("/request_legacy_detail_results", withRole(RoleViewer, requestLegacyDetailMatchResults))
+	http.HandleFunc("/request_greetings", withRole(RoleViewer, requestGreetings))
+	http.HandleFunc("/request_recent_matches", withRole(RoleViewer, requestRecentMatches))
+	http.HandleFunc("/request_recent_ffa_matches", withRole(RoleViewer, requestRecentFFAMatches))
+	http.HandleFunc("/request_user_matches", withRole(RoleViewer, requestUserMatches))
+	http.HandleFunc("/request_user_ffa_matches", withRole(RoleViewer, requestUserFFAMatches))
+	http.HandleFunc("/request_user_tournament_summaries", withRole(RoleViewer, requestUserTournamentSummaries))
+	http.HandleFunc("/request_all_badges", withRole(RoleViewer, requestAllBadges))
+	http.HandleFunc("/request_user_badges", withRole(RoleViewer, requestUserBadges))
+	http.HandleFunc("/request_tournaments", withRole(RoleViewer, requestTournaments))
+	http.HandleFunc("/request_api_tokens", withRole(RoleViewer, requestAPITokens))
+	http.HandleFunc("/request_prediction_report", withRole(RoleViewer, requestPredictionReport))
+	http.HandleFunc("/request_batch_ratings", withRole(RoleViewer, requestBatchRatings))
+	http.HandleFunc("/request_rating_fit", withRole(RoleViewer, requestRatingFit))
+	http.HandleFunc("/simulate_matches", withRole(RoleViewer, simulateMatches))
+
+	// Feeds are read by feed readers, which cannot log in
+	http.HandleFunc("/feed", withRole(RolePublic, requestFeed))
+
+	// Streams
+	http.HandleFunc("/stream_tournament_events", withRole(RoleViewer, streamTournamentEvents))
 
 	// Admin area
-	http.HandleFunc("/delete_match_entry", deleteMatchEntry)
-	http.HandleFunc("/switch_match_users", switchMatchUsers)
-	http.HandleFunc("/rerun", rerunMatches)
+	http.HandleFunc("/delete_match_entry", withTournamentRole(RoleOrganizer, deleteMatchEntry))
+	http.HandleFunc("/switch_match_users", withTournamentRole(RoleOrganizer, switchMatchUsers))
+	http.HandleFunc("/retract_match", withTournamentRole(RolePlayer, retractMatch))
+	http.HandleFunc("/delete_ffa_match", withTournamentRole(RoleOrganizer, deleteFFAMatch))
+	http.HandleFunc("/rerun", withRole(RoleAdmin, rerunMatches))
+	http.HandleFunc("/replay_tournament", withTournamentRole(RoleOrganizer, replayTournament))
+	http.HandleFunc("/repair_tournament_stats", withRole(RoleAdmin, repairTournamentStats))
+	http.HandleFunc("/fit_rating_parameters", withTournamentRole(RoleOrganizer, fitRatings))
+	http.HandleFunc("/run_batch_ratings", withTournamentRole(RoleOrganizer, runBatchRatings))
+	http.HandleFunc("/rename_user", withRole(RoleAdmin, renameUser))
+	http.HandleFunc("/merge_users", withRole(RoleAdmin, mergeUsers))
+	http.HandleFunc("/request_profile_claims", withRole(RoleAdmin, requestProfileClaims))
+	http.HandleFunc("/review_profile_claim", withRole(RoleAdmin, reviewProfileClaim))
+	http.HandleFunc("/request_roles", withRole(RoleAdmin, requestRoles))
+	http.HandleFunc("/submit_role", withRole(RoleAdmin, submitRole))
+	http.HandleFunc("/delete_role", withRole(RoleAdmin, deleteRole))
+	// Versioned API, roles are checked per route
+	http.HandleFunc("/api/v1/", withRole(RolePublic, serveAPIV1))
+	http.HandleFunc("/api/v1/openapi.json", withRole(RolePublic, serveOpenAPI))
 	// Static files
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 }
@@ -68,9 +108,6 @@ func guestbookKey(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, "Guestbook", "default_guestbook", 0, nil)
 }
 
-var existLatestMatch = false
-var latestMatch Match
-
 const startingElo float64 = 1200.0
 
 // [START func_test_root]
@@ -110,54 +147,44 @@ func existBadge(c context.Context, name string) (bool, datastore.Key, Badge, err
 }
 
 func getUserBadges(c context.Context, username string) []Badge {
-	queryBadge := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(c)).Filter("User =", username)
-	var userBadges []UserBadge
-	if _, err := queryBadge.GetAll(c, &userBadges); err != nil {
+	badges, err := requestReadCache(c).readUserBadges(c, username)
+	if err != nil {
 		return []Badge{}
 	}
-
-	badges := []Badge{}
-	if len(userBadges) != 0 {
-		badges = make([]Badge, len(userBadges[0].BadgeNames))
-		for i, badgeName := range userBadges[0].BadgeNames {
-			exist, _, badge, err := existBadge(c, badgeName)
-			if exist && err == nil {
-				badges[i] = badge
-			} else {
-				badges = []Badge{}
-				break
-			}
-		}
-	}
 	return badges
 }
 
 // [START submit_match_result]
 func submitUser(w http.ResponseWriter, r *http.Request) {
 	// [START new_context]
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	// [END new_context]
 
-	// Check valid name
-	name := r.FormValue("name")
+	if _, err := createPlayer(c, r.FormValue("name")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	// [END if_user]
+}
 
+// createPlayer registers a new player in the default tournament
+func createPlayer(c context.Context, name string) (UserProfile, error) {
+	// Check valid name
 	re, _ := regexp.Compile("^[A-Za-z0-9_]{3,20}$")
 
 	isValid := re.MatchString(name)
 	if !isValid {
-		http.Error(w, "Not a valid name", http.StatusBadRequest)
-		return
+		return UserProfile{}, invalidArgumentError("Not a valid name")
 	}
 
 	exist, _, _, err := existUser(c, name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return UserProfile{}, err
 	}
 
 	if exist {
-		http.Error(w, "Already registered", http.StatusBadRequest)
-		return
+		return UserProfile{}, alreadyExistsError("Already registered")
 	}
 
 	// Is a valid new user.
@@ -172,13 +199,11 @@ func submitUser(w http.ResponseWriter, r *http.Request) {
 
 	// [END getall]
 	key := datastore.NewIncompleteKey(c, "UserProfile", guestbookKey(c))
-	_, err = datastore.Put(c, key, &g)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if _, err := datastore.Put(c, key, &g); err != nil {
+		return UserProfile{}, err
 	}
-	http.Redirect(w, r, "/", http.StatusFound)
-	// [END if_user]
+	invalidateTournamentResponses(c, legacyCacheScope)
+	return g, nil
 }
 
 // [START add_match_result]
@@ -189,7 +214,7 @@ func addMatchResult(w http.ResponseWriter, r *http.Request) {
 // [START func_addGreeting]
 func submitGreeting(w http.ResponseWriter, r *http.Request) {
 	// [START new_context]
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	// [END new_context]
 	g := Greeting{
 		Content: r.FormValue("content"),
@@ -203,9 +228,7 @@ func submitGreeting(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// [START if_user]
-	if u := user.Current(c); u != nil {
-		g.Author = u.String()
-	}
+	g.Author = currentLogin(c)
 	// We set the same parent key on every Greeting entity to ensure each Greeting
 	// is in the same entity group. Queries across the single entity group
 	// will be consistent. However, the write rate to a single entity group
@@ -223,54 +246,50 @@ func submitGreeting(w http.ResponseWriter, r *http.Request) {
 // [END func_addGreeting]
 
 func requestUsers(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	users, err := readPlayers(newContext(r))
+	writeAPIResponse(w, users, err)
+}
+
+// readPlayers reads all player profiles ordered by name
+func readPlayers(c context.Context) ([]UserProfile, error) {
 	queryUser := datastore.NewQuery("UserProfile").Ancestor(guestbookKey(c)).Order("Name")
-	var users []UserProfile
+	users := []UserProfile{}
 	if _, err := queryUser.GetAll(c, &users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	return users, nil
+}
 
-	js, errJs := json.Marshal(users)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
+// readPlayer reads the profile of a player
+func readPlayer(c context.Context, username string) (UserProfile, error) {
+	exist, _, user, err := existUser(c, username)
+	if err != nil {
+		return UserProfile{}, err
+	} else if !exist {
+		return UserProfile{}, notFoundError("User \"%s\" does not exist", username)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return user, nil
 }
 
 func requestLatestMatch(w http.ResponseWriter, r *http.Request) {
-	if !existLatestMatch {
-		nilJs, nilErrJs := json.Marshal(nil)
-		if nilErrJs != nil {
-			http.Error(w, nilErrJs.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(nilJs)
-		return
-	}
-
-	js, errJs := json.Marshal(latestMatch)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	match, err := readLatestMatch(newContext(r))
+	writeAPIResponse(w, match, err)
 }
 
 func requestUserProfiles(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	writeCachedResponse(w, r, c, legacyCacheScope, false, func() (interface{}, error) {
+		return readLegacyLeaderboard(c)
+	})
+}
+
+// readLegacyLeaderboard reads the Elo leaderboard of the default tournament
+func readLegacyLeaderboard(c context.Context) ([]UserProfileToShow, error) {
 	// Get users
 	queryUser := datastore.NewQuery("UserProfile").Ancestor(guestbookKey(c)).Order("-Rating")
 	var users []UserProfile
 	if _, err := queryUser.GetAll(c, &users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	// Create public user profile
 	userProfileToShows := make([]UserProfileToShow, len(users))
@@ -284,32 +303,30 @@ func requestUserProfiles(w http.ResponseWriter, r *http.Request) {
 			Badges: getUserBadges(c, u.Name),
 		}
 	}
-
-	js, errJs := json.Marshal(userProfileToShows)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return userProfileToShows, nil
 }
 
 func requestLegacyDetailMatchResults(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+	writeCachedResponse(w, r, c, legacyCacheScope, false, func() (interface{}, error) {
+		return readLegacyDetailMatchResults(c)
+	})
+}
+
+// readLegacyDetailMatchResults reads the head-to-head results of all players
+// in the default tournament
+func readLegacyDetailMatchResults(c context.Context) (MatchData, error) {
 	// Get users
 	queryUser := datastore.NewQuery("UserProfile").Ancestor(guestbookKey(c)).Order("-Rating")
 	var users []UserProfile
 	if _, err := queryUser.GetAll(c, &users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return MatchData{}, err
 	}
 	// Get matches
 	queryMatch := datastore.NewQuery("Match").Ancestor(guestbookKey(c))
 	var matches []Match
 	if _, err := queryMatch.GetAll(c, &matches); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return MatchData{}, err
 	}
 	// Name to index map
 	mp := make(map[string]int)
@@ -334,8 +351,7 @@ func requestLegacyDetailMatchResults(w http.ResponseWriter, r *http.Request) {
 		idxW, existW := mp[m.Winner]
 		idxL, existL := mp[m.Loser]
 		if !existW || !existL {
-			http.Error(w, "Datastore Error", http.StatusInternalServerError)
-			return
+			return MatchData{}, errors.New("Datastore Error")
 		}
 		resultTable[idxW][idxL].Wins++
 		resultTable[idxL][idxW].Losses++
@@ -352,18 +368,11 @@ func requestLegacyDetailMatchResults(w http.ResponseWriter, r *http.Request) {
 		ResultTable: resultTable,
 	}
 
-	js, err := json.Marshal(matchData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return matchData, nil
 }
 
 func requestGreetings(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 
 	// Get number of greetings to retrieve
 	// If the number is not a positive integer, return nil
@@ -397,83 +406,58 @@ func requestGreetings(w http.ResponseWriter, r *http.Request) {
 }
 
 func requestRecentMatches(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 
 	// Get number of matches to retrieve
 	// If the number is not a positive integer, return nil
-	limit := -1
-	limitParam := r.FormValue("num")
-	if limitParam != "" {
-		newLimit, err := strconv.Atoi(limitParam)
-		if err == nil && newLimit > 0 {
-			limit = newLimit
-		}
+	limit := parseLimitParam(r)
+
+	filter, err := parseMatchFilter(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
 	}
 
-	tournament := r.FormValue("tournament")
+	writeCachedResponse(w, r, c, legacyCacheScope, false, func() (interface{}, error) {
+		return readMatchPage(c, r.FormValue("tournament"), filter, r.FormValue("cursor"), limit)
+	})
+}
+
+// readMatchPage reads a page of legacy matches, limit -1 returns an empty page
+func readMatchPage(c context.Context, tournament string, filter MatchFilter, cursor string, limit int) (MatchPage, error) {
 	if tournament == "" {
 		tournament = "Default"
 	}
 
-	matchWithKeys := []MatchWithKey{}
-	if limit != -1 {
-		queryMatch := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).
-			Filter("Tournament = ", tournament).
-			Order("-Date").
-			Limit(limit)
-		var matches []Match
-		keyMatches, err := queryMatch.GetAll(c, &matches)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		matchWithKeys = make([]MatchWithKey, len(matches))
-		for i, m := range matches {
-			matchWithKeys[i] = MatchWithKey{
-				Match: m,
-				Key:   keyMatches[i].Encode(),
-			}
-		}
-	}
-
-	js, errJs := json.Marshal(matchWithKeys)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
+	page := MatchPage{Matches: []MatchWithKey{}}
+	if limit == -1 {
+		return page, nil
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	var err error
+	page.Matches, page.NextCursor, err = queryMatchPage(c, tournament, filter, cursor, limit)
+	return page, err
 }
 
 func requestUserMatches(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	// Get username
-	username := ""
-	keys, ok := r.URL.Query()["user"]
-	if ok && len(keys) == 1 {
-		username = keys[0]
-	}
-	exist, _, _, err := existUser(c, username)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	} else if !exist {
-		http.Error(w, "User \""+username+"\" does not exist", http.StatusInternalServerError)
-		return
+	matches, err := readPlayerMatches(newContext(r), r.FormValue("user"))
+	writeAPIResponse(w, matches, err)
+}
+
+// readPlayerMatches reads all legacy matches of a player, from oldest to newest
+func readPlayerMatches(c context.Context, username string) ([]Match, error) {
+	if _, err := readPlayer(c, username); err != nil {
+		return nil, err
 	}
 	// Get user matches
 	queryMatchW := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).Filter("Winner =", username)
 	var matchesW []Match
 	if _, err := queryMatchW.GetAll(c, &matchesW); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	queryMatchL := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).Filter("Loser =", username)
 	var matchesL []Match
 	if _, err := queryMatchL.GetAll(c, &matchesL); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	// Create history
 	n := len(matchesW)
@@ -490,63 +474,39 @@ func requestUserMatches(w http.ResponseWriter, r *http.Request) {
 		return allMatches[i].Date.Before(allMatches[j].Date)
 	})
 
-	js, errJs := json.Marshal(allMatches)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return allMatches, nil
 }
 
 func requestAllBadges(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	// Get all badges
+	c := newContext(r)
+	writeCachedResponse(w, r, c, legacyCacheScope, false, func() (interface{}, error) {
+		return readBadges(c)
+	})
+}
+
+// readBadges reads all badges
+func readBadges(c context.Context) ([]Badge, error) {
 	queryBadge := datastore.NewQuery("Badge").Ancestor(guestbookKey(c))
-	var badges []Badge
+	badges := []Badge{}
 	if _, err := queryBadge.GetAll(c, &badges); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	js, errJs := json.Marshal(badges)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return badges, nil
 }
 
 func requestUserBadges(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	// Get username
-	username := ""
-	keys, ok := r.URL.Query()["user"]
-	if ok && len(keys) == 1 {
-		username = keys[0]
-	}
-	exist, _, _, err := existUser(c, username)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	} else if !exist {
-		http.Error(w, "User \""+username+"\" does not exist", http.StatusInternalServerError)
-		return
-	}
-	// Get User badges
-	badges := getUserBadges(c, username)
+	c := newContext(r)
+	writeCachedResponse(w, r, c, legacyCacheScope, false, func() (interface{}, error) {
+		return readPlayerBadges(c, r.FormValue("user"))
+	})
+}
 
-	js, errJs := json.Marshal(badges)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
+// readPlayerBadges reads the badges given to a player
+func readPlayerBadges(c context.Context, username string) ([]Badge, error) {
+	if _, err := readPlayer(c, username); err != nil {
+		return nil, err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return getUserBadges(c, username), nil
 }
 
 // Get the color of win/lose/tie
@@ -577,7 +537,7 @@ func getColor(u UserProfile, v UserProfile, wins int, losses int) string {
 }
 
 func profile(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	// Get username
 	username := ""
 	keys, ok := r.URL.Query()["user"]
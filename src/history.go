@@ -0,0 +1,220 @@
+package guestbook
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about a player's history across tournaments, shown in the profile
+
+// UserFFAMatchEntry is a FFA match from the point of view of one player
+type UserFFAMatchEntry struct {
+	Key        string
+	Tournament string
+
+	// 1-based placement, players in a draw share the same placement
+	Placement  int
+	NumPlayers int
+	// Names of other players, from first place to last place
+	Opponents []string
+
+	// True skill stats of the player before and after the match
+	PreGameTrueSkillMu      float64
+	PreGameTrueSkillSigma   float64
+	PreGameTrueSkillRating  float64
+	PostGameTrueSkillMu     float64
+	PostGameTrueSkillSigma  float64
+	PostGameTrueSkillRating float64
+
+	// Probability of the match result, calculated by Trueskill
+	OutcomeProbability float64
+
+	Note           string
+	Submitter      string
+	SubmissionTime time.Time
+	// Time the match was played, SubmissionTime unless it was entered later
+	PlayedAt time.Time
+}
+
+// UserTournamentSummary is a player's stats in one tournament
+type UserTournamentSummary struct {
+	Tournament string
+	// 1-based rank by TrueSkill rating, out of NumRankedPlayers
+	Rank             int
+	NumRankedPlayers int
+	GamesPlayed      int
+	Stats            UserProfileToShow
+}
+
+// createUserFFAMatchEntry creates the entry of the player with userID in a
+// match, PlayerNames of the match must be filled in.
+func createUserFFAMatchEntry(key string, match FFAMatch, tournamentName string, userID int64) UserFFAMatchEntry {
+	index := -1
+	opponents := []string{}
+	for i, playerID := range match.Players {
+		if playerID == userID {
+			index = i
+		} else {
+			opponents = append(opponents, match.PlayerNames[i])
+		}
+	}
+
+	entry := UserFFAMatchEntry{
+		Key:                key,
+		Tournament:         tournamentName,
+		NumPlayers:         len(match.Players),
+		Opponents:          opponents,
+		OutcomeProbability: match.OutcomeProbability,
+		Note:               generateFFAMatchNote(match.PlayerNames, match.Draws),
+		Submitter:          match.Submitter,
+		SubmissionTime:     match.SubmissionTime,
+		PlayedAt:           match.playedAt(),
+	}
+	if index == -1 {
+		return entry
+	}
+
+	entry.Placement = placement(match.Draws, index)
+	entry.PreGameTrueSkillMu = match.PreGameTrueSkillMu[index]
+	entry.PreGameTrueSkillSigma = match.PreGameTrueSkillSigma[index]
+	entry.PreGameTrueSkillRating = match.PreGameTrueSkillRating[index]
+	entry.PostGameTrueSkillMu = match.PostGameTrueSkillMu[index]
+	entry.PostGameTrueSkillSigma = match.PostGameTrueSkillSigma[index]
+	entry.PostGameTrueSkillRating = match.PostGameTrueSkillRating[index]
+	return entry
+}
+
+// readUserFFAMatches reads all FFA matches of a player, optionally only in one
+// tournament (tournamentID != 0), from oldest to newest.
+func readUserFFAMatches(ctx context.Context, userID int64, tournamentID int64) ([]UserFFAMatchEntry, error) {
+	query := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("Players =", userID)
+	if tournamentID != 0 {
+		query = query.Filter("TournamentID =", tournamentID)
+	}
+
+	var matches []FFAMatch
+	keys, err := query.GetAll(ctx, &matches)
+	if err != nil {
+		return nil, err
+	}
+
+	matchWithKeys := make([]FFAMatchWithKey, len(matches))
+	for i, m := range matches {
+		matchWithKeys[i] = FFAMatchWithKey{Match: m, Key: keys[i].Encode()}
+	}
+	if err := fillInFFAMatchPlayerNames(ctx, matchWithKeys); err != nil {
+		return nil, err
+	}
+
+	tournamentNames, err := readTournamentNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]UserFFAMatchEntry, len(matchWithKeys))
+	for i, m := range matchWithKeys {
+		entries[i] = createUserFFAMatchEntry(m.Key, m.Match, tournamentNames[m.Match.TournamentID], userID)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PlayedAt.Before(entries[j].PlayedAt)
+	})
+	return entries, nil
+}
+
+func requestUserFFAMatches(w http.ResponseWriter, r *http.Request) {
+	entries, err := readPlayerFFAMatches(newContext(r), r.FormValue("user"), r.FormValue("tournament"))
+	writeAPIResponse(w, entries, err)
+}
+
+// readPlayerFFAMatches reads all FFA matches of a player by name, optionally
+// only in one tournament
+func readPlayerFFAMatches(ctx context.Context, userName string, tournamentName string) ([]UserFFAMatchEntry, error) {
+	userKey, err := findUserKey(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	var tournamentID int64
+	if tournamentName != "" {
+		tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+		if err != nil {
+			return nil, err
+		}
+		tournamentID = tournamentKey.IntID()
+	}
+
+	return readUserFFAMatches(ctx, userKey.IntID(), tournamentID)
+}
+
+// readUserTournamentSummaries reads a player's stats in every tournament the
+// player has played, ordered by tournament name.
+func readUserTournamentSummaries(ctx context.Context, userID int64, profile UserProfile) ([]UserTournamentSummary, error) {
+	query := datastore.NewQuery("UserTournamentStats").Ancestor(guestbookKey(ctx)).
+		Filter("UserID =", userID)
+	var statsList []UserTournamentStats
+	if _, err := query.GetAll(ctx, &statsList); err != nil {
+		return nil, err
+	}
+
+	tournamentNames, err := readTournamentNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]UserTournamentSummary, len(statsList))
+	for i, stats := range statsList {
+		// Rank in the tournament leaderboard, which is ordered by TrueSkill
+		// rating. Rows are only counted, the player's row is already read.
+		tournamentQuery := datastore.NewQuery("UserTournamentStats").Ancestor(guestbookKey(ctx)).
+			Filter("TournamentID =", stats.TournamentID).
+			KeysOnly()
+		numRankedPlayers, err := tournamentQuery.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		numBetterPlayers, err := tournamentQuery.
+			Filter("TrueSkillRating >", stats.TrueSkillRating).
+			Order("-TrueSkillRating").
+			Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries[i] = UserTournamentSummary{
+			Tournament:       tournamentNames[stats.TournamentID],
+			Rank:             numBetterPlayers + 1,
+			NumRankedPlayers: numRankedPlayers,
+			GamesPlayed:      stats.Games,
+			Stats:            createUserProfileToShow(profile, stats, nil),
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Tournament < summaries[j].Tournament
+	})
+	return summaries, nil
+}
+
+func requestUserTournamentSummaries(w http.ResponseWriter, r *http.Request) {
+	summaries, err := readPlayerTournamentSummaries(newContext(r), r.FormValue("user"))
+	writeAPIResponse(w, summaries, err)
+}
+
+// readPlayerTournamentSummaries reads a player's stats in every tournament by
+// player name
+func readPlayerTournamentSummaries(ctx context.Context, userName string) ([]UserTournamentSummary, error) {
+	exist, userKey, profile, err := findExistingUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	} else if !exist {
+		return nil, notFoundError("User \"%s\" does not exist", userName)
+	}
+
+	return readUserTournamentSummaries(ctx, userKey.IntID(), profile)
+}
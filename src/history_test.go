@@ -0,0 +1,45 @@
+package guestbook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateUserFFAMatchEntry(t *testing.T) {
+	// alice > bob = carol > dave
+	match := FFAMatch{
+		Players:                 []int64{1, 2, 3, 4},
+		PlayerNames:             []string{"alice", "bob", "carol", "dave"},
+		Draws:                   []bool{false, true, false},
+		PreGameTrueSkillMu:      []float64{25, 26, 27, 28},
+		PreGameTrueSkillSigma:   []float64{8, 7, 6, 5},
+		PreGameTrueSkillRating:  []float64{1, 5, 9, 13},
+		PostGameTrueSkillMu:     []float64{29, 27, 26, 24},
+		PostGameTrueSkillSigma:  []float64{7, 6, 5, 4},
+		PostGameTrueSkillRating: []float64{8, 9, 11, 12},
+	}
+
+	wantedPlacements := []int{1, 2, 2, 4}
+	for i, userID := range match.Players {
+		entry := createUserFFAMatchEntry("key", match, "Catan", userID)
+
+		if entry.Placement != wantedPlacements[i] {
+			t.Errorf("Wanted placement %d for player %d, got %d", wantedPlacements[i], userID, entry.Placement)
+		}
+		if len(entry.Opponents) != 3 {
+			t.Errorf("Wanted 3 opponents for player %d, got %v", userID, entry.Opponents)
+		}
+		if entry.PreGameTrueSkillMu != match.PreGameTrueSkillMu[i] ||
+			entry.PostGameTrueSkillRating != match.PostGameTrueSkillRating[i] {
+			t.Errorf("Wrong stats for player %d: %+v", userID, entry)
+		}
+	}
+
+	entry := createUserFFAMatchEntry("key", match, "Catan", 3)
+	if !reflect.DeepEqual(entry.Opponents, []string{"alice", "bob", "dave"}) {
+		t.Errorf("Wanted opponents in ranking order, got %v", entry.Opponents)
+	}
+	if entry.Note != "alice > bob = carol > dave" {
+		t.Errorf("Wrong note %q", entry.Note)
+	}
+}
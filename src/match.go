@@ -5,110 +5,130 @@ import (
 	"net/http"
 	"time"
 
-	"google.golang.org/appengine"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/user"
 )
 
 // Functions about creating match and calculating ELO ratings
 
+// Attempts of the transaction of a 1v1 match, before giving up on concurrent
+// submissions involving the same players
+const legacyMatchTransactionAttempts = 5
+
 // [START submit_match_result]
 func submitMatchResult(w http.ResponseWriter, r *http.Request) {
 	// [START new_context]
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	// [END new_context]
 
-	keyWinner := datastore.Key{}
-	keyLoser := datastore.Key{}
-	winner := UserProfile{}
-	loser := UserProfile{}
-	exist := false
-	var err error
-
-	winnerName := r.FormValue("winner")
-	loserName := r.FormValue("loser")
-
-	if winnerName == loserName {
-		http.Error(w, "Winner should not be the same as loser.",
-			http.StatusBadRequest)
-	}
-
-	// Check winner is registered.
-	exist, keyWinner, winner, err = existUser(c, winnerName)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := submitLegacyMatch(c,
+		r.FormValue("winner"), r.FormValue("loser"), r.FormValue("note"), r.FormValue("request_id")); err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
-	if !exist {
-		http.Error(w, "Winner has not registered", http.StatusBadRequest)
-		return
-	}
+	http.Redirect(w, r, "/add_match_result", http.StatusFound)
+}
 
-	// Check loser is registered.
-	exist, keyLoser, loser, err = existUser(c, loserName)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// submitLegacyMatch records a 1v1 match of the default tournament submitted by
+// the current login, and updates Elo ratings of both players. If the login
+// already recorded a match with requestID, that match is returned instead.
+func submitLegacyMatch(
+	c context.Context,
+	winnerName string,
+	loserName string,
+	note string,
+	requestID string) (Match, error) {
 
-	if !exist {
-		http.Error(w, "Loser has not registered", http.StatusBadRequest)
-		return
+	if winnerName == loserName {
+		return Match{}, invalidArgumentError("Winner should not be the same as loser.")
 	}
-
-	// Create match entry
-	tournament := "Default"
-	submitter := user.Current(c).String()
-	note := r.FormValue("note")
-	date := time.Now()
-	match := createMatch(
-		winner.Rating, loser.Rating,
-		winner.Name, loser.Name,
-		tournament, submitter, note, date)
-
-	// Insert match entry
-	key := datastore.NewIncompleteKey(c, "Match", guestbookKey(c))
-	keyMatch := &datastore.Key{}
-	keyMatch, err = datastore.Put(c, key, &match)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := checkParticipant(c, 0, []string{winnerName, loserName}); err != nil {
+		return Match{}, err
 	}
 
-	// Try to update winner
-	winner.Rating = match.WinnerRatingAfter
-	winner.Wins++
-	_, err = datastore.Put(c, &keyWinner, &winner)
-	if err != nil {
-		// Remove match entity as best-effort fallback.
-		datastore.Delete(c, keyMatch)
+	submitter := currentSubmitter(c)
+	date := time.Now()
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// Ratings are read and written in one transaction, which is retried if
+	// another submission changed either player in the meantime.
+	var match Match
+	err := runInTransaction(c, func(c context.Context) error {
+		if requestID != "" {
+			var matches []Match
+			if _, err := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).
+				Filter("Submitter =", submitter).
+				Filter("RequestID =", requestID).
+				Limit(1).
+				GetAll(c, &matches); err != nil {
+				return err
+			}
+			if len(matches) > 0 {
+				match = matches[0]
+				return nil
+			}
+		}
+
+		// Check winner is registered.
+		exist, keyWinner, winner, err := existUser(c, winnerName)
+		if err != nil {
+			return err
+		} else if !exist {
+			return notFoundError("Winner has not registered")
+		}
+
+		// Check loser is registered.
+		exist, keyLoser, loser, err := existUser(c, loserName)
+		if err != nil {
+			return err
+		} else if !exist {
+			return notFoundError("Loser has not registered")
+		}
+
+		// Create match entry
+		match = createMatch(
+			winner.Rating, loser.Rating,
+			winner.Name, loser.Name,
+			"Default", submitter, note, date)
+		match.RequestID = requestID
+
+		winner.Rating = match.WinnerRatingAfter
+		winner.Wins++
+		loser.Rating = match.LoserRatingAfter
+		loser.Losses++
+
+		keyMatch := datastore.NewIncompleteKey(c, "Match", guestbookKey(c))
+		if _, err := datastore.Put(c, keyMatch, &match); err != nil {
+			return err
+		}
+		_, err = datastore.PutMulti(c,
+			[]*datastore.Key{&keyWinner, &keyLoser},
+			[]UserProfile{winner, loser})
+		return err
+	}, &datastore.TransactionOptions{Attempts: legacyMatchTransactionAttempts})
 
-	// Try to update loser rating.
-	loser.Rating = match.LoserRatingAfter
-	loser.Losses++
-	_, err = datastore.Put(c, &keyLoser, &loser)
 	if err != nil {
-		// Remove match entity as best-effort fallback.
-		datastore.Delete(c, keyMatch)
-		// Change winner rating back.
-		winner.Rating = match.WinnerRatingBefore
-		winner.Wins--
-		datastore.Put(c, &keyWinner, &winner)
-
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Match{}, err
 	}
+	invalidateTournamentResponses(c, legacyCacheScope)
+	return match, nil
+}
 
-	// Update latest match
-	existLatestMatch = true
-	latestMatch = match
-
-	http.Redirect(w, r, "/add_match_result", http.StatusFound)
+// readLatestMatch reads the latest legacy match submitted by the current
+// login, nil if there is none
+func readLatestMatch(c context.Context) (*Match, error) {
+	var matches []Match
+	if _, err := datastore.NewQuery("Match").Ancestor(guestbookKey(c)).
+		Filter("Submitter =", currentSubmitter(c)).
+		Order("-Date").
+		Limit(1).
+		GetAll(c, &matches); err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return &matches[0], nil
 }
 
 // Create a match for two players in default tournament
@@ -137,11 +157,16 @@ func createMatch(
 
 // Get the new ratings of two players after a match
 func newRatings(oldRatingW, oldRatingL float64) (float64, float64) {
+	return newRatingsWithK(DefaultEloK, oldRatingW, oldRatingL)
+}
+
+// Get the new ratings of two players after a match, with the K-factor k
+func newRatingsWithK(k, oldRatingW, oldRatingL float64) (float64, float64) {
 	//Get new ELO value
 	expectedScoreW := expectedScore(oldRatingW, oldRatingL)
-	winnerNewRating := newElo(oldRatingW, expectedScoreW, 1.0)
+	winnerNewRating := newElo(k, oldRatingW, expectedScoreW, 1.0)
 	expectedScoreL := expectedScore(oldRatingL, oldRatingW)
-	loserNewRating := newElo(oldRatingL, expectedScoreL, 0.0)
+	loserNewRating := newElo(k, oldRatingL, expectedScoreL, 0.0)
 	return winnerNewRating, loserNewRating
 }
 
@@ -151,6 +176,6 @@ func expectedScore(eloA, eloB float64) float64 {
 }
 
 // Get the new Elo rating.
-func newElo(oldElo, expected, score float64) float64 {
-	return oldElo + 32.0*(score-expected)
+func newElo(k, oldElo, expected, score float64) float64 {
+	return oldElo + k*(score-expected)
 }
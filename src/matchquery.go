@@ -0,0 +1,232 @@
+package guestbook
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about paging through match history with datastore cursors.
+
+// Maximum number of matches read for a page. Some filters are applied to the
+// matches read, so a page can have fewer matches than requested, and still a
+// cursor to the next page.
+const matchPageScanLimit = 500
+
+// MatchFilter narrows down a match listing. Zero values mean no filtering.
+type MatchFilter struct {
+	// Name of a player who played the match. Legacy matches store the
+	// winner and the loser apart, which one query cannot match, so it is
+	// applied to the matches read for them.
+	Player string
+	// Submitter of the match, as stored in the match
+	Submitter string
+	// Matches played at or after From, and before To
+	From time.Time
+	To   time.Time
+	// Minimum number of players of the match, applied to the matches read
+	MinPlayers int
+}
+
+// parseMatchFilter reads the "player", "submitter", "from", "to" and
+// "minPlayers" parameters of a request. Dates are in RFC 3339 or YYYY-MM-DD
+// format.
+func parseMatchFilter(r *http.Request) (MatchFilter, error) {
+	filter := MatchFilter{
+		Player:    r.FormValue("player"),
+		Submitter: r.FormValue("submitter"),
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(r.FormValue("from")); err != nil {
+		return MatchFilter{}, err
+	}
+	if filter.To, err = parseTimeParam(r.FormValue("to")); err != nil {
+		return MatchFilter{}, err
+	}
+
+	if minPlayersParam := r.FormValue("minPlayers"); minPlayersParam != "" {
+		filter.MinPlayers, err = strconv.Atoi(minPlayersParam)
+		if err != nil || filter.MinPlayers < 0 {
+			return MatchFilter{}, invalidArgumentError("minPlayers must be a non-negative integer, got %s", minPlayersParam)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseTimeParam parses a time in RFC 3339 or YYYY-MM-DD format, an empty
+// value is the zero time.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, invalidArgumentError("%s is not a valid date", value)
+	}
+	return t, nil
+}
+
+// parseLimitParam reads the "num" parameter, returns -1 if it is not a
+// positive integer.
+func parseLimitParam(r *http.Request) int {
+	limit := -1
+	limitParam := r.FormValue("num")
+	if limitParam != "" {
+		newLimit, err := strconv.Atoi(limitParam)
+		if err == nil && newLimit > 0 {
+			limit = newLimit
+		}
+	}
+	return limit
+}
+
+// startFromCursor makes the query continue from an encoded cursor, if any
+func startFromCursor(query *datastore.Query, cursor string) (*datastore.Query, error) {
+	if cursor == "" {
+		return query, nil
+	}
+	c, err := datastore.DecodeCursor(cursor)
+	if err != nil {
+		return nil, invalidArgumentError("invalid cursor: %s", err.Error())
+	}
+	return query.Start(c), nil
+}
+
+// queryFFAMatchPage reads up to limit matches of a tournament from the last
+// played to the first, starting from cursor, and at most matchPageScanLimit matches before
+// filtering. It returns the cursor of the next page, which is empty when there
+// are no more matches.
+func queryFFAMatchPage(
+	ctx context.Context,
+	tournamentID int64,
+	filter MatchFilter,
+	cursor string,
+	limit int) ([]FFAMatchWithKey, string, error) {
+
+	query := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID)
+
+	if filter.Player != "" {
+		userKey, err := findUserKey(ctx, filter.Player)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Filter("Players =", userKey.IntID())
+	}
+	if filter.Submitter != "" {
+		query = query.Filter("Submitter =", filter.Submitter)
+	}
+	if !filter.From.IsZero() {
+		query = query.Filter("PlayedAt >=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Filter("PlayedAt <", filter.To)
+	}
+
+	// Matches recorded before PlayedAt was kept are only found once
+	// backfillFFAMatchPlayedAt has run
+	query, err := startFromCursor(query.Order("-PlayedAt"), cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	matchWithKeys := []FFAMatchWithKey{}
+	it := query.Run(ctx)
+	for scanned := 0; len(matchWithKeys) < limit && scanned < matchPageScanLimit; scanned++ {
+		var match FFAMatch
+		key, err := it.Next(&match)
+		if err == datastore.Done {
+			return matchWithKeys, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		// Number of players is not indexed, filter it here
+		if len(match.Players) < filter.MinPlayers {
+			continue
+		}
+
+		matchWithKeys = append(matchWithKeys, FFAMatchWithKey{
+			Match: match,
+			Key:   key.Encode(),
+		})
+	}
+
+	next, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return matchWithKeys, next.String(), nil
+}
+
+// queryMatchPage is the same as queryFFAMatchPage for legacy 1v1 matches
+func queryMatchPage(
+	ctx context.Context,
+	tournament string,
+	filter MatchFilter,
+	cursor string,
+	limit int) ([]MatchWithKey, string, error) {
+
+	matchWithKeys := []MatchWithKey{}
+
+	// Legacy matches always have 2 players
+	if filter.MinPlayers > 2 {
+		return matchWithKeys, "", nil
+	}
+
+	query := datastore.NewQuery("Match").Ancestor(guestbookKey(ctx)).
+		Filter("Tournament =", tournament)
+
+	if filter.Submitter != "" {
+		query = query.Filter("Submitter =", filter.Submitter)
+	}
+	if !filter.From.IsZero() {
+		query = query.Filter("Date >=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Filter("Date <", filter.To)
+	}
+
+	query, err := startFromCursor(query.Order("-Date"), cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	it := query.Run(ctx)
+	for scanned := 0; len(matchWithKeys) < limit && scanned < matchPageScanLimit; scanned++ {
+		var match Match
+		key, err := it.Next(&match)
+		if err == datastore.Done {
+			return matchWithKeys, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		// A player can be either winner or loser, which cannot be done in a
+		// single query.
+		if filter.Player != "" && match.Winner != filter.Player && match.Loser != filter.Player {
+			continue
+		}
+
+		matchWithKeys = append(matchWithKeys, MatchWithKey{
+			Match: match,
+			Key:   key.Encode(),
+		})
+	}
+
+	next, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return matchWithKeys, next.String(), nil
+}
@@ -0,0 +1,263 @@
+package guestbook
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about how well pre-game ratings predicted match results. Every
+// pair of players of a match who did not draw is a prediction of the winner:
+// the TrueSkill win probability from the pre-game mu and sigma in FFA matches,
+// and the Elo expected score in 1v1 matches.
+
+// Calibration buckets split the probability of the favorite, from 0.5 to 1,
+// into buckets of this width
+const calibrationBucketWidth = 0.1
+
+// Number of upsets in a report
+const predictionReportUpsets = 10
+
+// Probabilities are clamped to this distance from 0 and 1 in log-losses
+const logLossEpsilon = 1e-15
+
+// pairPrediction is the predicted probability that the winner of a pair of
+// players would beat the loser
+type pairPrediction struct {
+	winner      string
+	loser       string
+	probability float64
+}
+
+// predictedMatch is a match with the predictions of its pairs of players
+type predictedMatch struct {
+	note           string
+	submissionTime time.Time
+	// Whether the player with the best pre-game rating won, or shared first
+	// place
+	favoriteWon bool
+	predictions []pairPrediction
+	// Probability of the full result, 0 if it is not known
+	outcomeProbability float64
+}
+
+// predictFFAMatch returns the predictions of a FFA match, names are the player
+// names of the match and beta the TrueSkill performance deviation
+func predictFFAMatch(match FFAMatch, names []string, beta float64) predictedMatch {
+	favorite := 0
+	for i, mu := range match.PreGameTrueSkillMu {
+		if mu > match.PreGameTrueSkillMu[favorite] {
+			favorite = i
+		}
+	}
+
+	predicted := predictedMatch{
+		note:               match.Note,
+		submissionTime:     match.SubmissionTime,
+		favoriteWon:        placement(match.Draws, favorite) == 1,
+		outcomeProbability: match.OutcomeProbability,
+	}
+	forEachFFAPair(match, func(i int, j int, isDraw bool) {
+		if isDraw {
+			return
+		}
+		predicted.predictions = append(predicted.predictions, pairPrediction{
+			winner: names[i],
+			loser:  names[j],
+			probability: trueSkillWinProbability(beta,
+				match.PreGameTrueSkillMu[i], match.PreGameTrueSkillSigma[i],
+				match.PreGameTrueSkillMu[j], match.PreGameTrueSkillSigma[j]),
+		})
+	})
+	return predicted
+}
+
+// predictLegacyMatch returns the prediction of a 1v1 match
+func predictLegacyMatch(match Match) predictedMatch {
+	return predictedMatch{
+		note:           match.Note,
+		submissionTime: match.Date,
+		favoriteWon:    match.Expected,
+		predictions: []pairPrediction{{
+			winner:      match.Winner,
+			loser:       match.Loser,
+			probability: expectedScore(match.WinnerRatingBefore, match.LoserRatingBefore),
+		}},
+	}
+}
+
+// logLoss is the log-loss of a predicted probability of what happened
+func logLoss(probability float64) float64 {
+	return -math.Log(math.Min(math.Max(probability, logLossEpsilon), 1-logLossEpsilon))
+}
+
+// buildPredictionReport measures the predictions of matches
+func buildPredictionReport(tournament string, matches []predictedMatch) PredictionReport {
+	report := PredictionReport{
+		Tournament: tournament,
+		Matches:    len(matches),
+		Upsets:     []Upset{},
+	}
+
+	numBuckets := int(math.Ceil(0.5 / calibrationBucketWidth))
+	report.Calibration = make([]CalibrationBucket, numBuckets)
+	favoriteWins := make([]float64, numBuckets)
+	for b := range report.Calibration {
+		report.Calibration[b].MinProbability = 0.5 + float64(b)*calibrationBucketWidth
+		report.Calibration[b].MaxProbability = math.Min(0.5+float64(b+1)*calibrationBucketWidth, 1)
+	}
+
+	outcomes := 0
+	for _, match := range matches {
+		if match.favoriteWon {
+			report.FavoriteWins++
+		}
+		if match.outcomeProbability > 0 {
+			report.OutcomeLogLoss += logLoss(match.outcomeProbability)
+			outcomes++
+		}
+
+		var biggestUpset *pairPrediction
+		for i, prediction := range match.predictions {
+			p := prediction.probability
+			report.Predictions++
+			report.LogLoss += logLoss(p)
+			report.BrierScore += (1 - p) * (1 - p)
+
+			// Buckets are by the probability of the favorite of the pair, who
+			// won half a time when both were even
+			favoriteProbability, favoriteWin := p, 1.0
+			if p < 0.5 {
+				favoriteProbability, favoriteWin = 1-p, 0
+			} else if p == 0.5 {
+				favoriteWin = 0.5
+			}
+			b := minInt(int((favoriteProbability-0.5)/calibrationBucketWidth), numBuckets-1)
+			report.Calibration[b].Predictions++
+			report.Calibration[b].MeanProbability += favoriteProbability
+			favoriteWins[b] += favoriteWin
+
+			if p < 0.5 && (biggestUpset == nil || p < biggestUpset.probability) {
+				biggestUpset = &match.predictions[i]
+			}
+		}
+
+		if biggestUpset != nil {
+			report.Upsets = append(report.Upsets, Upset{
+				Note:           match.note,
+				SubmissionTime: match.submissionTime,
+				Winner:         biggestUpset.winner,
+				Loser:          biggestUpset.loser,
+				Probability:    biggestUpset.probability,
+			})
+		}
+	}
+
+	if report.Matches > 0 {
+		report.FavoriteWinRate = float64(report.FavoriteWins) / float64(report.Matches)
+	}
+	if report.Predictions > 0 {
+		report.LogLoss /= float64(report.Predictions)
+		report.BrierScore /= float64(report.Predictions)
+	}
+	if outcomes > 0 {
+		report.OutcomeLogLoss /= float64(outcomes)
+	}
+	for b := range report.Calibration {
+		bucket := &report.Calibration[b]
+		if bucket.Predictions > 0 {
+			bucket.MeanProbability /= float64(bucket.Predictions)
+			bucket.FavoriteWinRate = favoriteWins[b] / float64(bucket.Predictions)
+		}
+	}
+
+	sort.SliceStable(report.Upsets, func(i, j int) bool {
+		return report.Upsets[i].Probability < report.Upsets[j].Probability
+	})
+	if len(report.Upsets) > predictionReportUpsets {
+		report.Upsets = report.Upsets[:predictionReportUpsets]
+	}
+	return report
+}
+
+// readPredictionReport measures the predictions of every match of a
+// tournament, or of 1v1 matches if tournamentName is empty
+func readPredictionReport(ctx context.Context, tournamentName string) (PredictionReport, error) {
+	if tournamentName == "" {
+		var matches []Match
+		if _, err := datastore.NewQuery("Match").Ancestor(guestbookKey(ctx)).
+			Order("Date").
+			GetAll(ctx, &matches); err != nil {
+			return PredictionReport{}, err
+		}
+		predictedMatches := make([]predictedMatch, len(matches))
+		for i, match := range matches {
+			predictedMatches[i] = predictLegacyMatch(match)
+		}
+		return buildPredictionReport("", predictedMatches), nil
+	}
+
+	exist, tournamentKey, tournament, err := findExistingTournament(ctx, tournamentName)
+	if err != nil {
+		return PredictionReport{}, err
+	}
+	if !exist {
+		return PredictionReport{}, notFoundError("tournament %s does not exist", tournamentName)
+	}
+	var matches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentKey.IntID()).
+		Order("SubmissionTime").
+		GetAll(ctx, &matches); err != nil {
+		return PredictionReport{}, err
+	}
+
+	playerIDMap := make(map[int64]bool)
+	for _, match := range matches {
+		for _, playerID := range match.Players {
+			playerIDMap[playerID] = true
+		}
+	}
+	var playerIDs []int64
+	for id := range playerIDMap {
+		playerIDs = append(playerIDs, id)
+	}
+	playerProfileMap, err := readUserIDAndProfileMapping(ctx, playerIDs)
+	if err != nil {
+		return PredictionReport{}, err
+	}
+
+	predictedMatches := make([]predictedMatch, len(matches))
+	for i, match := range matches {
+		names := make([]string, len(match.Players))
+		for j, playerID := range match.Players {
+			names[j] = playerProfileMap[playerID].Name
+		}
+		predictedMatches[i] = predictFFAMatch(match, names, tournament.trueSkillBeta())
+	}
+	return buildPredictionReport(tournamentName, predictedMatches), nil
+}
+
+// requestPredictionReport responds the prediction report of a tournament, or
+// of 1v1 matches without the tournament parameter
+func requestPredictionReport(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	tournamentName := r.FormValue("tournament")
+
+	scope := int64(legacyCacheScope)
+	if tournamentName != "" {
+		var err error
+		scope, err = tournamentCacheScope(ctx, tournamentName)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	writeCachedResponse(w, r, ctx, scope, false, func() (interface{}, error) {
+		return readPredictionReport(ctx, tournamentName)
+	})
+}
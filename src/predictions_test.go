@@ -0,0 +1,71 @@
+package guestbook
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPredictFFAMatch(t *testing.T) {
+	match := FFAMatch{
+		Players:               []int64{10, 11, 12},
+		Draws:                 []bool{false, true},
+		PreGameTrueSkillMu:    []float64{20, 30, 25},
+		PreGameTrueSkillSigma: []float64{2, 2, 2},
+		OutcomeProbability:    0.1,
+	}
+
+	predicted := predictFFAMatch(match, []string{"alice", "bob", "carol"}, DefaultTrueSkillBeta)
+	if predicted.favoriteWon {
+		t.Errorf("Wanted favorite bob to lose")
+	}
+	// bob and carol drew
+	if len(predicted.predictions) != 2 {
+		t.Fatalf("Wanted 2 predictions, got %d", len(predicted.predictions))
+	}
+	if p := predicted.predictions[0]; p.winner != "alice" || p.loser != "bob" || p.probability >= 0.5 {
+		t.Errorf("Wanted an unlikely win of alice over bob, got %+v", p)
+	}
+}
+
+func TestBuildPredictionReport(t *testing.T) {
+	matches := []predictedMatch{
+		predictLegacyMatch(Match{Winner: "alice", Loser: "bob", WinnerRatingBefore: 1400, LoserRatingBefore: 1400, Expected: true}),
+		predictLegacyMatch(Match{Winner: "alice", Loser: "bob", WinnerRatingBefore: 1600, LoserRatingBefore: 1400, Expected: true}),
+		predictLegacyMatch(Match{Winner: "bob", Loser: "alice", WinnerRatingBefore: 1400, LoserRatingBefore: 1600}),
+	}
+	p := expectedScore(1600, 1400)
+
+	report := buildPredictionReport("", matches)
+	if report.Matches != 3 || report.FavoriteWins != 2 || report.Predictions != 3 {
+		t.Errorf("Wanted 3 matches, 2 favorite wins and 3 predictions, got %+v", report)
+	}
+
+	wantLogLoss := (-math.Log(0.5) - math.Log(p) - math.Log(1-p)) / 3
+	if math.Abs(report.LogLoss-wantLogLoss) > 1e-9 {
+		t.Errorf("Wanted log-loss %f, got %f", wantLogLoss, report.LogLoss)
+	}
+	wantBrierScore := (0.25 + (1-p)*(1-p) + p*p) / 3
+	if math.Abs(report.BrierScore-wantBrierScore) > 1e-9 {
+		t.Errorf("Wanted Brier score %f, got %f", wantBrierScore, report.BrierScore)
+	}
+	if report.OutcomeLogLoss != 0 {
+		t.Errorf("Wanted no outcome log-loss for 1v1 matches, got %f", report.OutcomeLogLoss)
+	}
+
+	if len(report.Calibration) != 5 {
+		t.Fatalf("Wanted 5 calibration buckets, got %d", len(report.Calibration))
+	}
+	even := report.Calibration[0]
+	if even.Predictions != 1 || even.FavoriteWinRate != 0.5 {
+		t.Errorf("Wanted an even prediction counted as half a win, got %+v", even)
+	}
+	// p is about 0.76
+	favorite := report.Calibration[2]
+	if favorite.Predictions != 2 || favorite.FavoriteWinRate != 0.5 || math.Abs(favorite.MeanProbability-p) > 1e-9 {
+		t.Errorf("Wanted 2 predictions of %f won half the time, got %+v", p, favorite)
+	}
+
+	if len(report.Upsets) != 1 || report.Upsets[0].Winner != "bob" {
+		t.Errorf("Wanted the win of bob as the only upset, got %+v", report.Upsets)
+	}
+}
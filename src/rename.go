@@ -0,0 +1,420 @@
+package guestbook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about renaming and merging player profiles. Legacy matches, badges
+// and claims refer to players by name, while FFA data refers to them by ID.
+//
+// Both operations update references first and the profiles last, and every
+// step only changes references which still point to the old name or ID. If one
+// fails halfway, running it again with the same arguments completes it, since
+// the old profile is still there. Replays of the ratings are scheduled along
+// with the FFA matches they depend on, so they are not lost either.
+
+// renameUser renames a player, and updates every reference by name
+func renameUser(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if err := renamePlayer(ctx, r.FormValue("user"), r.FormValue("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// mergeUsers merges a duplicate profile into another one. Ratings of legacy
+// matches are replayed, and replays of the affected tournaments are scheduled.
+func mergeUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if err := mergePlayers(ctx, r.FormValue("from"), r.FormValue("into")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+func renamePlayer(ctx context.Context, oldName string, newName string) error {
+	re, _ := regexp.Compile("^[A-Za-z0-9_]{3,20}$")
+	if !re.MatchString(newName) {
+		return errors.New("Not a valid name")
+	}
+
+	userKey, err := findUserKey(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	exist, _, _, err := findExistingUser(ctx, newName)
+	if err != nil {
+		return err
+	} else if exist {
+		return errors.New("Already registered")
+	}
+	userID := userKey.IntID()
+
+	// Legacy matches
+	if err := updateLegacyMatches(ctx, "Winner", oldName, func(m *Match) { m.Winner = newName }); err != nil {
+		return err
+	}
+	if err := updateLegacyMatches(ctx, "Loser", oldName, func(m *Match) { m.Loser = newName }); err != nil {
+		return err
+	}
+	if err := replaceSubmitter(ctx, oldName, newName); err != nil {
+		return err
+	}
+
+	// Notes of FFA matches contain player names
+	var matches []FFAMatch
+	matchKeys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("Players =", userID).
+		GetAll(ctx, &matches)
+	if err != nil {
+		return err
+	}
+	if err := regenerateFFAMatchNotes(ctx, matches, userID, newName); err != nil {
+		return err
+	}
+	if err := putFFAMatchesInBatches(ctx, matchKeys, matches, false); err != nil {
+		return err
+	}
+
+	// Badges
+	var userBadges []UserBadge
+	badgeKeys, err := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(ctx)).
+		Filter("User =", oldName).
+		GetAll(ctx, &userBadges)
+	if err != nil {
+		return err
+	}
+	for i := range userBadges {
+		userBadges[i].User = newName
+	}
+	if _, err := datastore.PutMulti(ctx, badgeKeys, userBadges); err != nil {
+		return err
+	}
+
+	// Claims
+	if err := updateProfileClaims(ctx, userID, func(c *ProfileClaim) { c.UserName = newName }); err != nil {
+		return err
+	}
+
+	// Head-to-head results
+	if err := renameInHeadToHeads(ctx, userID, newName); err != nil {
+		return err
+	}
+
+	// Profile, whose name is shown in all tournaments
+	defer invalidateAllResponses(ctx)
+	return runInTransaction(ctx, func(ctx context.Context) error {
+		exist, _, _, err := findExistingUser(ctx, newName)
+		if err != nil {
+			return err
+		} else if exist {
+			return errors.New("Already registered")
+		}
+
+		var profile UserProfile
+		if err := datastore.Get(ctx, &userKey, &profile); err != nil {
+			return err
+		}
+		profile.Name = newName
+		_, err = datastore.Put(ctx, &userKey, &profile)
+		return err
+	}, nil)
+}
+
+func mergePlayers(ctx context.Context, fromName string, intoName string) error {
+	if fromName == intoName {
+		return errors.New("cannot merge a player into itself")
+	}
+
+	exist, fromKey, fromProfile, err := findExistingUser(ctx, fromName)
+	if err != nil {
+		return err
+	} else if !exist {
+		return fmt.Errorf("username %s does not exist", fromName)
+	}
+	exist, intoKey, intoProfile, err := findExistingUser(ctx, intoName)
+	if err != nil {
+		return err
+	} else if !exist {
+		return fmt.Errorf("username %s does not exist", intoName)
+	}
+	fromID := fromKey.IntID()
+	intoID := intoKey.IntID()
+
+	// Check for matches between the two players before changing anything
+	var matches []FFAMatch
+	matchKeys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("Players =", fromID).
+		GetAll(ctx, &matches)
+	if err != nil {
+		return err
+	}
+	for i := range matches {
+		for j, playerID := range matches[i].Players {
+			if playerID == intoID {
+				return fmt.Errorf("%s and %s played in the same FFA match at %s",
+					fromName, intoName, matches[i].SubmissionTime)
+			}
+			if playerID == fromID {
+				matches[i].Players[j] = intoID
+			}
+		}
+	}
+
+	var legacyMatches []Match
+	if _, err := datastore.NewQuery("Match").Ancestor(guestbookKey(ctx)).
+		Filter("Winner =", fromName).
+		Filter("Loser =", intoName).
+		GetAll(ctx, &legacyMatches); err != nil {
+		return err
+	}
+	if _, err := datastore.NewQuery("Match").Ancestor(guestbookKey(ctx)).
+		Filter("Winner =", intoName).
+		Filter("Loser =", fromName).
+		GetAll(ctx, &legacyMatches); err != nil {
+		return err
+	}
+	if len(legacyMatches) != 0 {
+		return fmt.Errorf("%s and %s played against each other at %s",
+			fromName, intoName, legacyMatches[0].Date)
+	}
+
+	// FFA matches, with a replay of their tournament which recreates the stats
+	// of the merged player and deletes the stats of the duplicate
+	if err := regenerateFFAMatchNotes(ctx, matches, intoID, intoName); err != nil {
+		return err
+	}
+	if err := putFFAMatchesInBatches(ctx, matchKeys, matches, true); err != nil {
+		return err
+	}
+
+	// Legacy matches
+	if err := updateLegacyMatches(ctx, "Winner", fromName, func(m *Match) { m.Winner = intoName }); err != nil {
+		return err
+	}
+	if err := updateLegacyMatches(ctx, "Loser", fromName, func(m *Match) { m.Loser = intoName }); err != nil {
+		return err
+	}
+	if err := replaceSubmitter(ctx, fromName, intoName); err != nil {
+		return err
+	}
+
+	// Badges
+	if err := mergeUserBadges(ctx, fromName, intoName); err != nil {
+		return err
+	}
+
+	// Claims
+	if err := updateProfileClaims(ctx, fromID, func(c *ProfileClaim) {
+		c.UserID = intoID
+		c.UserName = intoName
+	}); err != nil {
+		return err
+	}
+
+	// The linked account moves along if the other profile has none
+	if intoProfile.AccountID == "" && fromProfile.AccountID != "" {
+		intoProfile.AccountID = fromProfile.AccountID
+		intoProfile.AccountEmail = fromProfile.AccountEmail
+		if _, err := datastore.Put(ctx, &intoKey, &intoProfile); err != nil {
+			return err
+		}
+	}
+
+	// Legacy ratings
+	if err := rerunLegacyMatches(ctx); err != nil {
+		return err
+	}
+
+	// The duplicate profile is deleted last, a merge which failed before can
+	// only be run again while it exists
+	defer invalidateAllResponses(ctx)
+	return datastore.Delete(ctx, &fromKey)
+}
+
+// updateLegacyMatches applies update to every legacy match whose field equals
+// to value
+func updateLegacyMatches(ctx context.Context, field string, value string, update func(*Match)) error {
+	var matches []Match
+	keys, err := datastore.NewQuery("Match").Ancestor(guestbookKey(ctx)).
+		Filter(field+" =", value).
+		GetAll(ctx, &matches)
+	if err != nil {
+		return err
+	}
+	for i := range matches {
+		update(&matches[i])
+	}
+	for start := 0; start < len(matches); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(matches))
+		if _, err := datastore.PutMulti(ctx, keys[start:end], matches[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceSubmitter updates matches submitted by a player name, which is the
+// case for logins linked to a profile, and personal API tokens whose owner is
+// the player, since they record their owner as submitter
+func replaceSubmitter(ctx context.Context, oldName string, newName string) error {
+	if err := updateLegacyMatches(ctx, "Submitter", oldName, func(m *Match) { m.Submitter = newName }); err != nil {
+		return err
+	}
+
+	var matches []FFAMatch
+	keys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("Submitter =", oldName).
+		GetAll(ctx, &matches)
+	if err != nil {
+		return err
+	}
+	for i := range matches {
+		matches[i].Submitter = newName
+	}
+	if err := putFFAMatchesInBatches(ctx, keys, matches, false); err != nil {
+		return err
+	}
+
+	var tokens []APIToken
+	tokenKeys, err := datastore.NewQuery("APIToken").Ancestor(guestbookKey(ctx)).
+		Filter("Owner =", oldName).
+		Filter("Service =", false).
+		GetAll(ctx, &tokens)
+	if err != nil {
+		return err
+	}
+	for i := range tokens {
+		tokens[i].Owner = newName
+	}
+	_, err = datastore.PutMulti(ctx, tokenKeys, tokens)
+	return err
+}
+
+// regenerateFFAMatchNotes regenerates notes of matches from the current names
+// of their players, except userID whose name is name
+func regenerateFFAMatchNotes(ctx context.Context, matches []FFAMatch, userID int64, name string) error {
+	matchWithKeys := make([]FFAMatchWithKey, len(matches))
+	for i, m := range matches {
+		matchWithKeys[i] = FFAMatchWithKey{Match: m}
+	}
+	if err := fillInFFAMatchPlayerNames(ctx, matchWithKeys); err != nil {
+		return err
+	}
+	for i := range matches {
+		names := matchWithKeys[i].Match.PlayerNames
+		for j, playerID := range matches[i].Players {
+			if playerID == userID {
+				names[j] = name
+			}
+		}
+		matches[i].Note = generateFFAMatchNote(names, matches[i].Draws)
+	}
+	return nil
+}
+
+// putFFAMatchesInBatches writes changed matches by tournament. Each batch
+// increments the stats version of its tournament, so that a replay running
+// meanwhile does not write the matches back. If replay is set, each batch also
+// schedules a replay of its tournament.
+func putFFAMatchesInBatches(ctx context.Context, keys []*datastore.Key, matches []FFAMatch, replay bool) error {
+	indexesByTournament := make(map[int64][]int)
+	for i, match := range matches {
+		indexesByTournament[match.TournamentID] = append(indexesByTournament[match.TournamentID], i)
+	}
+
+	// The tournament is written along with each batch
+	batchSize := datastoreBatchSize - 1
+	for tournamentID, indexes := range indexesByTournament {
+		for start := 0; start < len(indexes); start += batchSize {
+			end := minInt(start+batchSize, len(indexes))
+			batchKeys := make([]*datastore.Key, end-start)
+			batch := make([]FFAMatch, end-start)
+			for i, index := range indexes[start:end] {
+				batchKeys[i] = keys[index]
+				batch[i] = matches[index]
+			}
+			if err := runInTransaction(ctx, func(ctx context.Context) error {
+				if _, err := datastore.PutMulti(ctx, batchKeys, batch); err != nil {
+					return err
+				}
+				return changeTournamentStats(ctx, tournamentID, replay)
+			}, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeUserBadges moves badges of a player to another player
+func mergeUserBadges(ctx context.Context, fromName string, intoName string) error {
+	var fromBadges []UserBadge
+	fromKeys, err := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(ctx)).
+		Filter("User =", fromName).
+		GetAll(ctx, &fromBadges)
+	if err != nil || len(fromBadges) == 0 {
+		return err
+	}
+
+	var intoBadges []UserBadge
+	intoKeys, err := datastore.NewQuery("UserBadge").Ancestor(guestbookKey(ctx)).
+		Filter("User =", intoName).
+		GetAll(ctx, &intoBadges)
+	if err != nil {
+		return err
+	}
+
+	if len(intoBadges) == 0 {
+		fromBadges[0].User = intoName
+		_, err := datastore.Put(ctx, fromKeys[0], &fromBadges[0])
+		return err
+	}
+
+	for _, badgeName := range fromBadges[0].BadgeNames {
+		if !containsString(intoBadges[0].BadgeNames, badgeName) {
+			intoBadges[0].BadgeNames = append(intoBadges[0].BadgeNames, badgeName)
+		}
+	}
+	if _, err := datastore.Put(ctx, intoKeys[0], &intoBadges[0]); err != nil {
+		return err
+	}
+	return datastore.Delete(ctx, fromKeys[0])
+}
+
+// updateProfileClaims applies update to every claim on a profile
+func updateProfileClaims(ctx context.Context, userID int64, update func(*ProfileClaim)) error {
+	var claims []ProfileClaim
+	keys, err := datastore.NewQuery("ProfileClaim").Ancestor(guestbookKey(ctx)).
+		Filter("UserID =", userID).
+		GetAll(ctx, &claims)
+	if err != nil {
+		return err
+	}
+	for i := range claims {
+		update(&claims[i])
+	}
+	_, err = datastore.PutMulti(ctx, keys, claims)
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
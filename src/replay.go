@@ -0,0 +1,499 @@
+package guestbook
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+)
+
+// Functions about replaying the FFA match history of a tournament, used after
+// the history was changed by admin operations or by a backdated match.
+//
+// A replay reads the whole history, then writes in several transactions.
+// Every change of the matches or stats of a tournament increments its
+// StatsVersion in the transaction of the change, and every transaction of a
+// replay checks that the version did not change since the history was read.
+// A replay which was overtaken starts again, so it never overwrites a
+// concurrent change with stale values.
+
+// Maximum number of entities in a single datastore batch operation
+const datastoreBatchSize = 500
+
+// Number of times a replay starts again after a concurrent change, before it
+// fails
+const replayAttempts = 3
+
+// errReplayConflict is returned by a replay overtaken by a change of the
+// tournament
+var errReplayConflict = errors.New("the tournament changed during the replay, please retry")
+
+// changeTournamentStats increments the stats version of a tournament, it must
+// be called in the transaction of every change of its matches or stats. If
+// replay is set, a replay of the tournament is scheduled as a task which is
+// added when the transaction commits, and retried until it succeeds.
+func changeTournamentStats(ctx context.Context, tournamentID int64, replay bool) error {
+	key := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+	var tournament Tournament
+	if err := datastore.Get(ctx, key, &tournament); err != nil {
+		return err
+	}
+	tournament.StatsVersion++
+	tournament.ReplayPending = tournament.ReplayPending || replay
+	if _, err := datastore.Put(ctx, key, &tournament); err != nil {
+		return err
+	}
+	if replay {
+		return replayFFAMatchesLater.Call(ctx, tournamentID)
+	}
+	return nil
+}
+
+var replayFFAMatchesLater = delay.Func("replayFFAMatches", replayPendingFFAMatches)
+
+// replayPendingFFAMatches runs a replay scheduled by changeTournamentStats,
+// unless an earlier task already did. An error makes the task retry.
+func replayPendingFFAMatches(ctx context.Context, tournamentID int64) error {
+	var tournament Tournament
+	key := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+	if err := datastore.Get(ctx, key, &tournament); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !tournament.ReplayPending {
+		return nil
+	}
+	return replayFFAMatches(withReadCache(ctx), tournamentID)
+}
+
+// runIfStatsUnchanged runs f in a transaction if the stats version of a
+// tournament is still version, and returns errReplayConflict otherwise
+func runIfStatsUnchanged(ctx context.Context, tournamentID int64, version int64, f func(ctx context.Context) error) error {
+	return runInTransaction(ctx, func(ctx context.Context) error {
+		var tournament Tournament
+		key := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+		if err := datastore.Get(ctx, key, &tournament); err != nil {
+			return err
+		}
+		if tournament.StatsVersion != version {
+			return errReplayConflict
+		}
+		return f(ctx)
+	}, nil)
+}
+
+// replayFFAMatches recalculates the stats stored in every FFAMatch of a
+// tournament from the first played match on, and rewrites UserTournamentStats
+// of the tournament with the final values. Stats of players who no longer have
+// any match in the tournament are deleted. Head-to-head results are rebuilt.
+// It starts again if the tournament changes meanwhile, see
+// changeTournamentStats, and clears its pending replay.
+func replayFFAMatches(ctx context.Context, tournamentID int64) error {
+	for attempt := 0; attempt < replayAttempts; attempt++ {
+		if err := replayFFAMatchesOnce(ctx, tournamentID); err != errReplayConflict {
+			return err
+		}
+	}
+	return errReplayConflict
+}
+
+// replayFFAMatchesOnce replays the matches of a tournament, it returns
+// errReplayConflict without writing anything more if the tournament changed
+// since its matches were read
+func replayFFAMatchesOnce(ctx context.Context, tournamentID int64) error {
+	var tournament Tournament
+	tournamentKey := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+	if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+		return err
+	}
+	version := tournament.StatsVersion
+	ts, err := tournament.RatingSettings.trueSkillConfig()
+	if err != nil {
+		return err
+	}
+
+	// Existing stats rows, rows which are not rewritten below are deleted
+	oldStatsKeys, err := datastore.NewQuery("UserTournamentStats").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var matches []FFAMatch
+	matchKeys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		Order("SubmissionTime").
+		GetAll(ctx, &matches)
+	if err != nil {
+		return err
+	}
+	sortFFAMatchesByPlayedAt(matches, matchKeys)
+
+	// Run all matches from initial stats, in the order they were played
+	statsMap := make(map[int64]UserTournamentStats)
+	for i := range matches {
+		match := &matches[i]
+
+		preGameUserStatsList := make([]UserTournamentStats, len(match.Players))
+		for j, userID := range match.Players {
+			stats, exist := statsMap[userID]
+			if !exist {
+				stats = createInitialUserStats(tournamentID, userID)
+			}
+			preGameUserStatsList[j] = stats
+		}
+
+		// Matches recorded before PlayedAt was kept get it, so that they are
+		// found by played time
+		match.PlayedAt = match.playedAt()
+		postGameUserStatsList, outcomeProbability := adjustFFAStats(ts, tournament.RatingSettings.eloK(), preGameUserStatsList, match.Draws, match.PlayedAt)
+		setFFAMatchStats(match, preGameUserStatsList, postGameUserStatsList, outcomeProbability)
+
+		for j, userID := range match.Players {
+			statsMap[userID] = postGameUserStatsList[j]
+		}
+	}
+
+	// Stats are written with deterministic keys, which also removes duplicated
+	// rows and rows of users without matches
+	var statsKeys, deletedKeys []*datastore.Key
+	var statsList []UserTournamentStats
+	keptKeyNames := make(map[string]bool)
+	for userID, stats := range statsMap {
+		key := userTournamentStatsKey(ctx, tournamentID, userID)
+		statsKeys = append(statsKeys, key)
+		statsList = append(statsList, stats)
+		keptKeyNames[key.StringID()] = true
+	}
+	for _, key := range oldStatsKeys {
+		if !keptKeyNames[key.StringID()] {
+			deletedKeys = append(deletedKeys, key)
+		}
+	}
+
+	headToHead, err := buildHeadToHead(ctx, tournamentID, matches)
+	if err != nil {
+		return err
+	}
+
+	// Written values are invalidated if the tournament changes before the
+	// end, the next attempt rewrites them
+	defer invalidateTournamentResponses(ctx, tournamentID)
+	for start := 0; start < len(matches); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(matches))
+		if err := runIfStatsUnchanged(ctx, tournamentID, version, func(ctx context.Context) error {
+			_, err := datastore.PutMulti(ctx, matchKeys[start:end], matches[start:end])
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(statsList); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(statsList))
+		if err := runIfStatsUnchanged(ctx, tournamentID, version, func(ctx context.Context) error {
+			_, err := datastore.PutMulti(ctx, statsKeys[start:end], statsList[start:end])
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(deletedKeys); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(deletedKeys))
+		if err := runIfStatsUnchanged(ctx, tournamentID, version, func(ctx context.Context) error {
+			return datastore.DeleteMulti(ctx, deletedKeys[start:end])
+		}); err != nil {
+			return err
+		}
+	}
+
+	// The replay is complete once head-to-head results are written
+	return runIfStatsUnchanged(ctx, tournamentID, version, func(ctx context.Context) error {
+		if err := putHeadToHead(ctx, &headToHead); err != nil {
+			return err
+		}
+		var tournament Tournament
+		if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+			return err
+		}
+		tournament.ReplayPending = false
+		_, err := datastore.Put(ctx, tournamentKey, &tournament)
+		return err
+	})
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// StatsRepairReport describes the UserTournamentStats rows found, or fixed,
+// by repairUserTournamentStats
+type StatsRepairReport struct {
+	DryRun bool
+	// Rows moved to deterministic keys
+	Rekeyed int
+	// FFA matches whose PlayedAt was filled in
+	PlayedAtFilled int
+	// Number of (tournament, user) pairs with more than one row
+	Duplicates int
+	// Tournaments replayed to merge duplicated rows, or whose stats changed
+	// while rows were moved
+	ReplayedTournaments []string
+}
+
+// planStatsRepair finds rows of UserTournamentStats, given with their key
+// names, which are not stored under their deterministic key. It returns the
+// indexes of rows to move, and the number of duplicated users by tournament.
+// Duplicated rows are not moved since their tournament has to be replayed.
+func planStatsRepair(keyNames []string, statsList []UserTournamentStats) ([]int, map[int64]int) {
+	rowsByPair := make(map[string][]int)
+	for i, stats := range statsList {
+		name := userTournamentStatsKeyName(stats.TournamentID, stats.UserID)
+		rowsByPair[name] = append(rowsByPair[name], i)
+	}
+
+	var rekeyed []int
+	duplicates := make(map[int64]int)
+	for name, rows := range rowsByPair {
+		if len(rows) > 1 {
+			duplicates[statsList[rows[0]].TournamentID]++
+		} else if keyNames[rows[0]] != name {
+			rekeyed = append(rekeyed, rows[0])
+		}
+	}
+	sort.Ints(rekeyed)
+	return rekeyed, duplicates
+}
+
+// Rows moved by a transaction of repairUserTournamentStats, each row is
+// written and deleted in the transaction along with its tournament
+const statsRekeyBatchSize = datastoreBatchSize/2 - 1
+
+// repairUserTournamentStats moves stats rows created before keys were
+// deterministic to their key, and replays tournaments where a user has more
+// than one row, which merges the rows. It also fills in PlayedAt of FFA
+// matches recorded before it was kept.
+//
+// Rows are moved in transactions which check that the stats of their
+// tournament did not change since they were read, and change its stats
+// version so that a replay running meanwhile starts again. A tournament
+// which changed is replayed instead, which also moves its rows.
+func repairUserTournamentStats(ctx context.Context, dryRun bool) (StatsRepairReport, error) {
+	// Versions are read before the stats they guard
+	var tournaments []Tournament
+	tournamentKeys, err := datastore.NewQuery("Tournament").Ancestor(guestbookKey(ctx)).
+		GetAll(ctx, &tournaments)
+	if err != nil {
+		return StatsRepairReport{}, err
+	}
+	tournamentNames := make(map[int64]string)
+	versions := make(map[int64]int64)
+	for i, tournament := range tournaments {
+		tournamentNames[tournamentKeys[i].IntID()] = tournament.Name
+		versions[tournamentKeys[i].IntID()] = tournament.StatsVersion
+	}
+
+	var statsList []UserTournamentStats
+	keys, err := datastore.NewQuery("UserTournamentStats").Ancestor(guestbookKey(ctx)).
+		GetAll(ctx, &statsList)
+	if err != nil {
+		return StatsRepairReport{}, err
+	}
+
+	keyNames := make([]string, len(keys))
+	for i, key := range keys {
+		keyNames[i] = key.StringID()
+	}
+	rekeyed, duplicates := planStatsRepair(keyNames, statsList)
+
+	// Rows of deleted tournaments are left as they are
+	rekeyedByTournament := make(map[int64][]int)
+	var rekeyedTournamentIDs []int64
+	for _, row := range rekeyed {
+		tournamentID := statsList[row].TournamentID
+		if _, exist := versions[tournamentID]; !exist || duplicates[tournamentID] != 0 {
+			continue
+		}
+		if len(rekeyedByTournament[tournamentID]) == 0 {
+			rekeyedTournamentIDs = append(rekeyedTournamentIDs, tournamentID)
+		}
+		rekeyedByTournament[tournamentID] = append(rekeyedByTournament[tournamentID], row)
+	}
+	report := StatsRepairReport{DryRun: dryRun}
+	replayed := make(map[int64]bool)
+	for tournamentID, count := range duplicates {
+		if _, exist := versions[tournamentID]; exist {
+			replayed[tournamentID] = true
+			report.Duplicates += count
+		}
+	}
+
+	report.PlayedAtFilled, err = backfillFFAMatchPlayedAt(ctx, dryRun)
+	if err != nil {
+		return report, err
+	}
+
+	for _, tournamentID := range rekeyedTournamentIDs {
+		rows := rekeyedByTournament[tournamentID]
+		if dryRun {
+			report.Rekeyed += len(rows)
+			continue
+		}
+		moved, err := rekeyUserTournamentStats(ctx, tournamentID, versions[tournamentID], keys, statsList, rows)
+		report.Rekeyed += moved
+		if err == errReplayConflict {
+			replayed[tournamentID] = true
+		} else if err != nil {
+			return report, err
+		}
+	}
+
+	report.ReplayedTournaments = []string{}
+	for tournamentID := range replayed {
+		report.ReplayedTournaments = append(report.ReplayedTournaments, tournamentNames[tournamentID])
+	}
+	sort.Strings(report.ReplayedTournaments)
+	if dryRun {
+		return report, nil
+	}
+
+	for tournamentID := range replayed {
+		if err := replayFFAMatches(ctx, tournamentID); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// rekeyUserTournamentStats moves the given stats rows of a tournament to their
+// deterministic keys, if the stats version of the tournament is still
+// version. It returns the number of rows moved, and errReplayConflict if the
+// stats changed before all rows were moved.
+func rekeyUserTournamentStats(
+	ctx context.Context,
+	tournamentID int64,
+	version int64,
+	keys []*datastore.Key,
+	statsList []UserTournamentStats,
+	rows []int) (int, error) {
+
+	moved := 0
+	for start := 0; start < len(rows); start += statsRekeyBatchSize {
+		end := minInt(start+statsRekeyBatchSize, len(rows))
+		newKeys := make([]*datastore.Key, end-start)
+		oldKeys := make([]*datastore.Key, end-start)
+		movedStats := make([]UserTournamentStats, end-start)
+		for i, row := range rows[start:end] {
+			newKeys[i] = userTournamentStatsKey(ctx, tournamentID, statsList[row].UserID)
+			oldKeys[i] = keys[row]
+			movedStats[i] = statsList[row]
+		}
+
+		if err := runIfStatsUnchanged(ctx, tournamentID, version, func(ctx context.Context) error {
+			if err := changeTournamentStats(ctx, tournamentID, false); err != nil {
+				return err
+			}
+			if _, err := datastore.PutMulti(ctx, newKeys, movedStats); err != nil {
+				return err
+			}
+			return datastore.DeleteMulti(ctx, oldKeys)
+		}); err != nil {
+			return moved, err
+		}
+		// The version was changed by the transaction
+		version++
+		moved += end - start
+	}
+	return moved, nil
+}
+
+// backfillFFAMatchPlayedAt sets PlayedAt of FFA matches without it to their
+// submission time, which is when they count as played. Matches without the
+// property are not in its index, so all matches are read. It returns the
+// number of matches filled in, or to fill in if dryRun is true.
+func backfillFFAMatchPlayedAt(ctx context.Context, dryRun bool) (int, error) {
+	keys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	filled := 0
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := minInt(start+datastoreBatchSize, len(keys))
+		// Matches are read again in the transaction, so that a match deleted
+		// or replayed meanwhile is not overwritten
+		var batchFilled int
+		err := runInTransaction(ctx, func(ctx context.Context) error {
+			matches := make([]FFAMatch, end-start)
+			err := datastore.GetMulti(ctx, keys[start:end], matches)
+			multiErr, isMultiErr := err.(appengine.MultiError)
+			if err != nil && !isMultiErr {
+				return err
+			}
+
+			var filledKeys []*datastore.Key
+			var filledMatches []FFAMatch
+			for i, match := range matches {
+				if isMultiErr && multiErr[i] == datastore.ErrNoSuchEntity {
+					continue
+				} else if isMultiErr && multiErr[i] != nil {
+					return multiErr[i]
+				}
+				if match.PlayedAt.IsZero() {
+					match.PlayedAt = match.SubmissionTime
+					filledKeys = append(filledKeys, keys[start+i])
+					filledMatches = append(filledMatches, match)
+				}
+			}
+			batchFilled = len(filledKeys)
+			if dryRun || len(filledKeys) == 0 {
+				return nil
+			}
+			_, err = datastore.PutMulti(ctx, filledKeys, filledMatches)
+			return err
+		}, nil)
+		if err != nil {
+			return filled, err
+		}
+		filled += batchFilled
+	}
+	return filled, nil
+}
+
+// repairTournamentStats finds and merges duplicated UserTournamentStats, only
+// reporting them if dry_run is true
+func repairTournamentStats(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	report, err := repairUserTournamentStats(ctx, r.FormValue("dry_run") == "true")
+	writeAPIResponse(w, report, err)
+}
+
+// replayTournament replays all FFA matches of a tournament
+func replayTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	tournamentKey, err := findExistingTournamentKey(ctx, r.FormValue("tournament"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if err := authorize(ctx, RoleOrganizer, tournamentKey.IntID()); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = replayFFAMatches(ctx, tournamentKey.IntID())
+	writeAPIResponse(w, "OK", err)
+}
@@ -0,0 +1,28 @@
+package guestbook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanStatsRepair(t *testing.T) {
+	statsList := []UserTournamentStats{
+		{TournamentID: 1, UserID: 10}, // deterministic key
+		{TournamentID: 1, UserID: 11}, // old key
+		{TournamentID: 2, UserID: 10}, // duplicated
+		{TournamentID: 2, UserID: 10},
+		{TournamentID: 2, UserID: 12}, // duplicated, one with deterministic key
+		{TournamentID: 2, UserID: 12},
+	}
+	keyNames := []string{"1-10", "", "", "", "2-12", ""}
+
+	rekeyed, duplicates := planStatsRepair(keyNames, statsList)
+
+	if !reflect.DeepEqual(rekeyed, []int{1}) {
+		t.Errorf("Wanted to move row 1, got %v", rekeyed)
+	}
+	wantedDuplicates := map[int64]int{2: 2}
+	if !reflect.DeepEqual(duplicates, wantedDuplicates) {
+		t.Errorf("Wanted duplicates %v, got %v", wantedDuplicates, duplicates)
+	}
+}
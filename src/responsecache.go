@@ -0,0 +1,267 @@
+package guestbook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// Functions about caching JSON responses of leaderboards, recent matches,
+// head-to-head results and badges. Cached responses are keyed by a generation
+// number of their tournament, which writes increment to invalidate every
+// response of the tournament at once. Changes shown in every tournament, like
+// badges and player names, increment the generation of all tournaments.
+//
+// Responses carry an ETag, and conditional GETs of an unchanged response get
+// 304 Not Modified.
+
+// Environment variable selecting the response cache: "memcache", "memory" for
+// an in-process cache, or "off". Memcache is used on App Engine by default.
+const responseCacheEnv = "RESPONSE_CACHE"
+
+// How long a response is cached if nothing invalidates it
+const responseCacheTTL = 5 * time.Minute
+
+// Entries of the in-process cache above which expired entries are removed
+const memoryResponseCacheSize = 1000
+
+// Cache scope of responses about legacy 1v1 matches and player profiles, which
+// are not in a tournament with an ID
+const legacyCacheScope = 0
+
+// Generation key of responses shown in every tournament
+const allScopesGenerationKey = "generation:all"
+
+// responseCache stores cached responses and generation numbers
+type responseCache interface {
+	get(ctx context.Context, key string) ([]byte, bool)
+	set(ctx context.Context, key string, value []byte)
+	// increment adds delta to a generation number and returns it, numbers
+	// missing from the cache start above all numbers they ever had
+	increment(ctx context.Context, key string, delta int64) uint64
+}
+
+type memcacheResponseCache struct{}
+
+func (memcacheResponseCache) get(ctx context.Context, key string) ([]byte, bool) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Printf("Failed to read cached response: %s", err.Error())
+		}
+		return nil, false
+	}
+	return item.Value, true
+}
+
+func (memcacheResponseCache) set(ctx context.Context, key string, value []byte) {
+	item := &memcache.Item{Key: key, Value: value, Expiration: responseCacheTTL}
+	if err := memcache.Set(ctx, item); err != nil {
+		log.Printf("Failed to cache response: %s", err.Error())
+	}
+}
+
+func (memcacheResponseCache) increment(ctx context.Context, key string, delta int64) uint64 {
+	// An evicted generation restarts from the current time, so that it does
+	// not come back to a number of older responses
+	generation, err := memcache.Increment(ctx, key, delta, uint64(time.Now().UnixNano()))
+	if err != nil {
+		log.Printf("Failed to increment cache generation: %s", err.Error())
+		return uint64(time.Now().UnixNano())
+	}
+	return generation
+}
+
+type memoryResponseCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryResponseCache is an in-process cache, other instances of the app do
+// not see its invalidations before the TTL
+type memoryResponseCache struct {
+	mutex       sync.Mutex
+	entries     map[string]memoryResponseCacheEntry
+	generations map[string]uint64
+}
+
+func newMemoryResponseCache() *memoryResponseCache {
+	return &memoryResponseCache{
+		entries:     make(map[string]memoryResponseCacheEntry),
+		generations: make(map[string]uint64),
+	}
+}
+
+func (c *memoryResponseCache) get(ctx context.Context, key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exist := c.entries[key]
+	if !exist || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *memoryResponseCache) set(ctx context.Context, key string, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= memoryResponseCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= memoryResponseCacheSize {
+		c.entries = make(map[string]memoryResponseCacheEntry)
+	}
+	c.entries[key] = memoryResponseCacheEntry{value: value, expires: now.Add(responseCacheTTL)}
+}
+
+func (c *memoryResponseCache) increment(ctx context.Context, key string, delta int64) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generations[key] += uint64(delta)
+	return c.generations[key]
+}
+
+var (
+	responseCacheOnce     sync.Once
+	responseCacheInstance responseCache
+)
+
+// currentResponseCache returns the response cache selected by
+// responseCacheEnv, nil if caching is off
+func currentResponseCache() responseCache {
+	responseCacheOnce.Do(func() {
+		switch os.Getenv(responseCacheEnv) {
+		case "off":
+		case "memory":
+			responseCacheInstance = newMemoryResponseCache()
+		case "memcache":
+			responseCacheInstance = memcacheResponseCache{}
+		default:
+			if appengine.IsAppEngine() {
+				responseCacheInstance = memcacheResponseCache{}
+			} else {
+				responseCacheInstance = newMemoryResponseCache()
+			}
+		}
+	})
+	return responseCacheInstance
+}
+
+func scopeGenerationKey(scope int64) string {
+	return "generation:" + strconv.FormatInt(scope, 10)
+}
+
+// invalidateTournamentResponses invalidates cached responses of a tournament,
+// or of legacy matches if tournamentID is legacyCacheScope
+func invalidateTournamentResponses(ctx context.Context, tournamentID int64) {
+	if cache := currentResponseCache(); cache != nil {
+		cache.increment(ctx, scopeGenerationKey(tournamentID), 1)
+	}
+}
+
+// invalidateAllResponses invalidates every cached response
+func invalidateAllResponses(ctx context.Context) {
+	if cache := currentResponseCache(); cache != nil {
+		cache.increment(ctx, allScopesGenerationKey, 1)
+	}
+}
+
+// responseCacheKey is the cache key of a request in a scope. Keys are hashed
+// to fit memcache.
+func responseCacheKey(scopeGeneration uint64, allGeneration uint64, r *http.Request, login string) string {
+	raw := fmt.Sprintf("%d\n%d\n%s\n%s\n%s", scopeGeneration, allGeneration, r.URL.Path, r.Form.Encode(), login)
+	hash := sha256.Sum256([]byte(raw))
+	return "response:" + hex.EncodeToString(hash[:])
+}
+
+// responseETag is the ETag of a response body
+func responseETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// writeCachedResponse writes the JSON of read, which is cached until the scope
+// is invalidated. Responses depending on the current login set perLogin.
+func writeCachedResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	ctx context.Context,
+	scope int64,
+	perLogin bool,
+	read func() (interface{}, error)) {
+
+	var body []byte
+	cache := currentResponseCache()
+	key := ""
+	if cache != nil {
+		r.ParseForm()
+		login := ""
+		if perLogin {
+			login = currentLogin(ctx)
+		}
+		key = responseCacheKey(
+			cache.increment(ctx, scopeGenerationKey(scope), 0),
+			cache.increment(ctx, allScopesGenerationKey, 0),
+			r, login)
+		body, _ = cache.get(ctx, key)
+	}
+
+	if body == nil {
+		v, err := read()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		body, err = json.Marshal(v)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if cache != nil {
+			cache.set(ctx, key, body)
+		}
+	}
+
+	etag := responseETag(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// tournamentCacheScope returns the cache scope of a tournament, which is its
+// ID. The default tournament is used if tournamentName is empty.
+func tournamentCacheScope(ctx context.Context, tournamentName string) (int64, error) {
+	if tournamentName == "" {
+		tournamentName = "Default"
+	}
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return 0, err
+	}
+	return tournamentKey.IntID(), nil
+}
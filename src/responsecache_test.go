@@ -0,0 +1,54 @@
+package guestbook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteCachedResponse(t *testing.T) {
+	ctx := context.Background()
+	const scope = 42
+	reads := 0
+	read := func() (interface{}, error) {
+		reads++
+		return []string{"alice", "bob"}, nil
+	}
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/request_tournament_stats?tournament=Catan", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		writeCachedResponse(w, r, ctx, scope, false, read)
+		return w
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || first.Body.String() != `["alice","bob"]` || etag == "" {
+		t.Errorf("Wanted the response with an ETag, got %d %s %q", first.Code, first.Body.String(), etag)
+	}
+
+	if second := get(""); second.Body.String() != first.Body.String() || reads != 1 {
+		t.Errorf("Wanted a cached response, got %s after %d reads", second.Body.String(), reads)
+	}
+
+	if notModified := get(etag); notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 {
+		t.Errorf("Wanted 304 for a matching ETag, got %d", notModified.Code)
+	}
+
+	invalidateTournamentResponses(ctx, scope)
+	get("")
+	if reads != 2 {
+		t.Errorf("Wanted a new read after invalidation, got %d reads", reads)
+	}
+
+	invalidateAllResponses(ctx)
+	get("")
+	if reads != 3 {
+		t.Errorf("Wanted a new read after invalidating all responses, got %d reads", reads)
+	}
+}
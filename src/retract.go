@@ -0,0 +1,229 @@
+package guestbook
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about submitters retracting their own FFA matches shortly after
+// submitting them, without asking an organizer to delete them.
+
+// Environment variable of how long a submitter can retract a match, in the
+// format of time.ParseDuration, e.g. "10m"
+const undoWindowEnv = "UNDO_WINDOW"
+
+// Undo window when undoWindowEnv is not set
+const defaultUndoWindow = 10 * time.Minute
+
+// undoWindow returns how long after submitting a match its submitter can
+// retract it
+func undoWindow() time.Duration {
+	value := os.Getenv(undoWindowEnv)
+	if value == "" {
+		return defaultUndoWindow
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s: %s", undoWindowEnv, value, defaultUndoWindow, err.Error())
+		return defaultUndoWindow
+	}
+	return window
+}
+
+// canRetractFFAMatch reports whether submitter can retract match at now
+func canRetractFFAMatch(match FFAMatch, submitter string, now time.Time, window time.Duration) bool {
+	return submitter != "" && match.Submitter == submitter && now.Sub(match.SubmissionTime) <= window
+}
+
+// sharesPlayer reports whether two FFA matches have a player in common
+func sharesPlayer(m1 FFAMatch, m2 FFAMatch) bool {
+	for _, p1 := range m1.Players {
+		for _, p2 := range m2.Players {
+			if p1 == p2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revertFFAStats returns the stats of the players of match before the match,
+// given their stats right after it. LastPlayed is cleared.
+func revertFFAStats(postGameUserStatsList []UserTournamentStats, match FFAMatch) []UserTournamentStats {
+	preGameUserStatsList := make([]UserTournamentStats, len(postGameUserStatsList))
+	copy(preGameUserStatsList, postGameUserStatsList)
+
+	for i := range preGameUserStatsList {
+		preGameUserStatsList[i].TrueSkillMu = match.PreGameTrueSkillMu[i]
+		preGameUserStatsList[i].TrueSkillSigma = match.PreGameTrueSkillSigma[i]
+		preGameUserStatsList[i].TrueSkillRating = match.PreGameTrueSkillRating[i]
+		if len(match.PreGameEloRating) == len(match.Players) {
+			preGameUserStatsList[i].Rating = match.PreGameEloRating[i]
+		}
+	}
+
+	// The time of the previous match of each player is not in match, callers
+	// set LastPlayed
+	tallyFFAMatch(preGameUserStatsList, match.Draws, time.Time{}, -1)
+	for i := range preGameUserStatsList {
+		preGameUserStatsList[i].LastPlayed = time.Time{}
+	}
+
+	return preGameUserStatsList
+}
+
+// retractFFAMatch deletes a FFA match submitted by the current login within
+// the undo window, and records the retraction. Stats of the players are
+// reverted directly if none of them played a later match in the tournament,
+// otherwise a replay of the tournament is scheduled in the same transaction.
+func retractFFAMatch(ctx context.Context, key *datastore.Key) (FFAMatchRetraction, error) {
+	if key.Kind() != "FFAMatch" {
+		return FFAMatchRetraction{}, invalidArgumentError("%s is not a FFA match", key.Kind())
+	}
+
+	submitter := currentSubmitter(ctx)
+	now := time.Now()
+	window := undoWindow()
+
+	var retraction FFAMatchRetraction
+	err := runInTransaction(ctx, func(ctx context.Context) error {
+		var match FFAMatch
+		if err := datastore.Get(ctx, key, &match); err == datastore.ErrNoSuchEntity {
+			return notFoundError("match does not exist")
+		} else if err != nil {
+			return err
+		}
+
+		if match.Submitter != submitter {
+			return APIError{
+				Status:  http.StatusForbidden,
+				Code:    ErrorCodePermissionDenied,
+				Message: "Only the submitter of a match can retract it",
+			}
+		}
+		if !canRetractFFAMatch(match, submitter, now, window) {
+			return failedPreconditionError(
+				"Matches can only be retracted within %s of submitting them, ask an organizer to delete it", window)
+		}
+
+		needsReplay, err := hasLaterFFAMatchOfPlayers(ctx, match)
+		if err != nil {
+			return err
+		}
+
+		if !needsReplay {
+			if err := revertFFAMatchStats(ctx, key, match); err != nil {
+				return err
+			}
+
+			headToHead, _, err := readHeadToHead(ctx, match.TournamentID)
+			if err != nil {
+				return err
+			}
+			headToHead.removeMatch(match)
+			if err := putHeadToHead(ctx, &headToHead); err != nil {
+				return err
+			}
+		}
+
+		if err := datastore.Delete(ctx, key); err != nil {
+			return err
+		}
+		// Replays write every stats row of the tournament, which may not fit
+		// in the transaction, so they run as a task
+		if err := changeTournamentStats(ctx, match.TournamentID, needsReplay); err != nil {
+			return err
+		}
+
+		retraction = FFAMatchRetraction{
+			TournamentID:   match.TournamentID,
+			Players:        match.Players,
+			Note:           match.Note,
+			Submitter:      match.Submitter,
+			SubmissionTime: match.SubmissionTime,
+			RetractionTime: now,
+		}
+		retractionKey := datastore.NewIncompleteKey(ctx, "FFAMatchRetraction", guestbookKey(ctx))
+		_, err = datastore.Put(ctx, retractionKey, &retraction)
+		return err
+	}, nil)
+
+	if err != nil {
+		return FFAMatchRetraction{}, err
+	}
+	invalidateTournamentResponses(ctx, retraction.TournamentID)
+	return retraction, nil
+}
+
+// revertFFAMatchStats restores the stats of the players of the latest match of
+// each of them. Stats of players for whom it was the first match in the
+// tournament are deleted, as a replay would.
+func revertFFAMatchStats(ctx context.Context, key *datastore.Key, match FFAMatch) error {
+	statsKeys := make([]*datastore.Key, len(match.Players))
+	postGameUserStatsList := make([]UserTournamentStats, len(match.Players))
+	for i, userID := range match.Players {
+		exist, key, stats, err := readStatsWithID(ctx, match.TournamentID, userID)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return notFoundError("stats of player %d do not exist", userID)
+		}
+		statsKeys[i] = key
+		postGameUserStatsList[i] = stats
+	}
+
+	preGameUserStatsList := revertFFAStats(postGameUserStatsList, match)
+	for i, userID := range match.Players {
+		// Other matches of the player were all played before the match
+		var playerMatches []FFAMatch
+		playerMatchKeys, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+			Filter("TournamentID =", match.TournamentID).
+			Filter("Players =", userID).
+			GetAll(ctx, &playerMatches)
+		if err != nil {
+			return err
+		}
+		hasEarlierMatch := false
+		lastPlayed := time.Time{}
+		for j, playerMatch := range playerMatches {
+			if playerMatchKeys[j].Equal(key) {
+				continue
+			}
+			hasEarlierMatch = true
+			if playerMatch.playedAt().After(lastPlayed) {
+				lastPlayed = playerMatch.playedAt()
+			}
+		}
+
+		if !hasEarlierMatch {
+			err = datastore.Delete(ctx, statsKeys[i])
+		} else {
+			preGameUserStatsList[i].LastPlayed = lastPlayed
+			_, err = datastore.Put(ctx, statsKeys[i], &preGameUserStatsList[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retractMatch retracts a FFA match of the current login, see retractFFAMatch
+func retractMatch(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	key, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeAPIError(w, invalidArgumentError(err.Error()))
+		return
+	}
+
+	retraction, err := retractFFAMatch(ctx, key)
+	writeAPIResponse(w, retraction, err)
+}
@@ -0,0 +1,47 @@
+package guestbook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevertFFAStats(t *testing.T) {
+	ts, err := createTrueSkillConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preGameUserStatsList := []UserTournamentStats{
+		createInitialUserStats(1, 10),
+		createInitialUserStats(1, 11),
+		createInitialUserStats(1, 12),
+	}
+	preGameUserStatsList[2].FFAWins = 3
+	draws := []bool{true, false}
+
+	postGameUserStatsList, outcomeProbability := adjustFFAStats(ts, DefaultEloK, preGameUserStatsList, draws, time.Now())
+	match := FFAMatch{Players: []int64{10, 11, 12}, Draws: draws}
+	setFFAMatchStats(&match, preGameUserStatsList, postGameUserStatsList, outcomeProbability)
+
+	reverted := revertFFAStats(postGameUserStatsList, match)
+	for i := range preGameUserStatsList {
+		if reverted[i] != preGameUserStatsList[i] {
+			t.Errorf("Wanted %+v, got %+v", preGameUserStatsList[i], reverted[i])
+		}
+	}
+}
+
+func TestCanRetractFFAMatch(t *testing.T) {
+	submissionTime := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	match := FFAMatch{Submitter: "alice", SubmissionTime: submissionTime}
+
+	if !canRetractFFAMatch(match, "alice", submissionTime.Add(9*time.Minute), 10*time.Minute) {
+		t.Errorf("Wanted submitter to retract within the window")
+	}
+	if canRetractFFAMatch(match, "alice", submissionTime.Add(11*time.Minute), 10*time.Minute) {
+		t.Errorf("Wanted submitter not to retract after the window")
+	}
+	if canRetractFFAMatch(match, "bob", submissionTime.Add(time.Minute), 10*time.Minute) {
+		t.Errorf("Wanted other logins not to retract")
+	}
+}
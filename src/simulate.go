@@ -0,0 +1,268 @@
+package guestbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	trueskill "github.com/mafredri/go-trueskill"
+)
+
+// Functions about previewing hypothetical results. Games are run through the
+// same rating updates as submitted matches, starting from the current stats,
+// and nothing is stored.
+
+// Largest number of games in one simulation
+const maxSimulatedGames = 20
+
+// HypotheticalGame is a game result to simulate
+type HypotheticalGame struct {
+	// Player names from first place to last place
+	Players []string
+	// Draws[i] is true if Players[i] and Players[i+1] are in a draw
+	Draws []bool
+}
+
+// SimulationRequest is a sequence of hypothetical games, played in order
+type SimulationRequest struct {
+	// TrueSkill ratings of this tournament are used, or Elo ratings of 1v1
+	// matches if it is empty
+	Tournament string
+	Games      []HypotheticalGame
+}
+
+// validateHypotheticalGames checks the number of games and of draws, and that
+// Elo games have a winner and a loser
+func validateHypotheticalGames(games []HypotheticalGame, isElo bool) error {
+	if len(games) == 0 || len(games) > maxSimulatedGames {
+		return invalidArgumentError("Request contains %d games, it should be 1 to %d.", len(games), maxSimulatedGames)
+	}
+	for i, game := range games {
+		if len(game.Players) < 2 || len(game.Players)-1 != len(game.Draws) {
+			return invalidArgumentError(
+				"Game %d contains %d Players and %d Draws, it should be N and N-1 instead.",
+				i+1, len(game.Players), len(game.Draws))
+		}
+		if isElo && (len(game.Players) != 2 || game.Draws[0]) {
+			return invalidArgumentError("Game %d should have a winner and a loser.", i+1)
+		}
+		if isElo && game.Players[0] == game.Players[1] {
+			return invalidArgumentError("Winner should not be the same as loser.")
+		}
+	}
+	return nil
+}
+
+// sortStatsByRating orders stats by TrueSkill rating, as leaderboards are
+func sortStatsByRating(statsList []UserTournamentStats) {
+	sort.SliceStable(statsList, func(i, j int) bool {
+		return statsList[i].TrueSkillRating > statsList[j].TrueSkillRating
+	})
+}
+
+// simulateFFAGames runs the TrueSkill and Elo updates of each game in order,
+// starting from the leaderboard of a tournament. userIDs maps the player names
+// of the games to their IDs. Players not on the leaderboard start with initial
+// stats.
+func simulateFFAGames(
+	ts trueskill.Config,
+	eloK float64,
+	tournamentID int64,
+	leaderboard []UserTournamentStats,
+	userIDs map[string]int64,
+	games []HypotheticalGame) []SimulatedGame {
+
+	statsList := make([]UserTournamentStats, len(leaderboard))
+	copy(statsList, leaderboard)
+	indexes := make(map[int64]int)
+	for i, stats := range statsList {
+		indexes[stats.UserID] = i
+	}
+
+	simulatedGames := make([]SimulatedGame, len(games))
+	for g, game := range games {
+		preGameUserStatsList := make([]UserTournamentStats, len(game.Players))
+		for i, name := range game.Players {
+			userID := userIDs[name]
+			if _, exist := indexes[userID]; !exist {
+				indexes[userID] = len(statsList)
+				statsList = append(statsList, createInitialUserStats(tournamentID, userID))
+			}
+			preGameUserStatsList[i] = statsList[indexes[userID]]
+		}
+
+		sortedStats := make([]UserTournamentStats, len(statsList))
+		copy(sortedStats, statsList)
+		sortStatsByRating(sortedStats)
+		previousRanks := leaderboardRanks(sortedStats)
+
+		postGameUserStatsList, outcomeProbability := adjustFFAStats(ts, eloK, preGameUserStatsList, game.Draws, time.Now())
+		for _, stats := range postGameUserStatsList {
+			statsList[indexes[stats.UserID]] = stats
+		}
+
+		copy(sortedStats, statsList)
+		sortStatsByRating(sortedStats)
+		ranks := leaderboardRanks(sortedStats)
+
+		simulatedGames[g] = SimulatedGame{
+			OutcomeProbability: outcomeProbability,
+			Players:            make([]SimulatedPlayer, len(game.Players)),
+		}
+		for i, name := range game.Players {
+			userID := postGameUserStatsList[i].UserID
+			simulatedGames[g].Players[i] = SimulatedPlayer{
+				Name:                   name,
+				PreGameRating:          preGameUserStatsList[i].TrueSkillRating,
+				PostGameRating:         postGameUserStatsList[i].TrueSkillRating,
+				PostGameTrueSkillMu:    postGameUserStatsList[i].TrueSkillMu,
+				PostGameTrueSkillSigma: postGameUserStatsList[i].TrueSkillSigma,
+				PreGameEloRating:       preGameUserStatsList[i].Rating,
+				PostGameEloRating:      postGameUserStatsList[i].Rating,
+				PreviousRank:           previousRanks[userID],
+				Rank:                   ranks[userID],
+			}
+		}
+	}
+	return simulatedGames
+}
+
+// eloRanks returns the 1-based rank of every player of an Elo leaderboard,
+// which is ordered by rating
+func eloRanks(profiles []UserProfile) map[string]int {
+	sorted := make([]UserProfile, len(profiles))
+	copy(sorted, profiles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Rating > sorted[j].Rating
+	})
+
+	ranks := make(map[string]int)
+	for i, profile := range sorted {
+		ranks[profile.Name] = i + 1
+	}
+	return ranks
+}
+
+// simulateEloGames runs the Elo update of createMatch for each game in order,
+// starting from the ratings of profiles. Every player of the games must have
+// a profile.
+func simulateEloGames(profiles []UserProfile, games []HypotheticalGame) []SimulatedGame {
+	ratings := make([]UserProfile, len(profiles))
+	copy(ratings, profiles)
+	indexes := make(map[string]int)
+	for i, profile := range ratings {
+		indexes[profile.Name] = i
+	}
+
+	simulatedGames := make([]SimulatedGame, len(games))
+	for g, game := range games {
+		winner, loser := &ratings[indexes[game.Players[0]]], &ratings[indexes[game.Players[1]]]
+		previousRanks := eloRanks(ratings)
+		winnerOldRating, loserOldRating := winner.Rating, loser.Rating
+		outcomeProbability := expectedScore(winnerOldRating, loserOldRating)
+
+		winner.Rating, loser.Rating = newRatings(winnerOldRating, loserOldRating)
+		winner.Wins++
+		loser.Losses++
+		ranks := eloRanks(ratings)
+
+		simulatedGames[g] = SimulatedGame{
+			OutcomeProbability: outcomeProbability,
+			Players: []SimulatedPlayer{
+				{
+					Name:           winner.Name,
+					PreGameRating:  winnerOldRating,
+					PostGameRating: winner.Rating,
+					PreviousRank:   previousRanks[winner.Name],
+					Rank:           ranks[winner.Name],
+				},
+				{
+					Name:           loser.Name,
+					PreGameRating:  loserOldRating,
+					PostGameRating: loser.Rating,
+					PreviousRank:   previousRanks[loser.Name],
+					Rank:           ranks[loser.Name],
+				},
+			},
+		}
+	}
+	return simulatedGames
+}
+
+// simulateGames previews a sequence of hypothetical games, see
+// SimulationRequest
+func simulateGames(ctx context.Context, request SimulationRequest) ([]SimulatedGame, error) {
+	isElo := request.Tournament == ""
+	if err := validateHypotheticalGames(request.Games, isElo); err != nil {
+		return nil, err
+	}
+
+	if isElo {
+		profiles, err := readPlayers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool)
+		for _, profile := range profiles {
+			names[profile.Name] = true
+		}
+		for _, game := range request.Games {
+			for _, name := range game.Players {
+				if !names[name] {
+					return nil, notFoundError("username %s does not exist", name)
+				}
+			}
+		}
+		return simulateEloGames(profiles, request.Games), nil
+	}
+
+	tournamentKey, err := findExistingTournamentKey(ctx, request.Tournament)
+	if err != nil {
+		return nil, err
+	}
+	tournamentID := tournamentKey.IntID()
+
+	userIDs := make(map[string]int64)
+	for _, game := range request.Games {
+		keys, err := findUserKeys(ctx, game.Players)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			userIDs[game.Players[i]] = key.IntID()
+		}
+	}
+
+	leaderboard, err := readAllUserStatsForTournament(ctx, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := readRatingSettings(ctx, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := settings.trueSkillConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create TrueSkill config: %s", err.Error())
+	}
+	return simulateFFAGames(ts, settings.eloK(), tournamentID, leaderboard, userIDs, request.Games), nil
+}
+
+// simulateMatches previews hypothetical games without recording them, see
+// simulateGames
+func simulateMatches(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	var request SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, invalidArgumentError(err.Error()))
+		return
+	}
+
+	simulatedGames, err := simulateGames(ctx, request)
+	writeAPIResponse(w, simulatedGames, err)
+}
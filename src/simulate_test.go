@@ -0,0 +1,116 @@
+package guestbook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulateFFAGames(t *testing.T) {
+	ts, err := createTrueSkillConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaderboard := []UserTournamentStats{
+		createInitialUserStats(1, 10),
+		createInitialUserStats(1, 11),
+	}
+	leaderboard[0].TrueSkillMu = 30
+	leaderboard[0].TrueSkillRating = calculateTrueSkillRating(30, leaderboard[0].TrueSkillSigma)
+	userIDs := map[string]int64{"alice": 10, "bob": 11, "carol": 12}
+	games := []HypotheticalGame{
+		{Players: []string{"bob", "alice"}, Draws: []bool{false}},
+		{Players: []string{"carol", "bob"}, Draws: []bool{false}},
+	}
+
+	simulatedGames := simulateFFAGames(ts, DefaultEloK, 1, leaderboard, userIDs, games)
+	if len(simulatedGames) != 2 {
+		t.Fatalf("Wanted 2 games, got %d", len(simulatedGames))
+	}
+
+	// The first game is the same update as a submitted match
+	postGameUserStatsList, outcomeProbability := adjustFFAStats(
+		ts, DefaultEloK, []UserTournamentStats{leaderboard[1], leaderboard[0]}, games[0].Draws, time.Now())
+	first := simulatedGames[0]
+	if first.OutcomeProbability != outcomeProbability {
+		t.Errorf("Wanted outcome probability %f, got %f", outcomeProbability, first.OutcomeProbability)
+	}
+	for i, player := range first.Players {
+		stats := postGameUserStatsList[i]
+		if player.PostGameRating != stats.TrueSkillRating ||
+			player.PostGameTrueSkillMu != stats.TrueSkillMu ||
+			player.PostGameTrueSkillSigma != stats.TrueSkillSigma {
+			t.Errorf("Wanted %+v, got %+v", stats, player)
+		}
+	}
+	wantRank := 2
+	if postGameUserStatsList[0].TrueSkillRating > postGameUserStatsList[1].TrueSkillRating {
+		wantRank = 1
+	}
+	if first.Players[0].PreviousRank != 2 || first.Players[0].Rank != wantRank {
+		t.Errorf("Wanted bob to move from 2 to %d, got %+v", wantRank, first.Players[0])
+	}
+
+	// The second game starts from the stats after the first one
+	second := simulatedGames[1]
+	if second.Players[1].PreGameRating != first.Players[0].PostGameRating {
+		t.Errorf("Wanted bob to start at %f, got %f", first.Players[0].PostGameRating, second.Players[1].PreGameRating)
+	}
+	if second.Players[0].PreviousRank != 3 {
+		t.Errorf("Wanted a new player to start last, got rank %d", second.Players[0].PreviousRank)
+	}
+}
+
+func TestSimulateEloGames(t *testing.T) {
+	profiles := []UserProfile{
+		{Name: "alice", Rating: 1600},
+		{Name: "bob", Rating: 1500},
+		{Name: "carol", Rating: 1490},
+	}
+	games := []HypotheticalGame{
+		{Players: []string{"carol", "alice"}, Draws: []bool{false}},
+		{Players: []string{"carol", "bob"}, Draws: []bool{false}},
+	}
+
+	simulatedGames := simulateEloGames(profiles, games)
+	match := createMatch(1490, 1600, "carol", "alice", "Default", "", "", profiles[0].JoinDate)
+	first := simulatedGames[0]
+	if first.Players[0].PostGameRating != match.WinnerRatingAfter || first.Players[1].PostGameRating != match.LoserRatingAfter {
+		t.Errorf("Wanted %f and %f, got %+v", match.WinnerRatingAfter, match.LoserRatingAfter, first.Players)
+	}
+	if first.Players[0].PreviousRank != 3 || first.Players[0].Rank != 2 {
+		t.Errorf("Wanted carol to move from 3 to 2, got %+v", first.Players[0])
+	}
+
+	second := simulatedGames[1]
+	if second.Players[0].PreGameRating != match.WinnerRatingAfter {
+		t.Errorf("Wanted carol to start at %f, got %f", match.WinnerRatingAfter, second.Players[0].PreGameRating)
+	}
+	if second.Players[0].PreviousRank != 2 || second.Players[1].PreviousRank != 3 {
+		t.Errorf("Wanted ranks after the first game, got %+v", second.Players)
+	}
+	if profiles[2].Rating != 1490 {
+		t.Errorf("Wanted profiles to be unchanged, got %+v", profiles[2])
+	}
+}
+
+func TestValidateHypotheticalGames(t *testing.T) {
+	tests := []struct {
+		games   []HypotheticalGame
+		isElo   bool
+		wantErr bool
+	}{
+		{[]HypotheticalGame{{Players: []string{"a", "b", "c"}, Draws: []bool{true, false}}}, false, false},
+		{[]HypotheticalGame{{Players: []string{"a", "b", "c"}, Draws: []bool{false}}}, false, true},
+		{[]HypotheticalGame{{Players: []string{"a", "b", "c"}, Draws: []bool{false, false}}}, true, true},
+		{[]HypotheticalGame{{Players: []string{"a", "b"}, Draws: []bool{true}}}, true, true},
+		{[]HypotheticalGame{{Players: []string{"a", "a"}, Draws: []bool{false}}}, true, true},
+		{nil, false, true},
+	}
+	for _, test := range tests {
+		err := validateHypotheticalGames(test.games, test.isElo)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Wanted error %v for %+v, got %v", test.wantErr, test.games, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package guestbook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Functions about the chat slash command (/elo) endpoint. The endpoint accepts
+// Slack and Mattermost style payloads:
+//
+//   /elo record Catan alice > bob = carol
+//   /elo top Catan [N]
+//   /elo odds alice bob [Tournament]
+
+const (
+	// Slack signs requests with this secret, see
+	// https://api.slack.com/authentication/verifying-requests-from-slack
+	slashCommandSigningSecretEnv = "SLASH_COMMAND_SIGNING_SECRET"
+	// Mattermost sends this token in the "token" field of every request
+	slashCommandTokenEnv = "SLASH_COMMAND_TOKEN"
+
+	// Requests with a timestamp older than this are rejected to avoid replays
+	slashCommandMaxAge = 5 * time.Minute
+
+	// Number of players shown by "top" if not specified
+	slashCommandDefaultTop = 10
+)
+
+// SlashCommandResponse is the reply understood by both Slack and Mattermost
+type SlashCommandResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+const slashCommandUsage = "Usage:\n" +
+	"`/elo record <tournament> alice > bob = carol` records a FFA match result\n" +
+	"`/elo top <tournament> [N]` shows the top N players of a tournament\n" +
+	"`/elo odds alice bob [tournament]` shows the chance of alice beating bob"
+
+func submitSlashCommand(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := verifySlashCommandRequest(r.Header, body, form, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	text, inChannel := runSlashCommand(ctx, form.Get("text"), form.Get("user_name"))
+
+	response := SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text:         text,
+	}
+	if inChannel {
+		response.ResponseType = "in_channel"
+	}
+
+	js, errJs := json.Marshal(response)
+	if errJs != nil {
+		http.Error(w, errJs.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// verifySlashCommandRequest accepts a request signed by Slack, or a request
+// carrying the Mattermost token. The endpoint rejects everything until one of
+// the secrets is configured.
+func verifySlashCommandRequest(header http.Header, body []byte, form url.Values, now time.Time) error {
+	signature := header.Get("X-Slack-Signature")
+	if secret := os.Getenv(slashCommandSigningSecretEnv); secret != "" && signature != "" {
+		return verifySlackSignature(
+			secret, header.Get("X-Slack-Request-Timestamp"), body, signature, now)
+	}
+
+	if token := os.Getenv(slashCommandTokenEnv); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(form.Get("token"))) == 1 {
+			return nil
+		}
+		return errors.New("invalid slash command token")
+	}
+
+	return errors.New("slash command request is not signed")
+}
+
+// verifySlackSignature checks the v0 signature Slack puts on each request:
+// "v0=" + hex(HMAC-SHA256(secret, "v0:" + timestamp + ":" + body))
+func verifySlackSignature(secret string, timestamp string, body []byte, signature string, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp %q", timestamp)
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > slashCommandMaxAge || age < -slashCommandMaxAge {
+		return errors.New("request timestamp is too far from current time")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// runSlashCommand executes the text following /elo and returns the reply, and
+// whether the reply should be visible to the whole channel.
+func runSlashCommand(ctx context.Context, text string, userName string) (string, bool) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		return slashCommandUsage, false
+	}
+
+	var reply string
+	var err error
+	switch args[0] {
+	case "record":
+		if len(args) < 3 {
+			return slashCommandUsage, false
+		}
+		reply, err = slashCommandRecord(ctx, args[1], strings.Join(args[2:], " "), userName)
+	case "top":
+		if len(args) < 2 || len(args) > 3 {
+			return slashCommandUsage, false
+		}
+		num := slashCommandDefaultTop
+		if len(args) == 3 {
+			num, err = strconv.Atoi(args[2])
+			if err != nil || num <= 0 {
+				return "N must be a positive integer", false
+			}
+		}
+		reply, err = slashCommandTop(ctx, args[1], num)
+	case "odds":
+		if len(args) < 3 || len(args) > 4 {
+			return slashCommandUsage, false
+		}
+		tournamentName := ""
+		if len(args) == 4 {
+			tournamentName = args[3]
+		}
+		reply, err = slashCommandOdds(ctx, args[1], args[2], tournamentName)
+	default:
+		return slashCommandUsage, false
+	}
+
+	if err != nil {
+		return "Error: " + err.Error(), false
+	}
+	return reply, true
+}
+
+// slashCommandRecord records a match as the slash command service, see
+// slashCommandServiceContext
+func slashCommandRecord(ctx context.Context, tournamentName string, note string, userName string) (string, error) {
+	players, draws, err := parseFFAMatchNote(note)
+	if err != nil {
+		return "", err
+	}
+
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return "", err
+	}
+
+	ctx = slashCommandServiceContext(ctx, userName)
+	if err := authorize(ctx, RolePlayer, tournamentKey.IntID()); err != nil {
+		return "", err
+	}
+	if err := checkParticipant(ctx, tournamentKey.IntID(), players); err != nil {
+		return "", err
+	}
+
+	matchResult := FfaMatchResult{
+		Tournament: tournamentName,
+		Players:    players,
+		Draws:      draws,
+	}
+
+	match, _, _, err := recordFFAMatch(ctx, tournamentKey.IntID(), matchResult, currentSubmitter(ctx))
+	if err != nil {
+		return "", err
+	}
+	warning, err := duplicateFFAMatchWarning(ctx, match)
+	if err != nil {
+		return "", err
+	}
+
+	reply := fmt.Sprintf("Recorded in %s: %s", tournamentName, match.Note)
+	for i, name := range match.PlayerNames {
+		reply += fmt.Sprintf("\n%s: %.2f ➨ %.2f",
+			name, match.PreGameTrueSkillRating[i], match.PostGameTrueSkillRating[i])
+	}
+	if warning != "" {
+		reply += "\n" + warning
+	}
+	return reply, nil
+}
+
+func slashCommandTop(ctx context.Context, tournamentName string, num int) (string, error) {
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return "", err
+	}
+
+	statsList, err := readAllUserStatsForTournament(ctx, tournamentKey.IntID())
+	if err != nil {
+		return "", err
+	}
+	if len(statsList) > num {
+		statsList = statsList[:num]
+	}
+
+	reply := tournamentName + " leaderboard"
+	if len(statsList) == 0 {
+		return reply + "\nNo matches yet", nil
+	}
+	userIDs := make([]int64, len(statsList))
+	for i, stats := range statsList {
+		userIDs[i] = stats.UserID
+	}
+	profiles, err := readUserProfiles(ctx, userIDs)
+	if err != nil {
+		return "", err
+	}
+	for i, stats := range statsList {
+		reply += fmt.Sprintf("\n%d. %s %.2f (mu %.2f, sigma %.2f, FFA wins %d)",
+			i+1, profiles[i].Name, stats.TrueSkillRating, stats.TrueSkillMu, stats.TrueSkillSigma, stats.FFAWins)
+	}
+	return reply, nil
+}
+
+// slashCommandOdds uses TrueSkill stats of the tournament if one is given,
+// and the legacy Elo ratings otherwise.
+func slashCommandOdds(ctx context.Context, nameA string, nameB string, tournamentName string) (string, error) {
+	if nameA == nameB {
+		return "", errors.New("players must be different")
+	}
+
+	if tournamentName == "" {
+		userA, err := readLegacyUser(ctx, nameA)
+		if err != nil {
+			return "", err
+		}
+		userB, err := readLegacyUser(ctx, nameB)
+		if err != nil {
+			return "", err
+		}
+		p := expectedScore(userA.Rating, userB.Rating)
+		return fmt.Sprintf("%s (%.0f) vs %s (%.0f): %s wins %.1f%%, %s wins %.1f%%",
+			nameA, userA.Rating, nameB, userB.Rating, nameA, 100*p, nameB, 100*(1-p)), nil
+	}
+
+	keyA, err := findUserKey(ctx, nameA)
+	if err != nil {
+		return "", err
+	}
+	keyB, err := findUserKey(ctx, nameB)
+	if err != nil {
+		return "", err
+	}
+
+	exist, tournamentKey, tournament, err := findExistingTournament(ctx, tournamentName)
+	if err != nil {
+		return "", err
+	}
+	if !exist {
+		return "", notFoundError("tournament %s does not exist", tournamentName)
+	}
+
+	statsA, err := readStatsOrInitial(ctx, tournamentKey.IntID(), keyA.IntID())
+	if err != nil {
+		return "", err
+	}
+	statsB, err := readStatsOrInitial(ctx, tournamentKey.IntID(), keyB.IntID())
+	if err != nil {
+		return "", err
+	}
+
+	p := trueSkillWinProbability(tournament.trueSkillBeta(),
+		statsA.TrueSkillMu, statsA.TrueSkillSigma, statsB.TrueSkillMu, statsB.TrueSkillSigma)
+	return fmt.Sprintf("%s vs %s in %s: %s wins %.1f%%, %s wins %.1f%%",
+		nameA, nameB, tournamentName, nameA, 100*p, nameB, 100*(1-p)), nil
+}
+
+func readLegacyUser(ctx context.Context, name string) (UserProfile, error) {
+	exist, _, user, err := existUser(ctx, name)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	if !exist {
+		return UserProfile{}, fmt.Errorf("username %s does not exist", name)
+	}
+	return user, nil
+}
+
+// readStatsOrInitial reads an user's stats for a tournament without creating
+// them, returning the initial stats if the user has not played yet.
+func readStatsOrInitial(ctx context.Context, tournamentID int64, userID int64) (UserTournamentStats, error) {
+	exist, _, stats, err := readStatsWithID(ctx, tournamentID, userID)
+	if err != nil {
+		return UserTournamentStats{}, err
+	}
+	if !exist {
+		return createInitialUserStats(tournamentID, userID), nil
+	}
+	return stats, nil
+}
+
+// trueSkillWinProbability is the probability that player A performs better
+// than player B in a single game, with the performance deviation beta.
+func trueSkillWinProbability(beta, muA, sigmaA, muB, sigmaB float64) float64 {
+	denominator := math.Sqrt(2*beta*beta + sigmaA*sigmaA + sigmaB*sigmaB)
+	return 0.5 * (1 + math.Erf((muA-muB)/(denominator*math.Sqrt2)))
+}
+
+// slashCommandServiceContext acts as a service token of the slash command
+// with the submit scope. Requests are verified with the secret of the chat
+// workspace, but chat users are neither logins of the app nor linked to
+// profiles, so the command is trusted like a service: anyone who can run it
+// in the chat can record any match. The submitter is the chat user name with
+// the service.
+func slashCommandServiceContext(ctx context.Context, userName string) context.Context {
+	return context.WithValue(ctx, apiTokenContextKey, &APIToken{
+		Name:    "/elo",
+		Owner:   slashCommandSubmitter(userName),
+		Scope:   APITokenScopeSubmit,
+		Service: true,
+	})
+}
+
+func slashCommandSubmitter(userName string) string {
+	return userName + " (via /elo)"
+}
+
+// parseFFAMatchNote is the reverse of generateFFAMatchNote. It parses a ranking
+// such as "alice > bob = carol" into player names and draws.
+func parseFFAMatchNote(note string) ([]string, []bool, error) {
+	var players []string
+	var draws []bool
+
+	name := ""
+	addPlayer := func() error {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("missing player name in %q", note)
+		}
+		if strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("missing '>' or '=' between players in %q", name)
+		}
+		for _, player := range players {
+			if player == name {
+				return fmt.Errorf("player %s appears more than once", name)
+			}
+		}
+		players = append(players, name)
+		name = ""
+		return nil
+	}
+
+	for _, c := range note {
+		if c == '>' || c == '=' {
+			if err := addPlayer(); err != nil {
+				return nil, nil, err
+			}
+			draws = append(draws, c == '=')
+			continue
+		}
+		name += string(c)
+	}
+	if err := addPlayer(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(players) < 2 {
+		return nil, nil, errors.New("at least 2 players are required in a FFA ranking")
+	}
+	return players, draws, nil
+}
@@ -0,0 +1,92 @@
+package guestbook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseFFAMatchNote(t *testing.T) {
+	players := []string{"alice", "bob", "carol", "dave"}
+	draws := []bool{false, true, false}
+
+	gotPlayers, gotDraws, err := parseFFAMatchNote(generateFFAMatchNote(players, draws))
+	if err != nil {
+		t.Errorf("Failed to parse generated note: %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(gotPlayers, players) || !reflect.DeepEqual(gotDraws, draws) {
+		t.Errorf("Wanted %v %v, got %v %v", players, draws, gotPlayers, gotDraws)
+	}
+
+	// Spaces around separators are optional
+	gotPlayers, gotDraws, err = parseFFAMatchNote("alice>bob=carol")
+	if err != nil || !reflect.DeepEqual(gotPlayers, []string{"alice", "bob", "carol"}) ||
+		!reflect.DeepEqual(gotDraws, []bool{false, true}) {
+		t.Errorf("Failed to parse note without spaces, got %v %v %v", gotPlayers, gotDraws, err)
+	}
+
+	invalidNotes := []string{"", "alice", "alice >", "> bob", "alice bob > carol", "alice > alice"}
+	for _, note := range invalidNotes {
+		if _, _, err := parseFFAMatchNote(note); err == nil {
+			t.Errorf("Wanted an error when parsing %q", note)
+		}
+	}
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	secret := "8f742231b10e8888abcd99yyyzzz85a5"
+	body := []byte("token=xyz&command=%2Felo&text=top+Catan")
+	now := time.Unix(1531420618, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	signature := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if err := verifySlackSignature(secret, timestamp, body, signature, now); err != nil {
+		t.Errorf("Wanted valid signature, got %s", err.Error())
+	}
+	if err := verifySlackSignature("wrong", timestamp, body, signature, now); err == nil {
+		t.Errorf("Wanted an error for a wrong secret")
+	}
+	if err := verifySlackSignature(secret, timestamp, []byte("text=top+Other"), signature, now); err == nil {
+		t.Errorf("Wanted an error for a modified body")
+	}
+	if err := verifySlackSignature(secret, timestamp, body, signature, now.Add(time.Hour)); err == nil {
+		t.Errorf("Wanted an error for an expired timestamp")
+	}
+}
+
+func TestTrueSkillWinProbability(t *testing.T) {
+	if p := trueSkillWinProbability(DefaultTrueSkillBeta, 25, 8, 25, 8); p != 0.5 {
+		t.Errorf("Wanted 0.5 for equal players, got %f", p)
+	}
+
+	p := trueSkillWinProbability(DefaultTrueSkillBeta, 30, 2, 20, 2)
+	q := trueSkillWinProbability(DefaultTrueSkillBeta, 20, 2, 30, 2)
+	if p <= 0.5 || p+q < 0.999999 || p+q > 1.000001 {
+		t.Errorf("Wanted complementary probabilities favoring the stronger player, got %f and %f", p, q)
+	}
+}
+
+func TestSlashCommandServiceContext(t *testing.T) {
+	ctx := slashCommandServiceContext(context.Background(), "alice")
+
+	if role, err := currentRole(ctx, 1); err != nil || role != RolePlayer {
+		t.Errorf("Wanted role %s, got %s, %v", RolePlayer, role, err)
+	}
+	if err := checkParticipant(ctx, 1, []string{"bob", "carol"}); err != nil {
+		t.Errorf("Wanted the service to submit matches of any player, got %v", err)
+	}
+	if submitter := currentSubmitter(ctx); submitter != "alice (via /elo)" {
+		t.Errorf("Wanted submitter alice (via /elo), got %s", submitter)
+	}
+}
@@ -0,0 +1,87 @@
+package guestbook
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Functions about leaderboards of a tournament as they were at a past date,
+// rebuilt from the post-game stats stored in FFAMatch.
+
+// readFFAMatchesBefore reads the matches of a tournament played before a time,
+// from first to last played. Matches submitted later may have been played
+// before, so all matches are read.
+func readFFAMatchesBefore(ctx context.Context, tournamentID int64, before time.Time) ([]FFAMatch, error) {
+	var matches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		Order("SubmissionTime").
+		GetAll(ctx, &matches); err != nil {
+		return nil, err
+	}
+	sortFFAMatchesByPlayedAt(matches, nil)
+	return matchesBefore(matches, before), nil
+}
+
+// statsAsOf returns the stats of players at the end of matches, which are
+// ordered from first to last played. Stats are the post-game values of the
+// last match of each player, or initial values for players without a match.
+// They are ordered by TrueSkill rating.
+func statsAsOf(tournamentID int64, userIDs []int64, matches []FFAMatch) []UserTournamentStats {
+	statsMap := make(map[int64]UserTournamentStats)
+	for _, userID := range userIDs {
+		statsMap[userID] = createInitialUserStats(tournamentID, userID)
+	}
+
+	for _, match := range matches {
+		userStatsList := make([]UserTournamentStats, len(match.Players))
+		for i, userID := range match.Players {
+			stats, exist := statsMap[userID]
+			if !exist {
+				stats = createInitialUserStats(tournamentID, userID)
+			}
+			stats.TrueSkillMu = match.PostGameTrueSkillMu[i]
+			stats.TrueSkillSigma = match.PostGameTrueSkillSigma[i]
+			stats.TrueSkillRating = match.PostGameTrueSkillRating[i]
+			if len(match.PostGameEloRating) == len(match.Players) {
+				stats.Rating = match.PostGameEloRating[i]
+			}
+			userStatsList[i] = stats
+		}
+
+		tallyFFAMatch(userStatsList, match.Draws, match.playedAt(), 1)
+		for i, userID := range match.Players {
+			statsMap[userID] = userStatsList[i]
+		}
+	}
+
+	statsList := make([]UserTournamentStats, len(userIDs))
+	for i, userID := range userIDs {
+		statsList[i] = statsMap[userID]
+	}
+	sort.SliceStable(statsList, func(i, j int) bool {
+		return statsList[i].TrueSkillRating > statsList[j].TrueSkillRating
+	})
+	return statsList
+}
+
+// matchesBefore returns the matches played before a time, matches are
+// ordered from first to last played
+func matchesBefore(matches []FFAMatch, before time.Time) []FFAMatch {
+	end := sort.Search(len(matches), func(i int) bool {
+		return !matches[i].playedAt().Before(before)
+	})
+	return matches[:end]
+}
+
+// leaderboardRanks returns the 1-based rank of every player of a leaderboard
+func leaderboardRanks(statsList []UserTournamentStats) map[int64]int {
+	ranks := make(map[int64]int)
+	for i, stats := range statsList {
+		ranks[stats.UserID] = i + 1
+	}
+	return ranks
+}
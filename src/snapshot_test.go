@@ -0,0 +1,68 @@
+package guestbook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsAsOf(t *testing.T) {
+	ts, err := createTrueSkillConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	statsMap := map[int64]UserTournamentStats{
+		10: createInitialUserStats(1, 10),
+		11: createInitialUserStats(1, 11),
+		12: createInitialUserStats(1, 12),
+	}
+	var matches []FFAMatch
+	for i, players := range [][]int64{{10, 11}, {11, 10}, {11, 12}} {
+		preGameUserStatsList := []UserTournamentStats{statsMap[players[0]], statsMap[players[1]]}
+		submissionTime := start.Add(time.Duration(i) * time.Hour)
+		postGameUserStatsList, outcomeProbability := adjustFFAStats(ts, DefaultEloK, preGameUserStatsList, []bool{false}, submissionTime)
+		match := FFAMatch{
+			Players:        players,
+			Draws:          []bool{false},
+			SubmissionTime: submissionTime,
+		}
+		setFFAMatchStats(&match, preGameUserStatsList, postGameUserStatsList, outcomeProbability)
+		matches = append(matches, match)
+		for j, stats := range postGameUserStatsList {
+			statsMap[players[j]] = stats
+		}
+	}
+
+	userIDs := []int64{10, 11, 12}
+	statsList := statsAsOf(1, userIDs, matches)
+	for _, stats := range statsList {
+		if stats != statsMap[stats.UserID] {
+			t.Errorf("Wanted %+v, got %+v", statsMap[stats.UserID], stats)
+		}
+	}
+
+	before := matchesBefore(matches, start.Add(90*time.Minute))
+	if len(before) != 2 {
+		t.Fatalf("Wanted 2 matches, got %d", len(before))
+	}
+	statsList = statsAsOf(1, userIDs, before)
+	if statsList[2] != createInitialUserStats(1, 12) {
+		t.Errorf("Wanted initial stats of a player without matches, got %+v", statsList[2])
+	}
+	for _, stats := range statsList[:2] {
+		if stats.FFAWins != 1 {
+			t.Errorf("Wanted 1 FFA win of player %d, got %d", stats.UserID, stats.FFAWins)
+		}
+	}
+}
+
+func TestLeaderboardRanks(t *testing.T) {
+	ranks := leaderboardRanks([]UserTournamentStats{{UserID: 12}, {UserID: 10}, {UserID: 11}})
+	want := map[int64]int{12: 1, 10: 2, 11: 3}
+	for userID, rank := range want {
+		if ranks[userID] != rank {
+			t.Errorf("Wanted rank %d of player %d, got %d", rank, userID, ranks[userID])
+		}
+	}
+}
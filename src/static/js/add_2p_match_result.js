@@ -1,6 +1,9 @@
 Vue.component('v-select', VueSelect.VueSelect);
 
 var users = null;
+
+// Same for every submission of the page, so a retry is not recorded twice
+var requestID = null;
 var userNames = null;
 
 var pageInitialized = false;
@@ -119,10 +122,19 @@ function submitResult() {
     return;
   }
 
+  if (requestID == null) {
+    requestID = newRequestID();
+  }
+  matchResult.RequestID = requestID;
+
   httpPostJsonAsync(
     location.origin + "/submit_ffa_match_result",
     matchResult,
     function (responseText) {
+      var submission = JSON.parse(responseText);
+      for (const warning of submission.Warnings) {
+        alert(warning);
+      }
       // redirect to tournament stats page
       window.location.href = "/tournament/" + matchResult.Tournament;
     });
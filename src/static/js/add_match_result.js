@@ -58,10 +58,20 @@ function httpGetAsync(theUrl, callback)
 }
 
 function onLoad() {
+  setRequestID();
   getAlert();
   getUsers();
 }
 
+// A random ID is sent with the form, so that a match submitted twice is only
+// recorded once
+function setRequestID() {
+  var bytes = new Uint8Array(16);
+  window.crypto.getRandomValues(bytes);
+  document.getElementById("request_id").value =
+    Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+}
+
 function getUsers () {
   console.log("get users");
   // Get available user data from JSON API.
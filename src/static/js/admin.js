@@ -7,6 +7,8 @@ function httpGetAsync(theUrl, callback)
         callback(xmlHttp.responseText);
       else if (xmlHttp.status == 401)
         alert("You are not admin QQ");
+      else if (xmlHttp.status == 403)
+        console.log(xmlHttp.responseText);
     }
   }
   xmlHttp.open("GET", theUrl, true); // true for asynchronous
@@ -15,6 +17,71 @@ function httpGetAsync(theUrl, callback)
 
 function onLoad() {
   getBadges();
+  getProfileClaims();
+  getRoles();
+}
+
+function getRoles() {
+  httpGetAsync(location.origin + "/request_roles", fillInRoles);
+}
+
+function fillInRoles(r) {
+  var roles = JSON.parse(r);
+  var role_table = document.getElementById("roles");
+  var content = "<tr>" +
+                "<th>Email</th>" +
+                "<th>Role</th>" +
+                "<th>Tournament</th>" +
+                "<th></th>" +
+                "</tr>";
+  for (var i in roles) {
+    var role = roles[i].Assignment;
+    var key = roles[i].Key;
+    var row = "<tr>" +
+              "<td>" + role.Email + "</td>" +
+              "<td>" + role.Role + "</td>" +
+              "<td>" + (roles[i].Tournament || "All") + "</td>" +
+              "<td><input type=\"button\" value=\"Delete\" onclick=\"deleteRole('" + key + "')\"></input></td>" +
+              "</tr>";
+    content += row;
+  }
+  role_table.innerHTML = content;
+}
+
+function deleteRole(key) {
+  httpGetAsync(location.origin + "/delete_role?key=" + key, getRoles);
+}
+
+function getProfileClaims() {
+  httpGetAsync(location.origin + "/request_profile_claims", fillInProfileClaims);
+}
+
+function fillInProfileClaims(r) {
+  var claims = JSON.parse(r);
+  var claim_table = document.getElementById("claims");
+  var content = "<tr>" +
+                "<th>Player</th>" +
+                "<th>Account</th>" +
+                "<th>Requested</th>" +
+                "<th></th>" +
+                "</tr>";
+  for (var i in claims) {
+    var claim = claims[i].Claim;
+    var key = claims[i].Key;
+    var row = "<tr>" +
+              "<td>" + claim.UserName + "</td>" +
+              "<td>" + claim.AccountEmail + "</td>" +
+              "<td>" + new Date(claim.RequestTime).toLocaleString() + "</td>" +
+              "<td><input type=\"button\" value=\"Approve\" onclick=\"reviewClaim('" + key + "', true)\"></input>" +
+              "<input type=\"button\" value=\"Reject\" style=\"margin-left:10px\" onclick=\"reviewClaim('" + key + "', false)\"></input></td>" +
+              "</tr>";
+    content += row;
+  }
+  claim_table.innerHTML = content;
+}
+
+function reviewClaim(key, approve) {
+  httpGetAsync(location.origin + "/review_profile_claim?key=" + key + "&approve=" + approve, getProfileClaims);
 }
 
 function getBadges() {
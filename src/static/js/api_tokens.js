@@ -0,0 +1,58 @@
+function getAPITokens() {
+  httpGetAsync(location.origin + "/request_api_tokens", fillInAPITokens);
+}
+
+function fillInAPITokens(r) {
+  var tokens = JSON.parse(r);
+  var token_table = document.getElementById("tokens");
+  var content = "<tr>" +
+                "<th>Name</th>" +
+                "<th>Token</th>" +
+                "<th>Scope</th>" +
+                "<th>Tournaments</th>" +
+                "<th>Owner</th>" +
+                "<th>Last used</th>" +
+                "<th></th>" +
+                "</tr>";
+  for (var i in tokens) {
+    var token = tokens[i].Token;
+    var key = tokens[i].Key;
+    var lastUsed = (new Date(token.LastUseTime).getFullYear() > 1) ? new Date(token.LastUseTime).toLocaleString() : "Never";
+    var row = "<tr>" +
+              "<td>" + token.Name + "</td>" +
+              "<td>" + token.Prefix + "...</td>" +
+              "<td>" + token.Scope + "</td>" +
+              "<td>" + (tokens[i].Tournaments.length ? tokens[i].Tournaments.join(", ") : "All") + "</td>" +
+              "<td>" + token.Owner + "</td>" +
+              "<td>" + lastUsed + "</td>" +
+              "<td><input type=\"button\" value=\"Revoke\" onclick=\"revokeAPIToken('" + key + "')\"></input></td>" +
+              "</tr>";
+    content += row;
+  }
+  token_table.innerHTML = content;
+}
+
+function createAPIToken() {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.onreadystatechange = function () {
+    if (xmlHttp.readyState != 4) {
+      return;
+    }
+    if (xmlHttp.status != 200) {
+      alert(JSON.parse(xmlHttp.responseText).Error.Message);
+      return;
+    }
+    var created = JSON.parse(xmlHttp.responseText);
+    document.getElementById("new_token_value").innerText = created.Token;
+    document.getElementById("new_token").style.display = "block";
+    getAPITokens();
+  }
+  xmlHttp.open("POST", location.origin + "/submit_api_token", true);
+  xmlHttp.send(new FormData(document.getElementById("token_form")));
+}
+
+function revokeAPIToken(key) {
+  if (confirm("Are you sure to revoke this token? Scripts using it will stop working.")) {
+    httpGetAsync(location.origin + "/revoke_api_token?key=" + key, getAPITokens);
+  }
+}
@@ -29,4 +29,11 @@ function httpPostJsonAsync(url, jsonObject, callback) {
 
     var jsonString = (jsonObject == null) ? null : JSON.stringify(jsonObject);
     xmlHttp.send(jsonString);
-}
\ No newline at end of file
+}
+// newRequestID returns a random ID to send with a submission, so that a
+// submission sent twice is only recorded once
+function newRequestID() {
+    var bytes = new Uint8Array(16);
+    window.crypto.getRandomValues(bytes);
+    return Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+}
@@ -1,3 +1,5 @@
+var nextMatchesCursor = "";
+
 function onLoad() {
   getLeaderboard();
   getDetailMatchResult();
@@ -15,7 +17,14 @@ function getDetailMatchResult() {
 
 function getRecentMatches() {
   var num_matches = document.getElementById("num_matches").value;
-  httpGetAsync(location.origin + "/request_recent_matches?num=" + num_matches, fillInRecentMatches);
+  httpGetAsync(location.origin + "/request_recent_matches?num=" + num_matches, fillInRecentMatches(false));
+}
+
+function getOlderMatches() {
+  if (nextMatchesCursor == "") return;
+  var num_matches = document.getElementById("num_matches").value;
+  httpGetAsync(location.origin + "/request_recent_matches?num=" + num_matches +
+               "&cursor=" + nextMatchesCursor, fillInRecentMatches(true));
 }
 
 function getGreetings() {
@@ -78,11 +87,18 @@ function fillInDetailMatchResult(r) {
   detail_result_table.innerHTML = content;
 }
 
-function fillInRecentMatches(r) {
-  var matchWithKeys = JSON.parse(r);
-  if (matches.length == 0) return;
+function fillInRecentMatches(append) {
+  return function(r) {
+    var page = JSON.parse(r);
+    nextMatchesCursor = page.NextCursor;
+    document.getElementById("older_matches").style.display = (nextMatchesCursor == "") ? "none" : "inline";
+    appendRecentMatches(page.Matches, append);
+  }
+}
+
+function appendRecentMatches(matchWithKeys, append) {
   var matches_div = document.getElementById("matches");
-  var content = "";
+  var content = append ? matches_div.innerHTML : "";
   for (var i in matchWithKeys) {
     match = matchWithKeys[i].Match;
     key = matchWithKeys[i].Key
@@ -13,9 +13,93 @@ function httpGetAsync(theUrl, callback)
   xmlHttp.send(null);
 }
 
+var profileUsername;
+
 function onLoad(username) {
+  profileUsername = username;
   getUserBadges(username);
   getUserMatches(username);
+  getUserTournamentSummaries(username);
+  getUserFFAMatches();
+}
+
+function getUserTournamentSummaries(username) {
+  httpGetAsync(location.origin + "/request_user_tournament_summaries?user=" + username, fillInTournamentSummaries);
+}
+
+function getUserFFAMatches() {
+  var tournament = document.getElementById("ffa_tournament").value;
+  httpGetAsync(location.origin + "/request_user_ffa_matches?user=" + profileUsername +
+               "&tournament=" + tournament, fillInUserFFAMatches);
+}
+
+function fillInTournamentSummaries(r) {
+  var summaries = JSON.parse(r);
+  var table = document.getElementById("tournament_summaries");
+  var select = document.getElementById("ffa_tournament");
+  var content = "<tr>" +
+                "<th>Tournament</th>" +
+                "<th>Rank</th>" +
+                "<th>TrueSkill rating</th>" +
+                "<th>TrueSkill mu</th>" +
+                "<th>TrueSkill sigma</th>" +
+                "<th>FFA Wins</th>" +
+                "<th>Games</th>" +
+                "</tr>";
+  var totalWins = 0;
+  var totalGames = 0;
+  for (var i in summaries) {
+    var summary = summaries[i];
+    var stats = summary.Stats;
+    totalWins += stats.FFAWins;
+    totalGames += summary.GamesPlayed;
+    content += "<tr>" +
+               "<td><a href=\"/tournament/" + summary.Tournament + "\">" + summary.Tournament + "</a></td>" +
+               "<td>" + summary.Rank + " / " + summary.NumRankedPlayers + "</td>" +
+               "<td>" + round(stats.TrueSkillRating) + "</td>" +
+               "<td>" + round(stats.TrueSkillMu) + "</td>" +
+               "<td>" + round(stats.TrueSkillSigma) + "</td>" +
+               "<td>" + stats.FFAWins + "</td>" +
+               "<td>" + summary.GamesPlayed + "</td>" +
+               "</tr>";
+    var option = document.createElement("option");
+    option.value = summary.Tournament;
+    option.textContent = summary.Tournament;
+    select.appendChild(option);
+  }
+  content += "<tr><th>Total</th><td></td><td></td><td></td><td></td>" +
+             "<th>" + totalWins + "</th><th>" + totalGames + "</th></tr>";
+  table.innerHTML = content;
+}
+
+function fillInUserFFAMatches(r) {
+  var entries = JSON.parse(r);
+  var matches_div = document.getElementById("user_ffa_matches");
+  var content = "";
+  for (var i = entries.length - 1; i >= 0; --i) {
+    var entry = entries[i];
+    var color = (entry.Placement == 1) ? "honeydew" : "seashell";
+    var result = "<h3>" + entry.Note + "</h3>" +
+                 "<div>" + entry.Tournament + ": #" + entry.Placement + " of " + entry.NumPlayers +
+                 " against " + entry.Opponents.join(", ") + "</div>" +
+                 "<div>Rating " + round(entry.PreGameTrueSkillRating) + " &#x27a8; " + round(entry.PostGameTrueSkillRating) +
+                 ", mu " + round(entry.PreGameTrueSkillMu) + " &#x27a8; " + round(entry.PostGameTrueSkillMu) +
+                 ", sigma " + round(entry.PreGameTrueSkillSigma) + " &#x27a8; " + round(entry.PostGameTrueSkillSigma) +
+                 ", outcome probability " + Math.round(entry.OutcomeProbability * 1000) / 10 + "%</div>";
+    var log = "( Submitted by " + entry.Submitter + " @ " + getTime(entry.SubmissionTime) + " )";
+    if (entry.PlayedAt != entry.SubmissionTime) {
+      log = "( Played @ " + getTime(entry.PlayedAt) + ", submitted by " + entry.Submitter + " @ " + getTime(entry.SubmissionTime) + " )";
+    }
+    content += "<div><div class=\"Match\" style=\"background-color:" + color + "\">" + result + log + "</div></div>";
+  }
+  if (content == "") {
+    content = "No FFA matches";
+  }
+  matches_div.innerHTML = content;
+}
+
+function round(num) {
+  return Math.round(num * 100) / 100;
 }
 
 function getUserBadges(username) {
@@ -1,28 +1,51 @@
 var tournament;
 var recentFFAMatchesVue;
+var leaderboardUsers = [];
+var nextFFAMatchesCursor = "";
+var eventSource = null;
 
 function onLoad() {
   tournament = getTournamentName();
   document.title = tournament + " tournament stats"
   document.getElementById("addMatchForm").action = "/tournament/" + tournament + "/add_ffa_match_result"
+  document.getElementById("feedLink").href = "/feed?tournament=" + tournament
 
   initVueElements();
   getLeaderboard();
   getDetailMatchResult();
+  getPredictionReport();
+  getBatchRatings();
   getGreetings();
   getRecentFFAMatches();
+  startEventStream();
 }
 
 function initVueElements() {
   recentFFAMatchesVue = new Vue({
     el: '#recent_ffa_matches',
     data: {
-      matchWithKeys: []
+      matchWithKeys: [],
+      retractableKeys: []
     },
     methods: {
+      confirmDeleteFFA(key) {
+        if (confirm("Are you sure to delete this match? Ratings of later matches are recalculated.")) {
+          httpGetAsync(location.origin + "/delete_ffa_match?key=" + key, refreshData);
+        }
+      },
+      confirmRetractFFA(key) {
+        if (confirm("Are you sure to retract this match? Ratings are reverted.")) {
+          httpPostJsonAsync(location.origin + "/retract_match?key=" + key, null, refreshData);
+        }
+      },
       getLocalTime(time) {
         return new Date(time).toLocaleString()
       },
+      isBackdated(match) {
+        // Matches recorded before PlayedAt was kept have a zero time
+        var playedAt = new Date(match.PlayedAt);
+        return playedAt.getFullYear() > 1 && playedAt < new Date(match.SubmissionTime)
+      },
       getArrowColor(preGame, postGame) {
         if (postGame < preGame) {
           return 'red'
@@ -43,17 +66,53 @@ function getTournamentName() {
 }
 
 function getLeaderboard() {
-  httpGetAsync(location.origin + "/request_tournament_stats?tournament=" + tournament, fillInLeaderboard);
+  var path = location.origin + "/request_tournament_stats?tournament=" + tournament;
+  var params = ["asOf", "compareTo"];
+  for (var i in params) {
+    var value = document.getElementById("leaderboard_" + params[i]).value;
+    if (value != "") {
+      path += "&" + params[i] + "=" + encodeURIComponent(value);
+    }
+  }
+  httpGetAsync(path, fillInLeaderboard);
 }
 
 function getDetailMatchResult() {
   httpGetAsync(location.origin + "/request_detail_results?tournament=" + tournament, fillInDetailMatchResult);
 }
 
+function getPredictionReport() {
+  httpGetAsync(location.origin + "/request_prediction_report?tournament=" + tournament, fillInPredictionReport);
+}
+
+function getBatchRatings() {
+  httpGetAsync(location.origin + "/request_batch_ratings?tournament=" + tournament, fillInBatchRatings);
+}
+
+function runBatchRatings() {
+  httpPostJsonAsync(location.origin + "/run_batch_ratings?tournament=" + tournament, null, fillInBatchRatings);
+}
+
 function getRecentFFAMatches() {
+  httpGetAsync(getRecentFFAMatchesPath(), fillInRecentFFAMatches(false));
+}
+
+function getOlderFFAMatches() {
+  if (nextFFAMatchesCursor == "") return;
+  httpGetAsync(getRecentFFAMatchesPath() + "&cursor=" + nextFFAMatchesCursor, fillInRecentFFAMatches(true));
+}
+
+function getRecentFFAMatchesPath() {
   var num_matches = document.getElementById("num_ffa_matches").value;
   var path = location.origin + "/request_recent_ffa_matches?num=" + num_matches + "&tournament=" + tournament
-  httpGetAsync(path, fillInRecentFFAMatches);
+  var filters = ["player", "submitter", "from", "to", "minPlayers"];
+  for (var i in filters) {
+    var value = document.getElementById("filter_" + filters[i]).value;
+    if (value != "") {
+      path += "&" + filters[i] + "=" + encodeURIComponent(value);
+    }
+  }
+  return path;
 }
 
 function getGreetings() {
@@ -62,17 +121,34 @@ function getGreetings() {
 }
 
 function fillInLeaderboard(r) {
-  var users = JSON.parse(r);
+  leaderboardUsers = JSON.parse(r);
+  renderLeaderboard(leaderboardUsers);
+}
+
+// Order the leaderboard by the rating chosen in leaderboard_orderBy
+function sortLeaderboard(users) {
+  var orderBy = document.getElementById("leaderboard_orderBy").value;
+  users.sort((a, b) => b[orderBy] - a[orderBy]);
+}
+
+function renderLeaderboard(users) {
+  sortLeaderboard(users);
   var leaderboard_table = document.getElementById("leaderboard");
+  var showRankChange = users.some(u => u.Rank);
   var content = "<tr>" +
     "<th>Player</th>" +
     "<th>TrueSkill rating</th>" +
     "<th>TrueSkill mu</th>" +
     "<th>TrueSkill sigma</th>" +
+    "<th>Elo</th>" +
+    "<th>Games</th>" +
     "<th>FFA Wins</th>" +
-    "<th>Wins</th>" +
-    "<th>Losses</th>" +
+    "<th>Podiums</th>" +
+    "<th>Average place</th>" +
+    "<th>Wins / Draws / Losses</th>" +
+    "<th>Last played</th>" +
     "<th>Badges</th>" +
+    (showRankChange ? "<th>Rank change</th>" : "") +
     "</tr>";
   for (var i in users) {
     user = users[i];
@@ -86,16 +162,32 @@ function fillInLeaderboard(r) {
       "<td>" + Math.round(user.TrueSkillRating * 100) / 100 + "</td>" +
       "<td>" + Math.round(user.TrueSkillMu * 100) / 100 + "</td>" +
       "<td>" + Math.round(user.TrueSkillSigma * 100) / 100 + "</td>" +
+      "<td>" + Math.round(user.Rating * 100) / 100 + "</td>" +
+      "<td>" + (user.Games || 0) + "</td>" +
       "<td>" + user.FFAWins + "</td>" +
-      "<td>" + user.Wins + "</td>" +
-      "<td>" + user.Losses + "</td>" +
+      "<td>" + (user.Podiums || 0) + "</td>" +
+      "<td>" + (user.AveragePlacement ? Math.round(user.AveragePlacement * 100) / 100 : "-") + "</td>" +
+      "<td>" + user.Wins + " / " + (user.Draws || 0) + " / " + user.Losses + "</td>" +
+      "<td>" + (user.Games ? new Date(user.LastPlayed).toLocaleDateString() : "-") + "</td>" +
       "<td>" + badge_imgs + "</td>" +
+      (showRankChange ? "<td>" + getRankChange(user) + "</td>" : "") +
       "</tr>";
     content += row;
   }
   leaderboard_table.innerHTML = content;
 }
 
+// Rank movement since the compareTo date, e.g. "▲2"
+function getRankChange(user) {
+  var change = user.RankChange || 0;
+  if (change > 0) {
+    return "<span style=\"color:green\">▲" + change + "</span>";
+  } else if (change < 0) {
+    return "<span style=\"color:red\">▼" + (-change) + "</span>";
+  }
+  return "-";
+}
+
 function fillInDetailMatchResult(r) {
   var matchData = JSON.parse(r);
   var usernames = matchData.Usernames;
@@ -122,9 +214,103 @@ function fillInDetailMatchResult(r) {
   detail_result_table.innerHTML = content;
 }
 
-function fillInRecentFFAMatches(r) {
-  document.getElementById('recent_ffa_matches').style.display = 'block';
-  recentFFAMatchesVue.matchWithKeys = JSON.parse(r);
+function fillInPredictionReport(r) {
+  var report = JSON.parse(r);
+  var percent = function (p) { return Math.round(p * 1000) / 10 + "%"; };
+  document.getElementById("prediction_summary").innerHTML =
+    "The favorite won " + report.FavoriteWins + " of " + report.Matches + " matches (" +
+    percent(report.FavoriteWinRate) + "). Log-loss " + Math.round(report.LogLoss * 1000) / 1000 +
+    ", Brier score " + Math.round(report.BrierScore * 1000) / 1000 +
+    " over " + report.Predictions + " pairs of players.";
+
+  var content = "<tr><th>Predicted</th><th>Pairs</th><th>Mean predicted</th><th>Favorite won</th></tr>";
+  for (var i in report.Calibration) {
+    var bucket = report.Calibration[i];
+    content += "<tr>" +
+      "<td>" + percent(bucket.MinProbability) + " - " + percent(bucket.MaxProbability) + "</td>" +
+      "<td>" + bucket.Predictions + "</td>" +
+      "<td>" + percent(bucket.MeanProbability) + "</td>" +
+      "<td>" + percent(bucket.FavoriteWinRate) + "</td>" +
+      "</tr>";
+  }
+  document.getElementById("prediction_calibration").innerHTML = content;
+
+  content = "<tr><th>Match</th><th>Winner</th><th>Loser</th><th>Win probability</th></tr>";
+  for (var i in report.Upsets) {
+    var upset = report.Upsets[i];
+    content += "<tr>" +
+      "<td>" + upset.Note + " @" + new Date(upset.SubmissionTime).toLocaleString() + "</td>" +
+      "<td>" + upset.Winner + "</td>" +
+      "<td>" + upset.Loser + "</td>" +
+      "<td>" + percent(upset.Probability) + "</td>" +
+      "</tr>";
+  }
+  document.getElementById("prediction_upsets").innerHTML = content;
+}
+
+function fillInBatchRatings(r) {
+  var job = JSON.parse(r);
+  var status = "Last requested " + new Date(job.RequestTime).toLocaleString() + ", " + job.Status + ".";
+  if (job.Error) {
+    status += " " + job.Error;
+  }
+  if (job.Status != "running" && job.Matches > 0) {
+    status += " Fitted on " + job.Matches + " matches, completed " + new Date(job.CompletionTime).toLocaleString() + ".";
+  }
+  document.getElementById("batch_ratings_status").innerHTML = status;
+  if (job.Status == "running") {
+    setTimeout(getBatchRatings, 5000);
+  }
+
+  var content = "<tr><th>Name</th><th>Rating</th><th>95% interval</th><th>Games</th></tr>";
+  for (var i in job.Ratings) {
+    var rating = job.Ratings[i];
+    content += "<tr>" +
+      "<td>" + rating.Name + "</td>" +
+      "<td>" + Math.round(rating.Rating) + "</td>" +
+      "<td>" + Math.round(rating.Lower) + " - " + Math.round(rating.Upper) + "</td>" +
+      "<td>" + rating.Games + "</td>" +
+      "</tr>";
+  }
+  document.getElementById("batch_ratings").innerHTML = content;
+}
+
+// Listen to new matches and stats changes of this tournament. Each request
+// ends after changes, EventSource reconnects by itself and resumes with the
+// last event ID it has received.
+function startEventStream() {
+  if (typeof (EventSource) === "undefined") {
+    return;
+  }
+  eventSource = new EventSource(location.origin + "/stream_tournament_events?tournament=" + tournament);
+  eventSource.addEventListener("match", function (e) {
+    var matchWithKey = JSON.parse(e.data);
+    recentFFAMatchesVue.matchWithKeys.unshift(matchWithKey);
+    document.getElementById('recent_ffa_matches').style.display = 'block';
+  });
+  // Stats changed with new matches, retractions, deletions or replays, which
+  // the server computes
+  eventSource.addEventListener("stats", function (e) {
+    getLeaderboard();
+    getDetailMatchResult();
+    getRecentFFAMatches();
+  });
+}
+
+function fillInRecentFFAMatches(append) {
+  return function (r) {
+    var page = JSON.parse(r);
+    nextFFAMatchesCursor = page.NextCursor;
+    document.getElementById('older_ffa_matches').style.display = (nextFFAMatchesCursor == "") ? 'none' : 'inline';
+    document.getElementById('recent_ffa_matches').style.display = 'block';
+    if (append) {
+      recentFFAMatchesVue.matchWithKeys = recentFFAMatchesVue.matchWithKeys.concat(page.Matches);
+      recentFFAMatchesVue.retractableKeys = recentFFAMatchesVue.retractableKeys.concat(page.RetractableKeys);
+    } else {
+      recentFFAMatchesVue.matchWithKeys = page.Matches;
+      recentFFAMatchesVue.retractableKeys = page.RetractableKeys;
+    }
+  }
 }
 
 function fillInGreetings(r) {
@@ -1,12 +1,11 @@
 package guestbook
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 
 	trueskill "github.com/mafredri/go-trueskill"
@@ -26,11 +25,26 @@ const (
 	InitialTrueSkillSigma  = 25.0 / 3.0
 	InitialTrueSkillRating = 0.0
 	DrawProbability        = 5.0 // setting draw probability to 5%, the library uses 0.0-100.0 instead of 0.0-1.0
+
+	// TrueSkill performance deviation and dynamics, the library defaults when
+	// only mu and sigma are configured
+	DefaultTrueSkillBeta = InitialTrueSkillSigma / 2
+	DefaultTrueSkillTau  = InitialTrueSkillSigma / 100
+
+	// K-factor of Elo updates, of 1v1 matches and of FFA matches in
+	// tournaments without their own
+	DefaultEloK = 32.0
 )
 
 // createTrueSkillConfig creates a TrueSkill config object with default values
 func createTrueSkillConfig() (trueskill.Config, error) {
-	drawProbabilityOption, err := trueskill.DrawProbability(DrawProbability)
+	return RatingSettings{}.trueSkillConfig()
+}
+
+// trueSkillConfig creates a TrueSkill config object with the settings, using
+// default values for unset settings
+func (s RatingSettings) trueSkillConfig() (trueskill.Config, error) {
+	drawProbabilityOption, err := trueskill.DrawProbability(s.drawProbability())
 	if err != nil {
 		return trueskill.New(), err
 	}
@@ -38,9 +52,62 @@ func createTrueSkillConfig() (trueskill.Config, error) {
 	return trueskill.New(
 		trueskill.Mu(InitialTrueSkillMu),
 		trueskill.Sigma(InitialTrueSkillSigma),
+		trueskill.Beta(s.trueSkillBeta()),
+		trueskill.Tau(s.trueSkillTau()),
 		drawProbabilityOption), nil
 }
 
+func (s RatingSettings) trueSkillBeta() float64 {
+	if s.TrueSkillBeta == 0 {
+		return DefaultTrueSkillBeta
+	}
+	return s.TrueSkillBeta
+}
+
+func (s RatingSettings) trueSkillTau() float64 {
+	if s.TrueSkillTau == 0 {
+		return DefaultTrueSkillTau
+	}
+	return s.TrueSkillTau
+}
+
+func (s RatingSettings) drawProbability() float64 {
+	if s.DrawProbability == 0 {
+		return DrawProbability
+	}
+	return s.DrawProbability
+}
+
+func (s RatingSettings) eloK() float64 {
+	if s.EloK == 0 {
+		return DefaultEloK
+	}
+	return s.EloK
+}
+
+// withDefaults returns the settings with default values in place of unset
+// ones
+func (s RatingSettings) withDefaults() RatingSettings {
+	return RatingSettings{
+		TrueSkillBeta:   s.trueSkillBeta(),
+		TrueSkillTau:    s.trueSkillTau(),
+		DrawProbability: s.drawProbability(),
+		EloK:            s.eloK(),
+	}
+}
+
+// readRatingSettings reads the rating settings of a tournament
+func readRatingSettings(ctx context.Context, tournamentID int64) (RatingSettings, error) {
+	var tournament Tournament
+	key := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+	if err := datastore.Get(ctx, key, &tournament); err == datastore.ErrNoSuchEntity {
+		return RatingSettings{}, notFoundError("tournament %d does not exist", tournamentID)
+	} else if err != nil {
+		return RatingSettings{}, err
+	}
+	return tournament.RatingSettings, nil
+}
+
 // findExistingUser tries to find exiting user in the database that matches the
 // given username
 func findExistingUser(ctx context.Context, userName string) (bool, datastore.Key, UserProfile, error) {
@@ -64,7 +131,7 @@ func findUserKey(ctx context.Context, userName string) (datastore.Key, error) {
 		return datastore.Key{}, err
 	}
 	if !exist {
-		return datastore.Key{}, fmt.Errorf("username %s does not exist", userName)
+		return datastore.Key{}, notFoundError("username %s does not exist", userName)
 	}
 	return key, nil
 }
@@ -83,24 +150,48 @@ func findUserKeys(ctx context.Context, userNames []string) ([]datastore.Key, err
 	return keys, nil
 }
 
-// readStatsWithKey reads an user's stats for a given tournament, using
+// readStatsWithID reads an user's stats for a given tournament, using
 // datastore ID instead of string names. The first returned value indicates
 // whether the stats exists.
 func readStatsWithID(ctx context.Context, tournamentID int64, userID int64) (
 	bool, *datastore.Key, UserTournamentStats, error) {
+	key := userTournamentStatsKey(ctx, tournamentID, userID)
+	var stats UserTournamentStats
+	err := datastore.Get(ctx, key, &stats)
+	if err == nil {
+		return true, key, stats, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, nil, UserTournamentStats{}, err
+	}
+
+	// Stats created before keys were deterministic, until
+	// repairUserTournamentStats has moved them
 	q := datastore.NewQuery("UserTournamentStats").Ancestor(guestbookKey(ctx)).
 		Filter("TournamentID =", tournamentID).
 		Filter("UserID =", userID).
 		Limit(1)
-	var stats []UserTournamentStats
-	keys, err := q.GetAll(ctx, &stats)
+	var statsList []UserTournamentStats
+	keys, err := q.GetAll(ctx, &statsList)
 	if err != nil {
 		return false, nil, UserTournamentStats{}, err
 	}
-	if len(stats) == 0 {
-		return false, nil, UserTournamentStats{}, err
+	if len(statsList) == 0 {
+		return false, nil, UserTournamentStats{}, nil
 	}
-	return true, keys[0], stats[0], nil
+	return true, keys[0], statsList[0], nil
+}
+
+// userTournamentStatsKeyName is the key name of the UserTournamentStats of a
+// user in a tournament. There is a single possible key for each pair, so
+// concurrent transactions creating the same stats conflict instead of creating
+// two rows.
+func userTournamentStatsKeyName(tournamentID int64, userID int64) string {
+	return fmt.Sprintf("%d-%d", tournamentID, userID)
+}
+
+func userTournamentStatsKey(ctx context.Context, tournamentID int64, userID int64) *datastore.Key {
+	return datastore.NewKey(ctx, "UserTournamentStats",
+		userTournamentStatsKeyName(tournamentID, userID), 0, guestbookKey(ctx))
 }
 
 func calculateTrueSkillRating(mu float64, sigma float64) float64 {
@@ -121,8 +212,9 @@ func createInitialUserStats(tournamentID int64, userID int64) UserTournamentStat
 	}
 }
 
-// readOrCreateStatsWithID reads user stats with given IDs, and will create a
-// new default entry if the records does not exist yet.
+// readOrCreateStatsWithID reads user stats with given IDs, or returns initial
+// stats if the record does not exist yet. It must run in a transaction which
+// puts the returned stats, so that only one initial record is created.
 func readOrCreateStatsWithID(ctx context.Context, tournamentID int64, userID int64) (
 	*datastore.Key, UserTournamentStats, error) {
 	exist, key, stats, err := readStatsWithID(ctx, tournamentID, userID)
@@ -134,24 +226,7 @@ func readOrCreateStatsWithID(ctx context.Context, tournamentID int64, userID int
 		return key, stats, nil
 	}
 
-	exist, key, stats, err = readStatsWithID(ctx, tournamentID, userID)
-	if exist {
-		// there are multiple queries that were trying to create this entry,
-		// and it's now created by some other thread. We can now return stats.
-		return nil, UserTournamentStats{}, nil
-	}
-
-	incompleteKey := datastore.NewIncompleteKey(ctx, "UserTournamentStats", guestbookKey(ctx))
-
-	stats = createInitialUserStats(tournamentID, userID)
-
-	key, err = datastore.Put(ctx, incompleteKey, &stats)
-
-	if err != nil {
-		return nil, UserTournamentStats{}, err
-	}
-
-	return key, stats, nil
+	return userTournamentStatsKey(ctx, tournamentID, userID), createInitialUserStats(tournamentID, userID), nil
 }
 
 func readAllUserStatsForTournament(ctx context.Context, tournamentID int64) ([]UserTournamentStats, error) {
@@ -166,58 +241,124 @@ func readAllUserStatsForTournament(ctx context.Context, tournamentID int64) ([]U
 	return statsList, nil
 }
 
+// createUserProfileToShow creates the public view of an user's stats in a
+// tournament
+func createUserProfileToShow(profile UserProfile, stats UserTournamentStats, badges []Badge) UserProfileToShow {
+	userProfileToShow := UserProfileToShow{
+		Name:            profile.Name,
+		Rating:          stats.Rating,
+		TrueSkillMu:     stats.TrueSkillMu,
+		TrueSkillSigma:  stats.TrueSkillSigma,
+		TrueSkillRating: stats.TrueSkillRating,
+		FFAWins:         stats.FFAWins,
+		Wins:            stats.Wins,
+		Losses:          stats.Losses,
+		Badges:          badges,
+		Games:           stats.Games,
+		Podiums:         stats.Podiums,
+		Draws:           stats.Draws,
+		LastPlayed:      stats.LastPlayed,
+	}
+	if stats.Games > 0 {
+		userProfileToShow.AveragePlacement = float64(stats.PlacementSum) / float64(stats.Games)
+	}
+	return userProfileToShow
+}
+
 func requestTournamentStats(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	tournamentName := r.FormValue("tournament")
 	if tournamentName == "" {
-		http.Error(w, "tournament parameter is missing", http.StatusBadRequest)
+		writeAPIError(w, invalidArgumentError("tournament parameter is missing"))
 		return
 	}
 
-	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
-
+	scope, err := tournamentCacheScope(ctx, tournamentName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	asOf, err := parseTimeParam(r.FormValue("asOf"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeAPIError(w, err)
 		return
 	}
+	compareTo, err := parseTimeParam(r.FormValue("compareTo"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeCachedResponse(w, r, ctx, scope, false, func() (interface{}, error) {
+		return readTournamentLeaderboard(ctx, tournamentName, asOf, compareTo)
+	})
+}
+
+// readTournamentLeaderboard reads the stats of all players in a tournament,
+// ordered by TrueSkill rating. If asOf is not zero, the stats are the ones
+// players had at that time. If compareTo is not zero, ranks of the players at
+// that time are included.
+func readTournamentLeaderboard(
+	ctx context.Context,
+	tournamentName string,
+	asOf time.Time,
+	compareTo time.Time) ([]UserProfileToShow, error) {
+
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return nil, err
+	}
+	tournamentID := tournamentKey.IntID()
 
 	// Get user tournament stats
-	statsList, err := readAllUserStatsForTournament(ctx, tournamentKey.IntID())
+	statsList, err := readAllUserStatsForTournament(ctx, tournamentID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	// Create public user profile
-	userProfileToShows := make([]UserProfileToShow, len(statsList))
+	userIDs := make([]int64, len(statsList))
 	for i, stats := range statsList {
-		profile, err := readUserProfile(ctx, stats.UserID)
+		userIDs[i] = stats.UserID
+	}
+
+	// Past leaderboards are rebuilt from matches before the later date
+	var previousRanks map[int64]int
+	if !asOf.IsZero() || !compareTo.IsZero() {
+		latest := asOf
+		if latest.IsZero() || compareTo.After(latest) {
+			latest = compareTo
+		}
+		matches, err := readFFAMatchesBefore(ctx, tournamentID, latest)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 
-		// Get badges
-		userProfileToShows[i] = UserProfileToShow{
-			Name:            profile.Name,
-			Rating:          stats.Rating,
-			TrueSkillMu:     stats.TrueSkillMu,
-			TrueSkillSigma:  stats.TrueSkillSigma,
-			TrueSkillRating: stats.TrueSkillRating,
-			FFAWins:         stats.FFAWins,
-			Wins:            stats.Wins,
-			Losses:          stats.Losses,
-			Badges:          getUserBadges(ctx, profile.Name),
+		if !compareTo.IsZero() {
+			previousRanks = leaderboardRanks(statsAsOf(tournamentID, userIDs, matchesBefore(matches, compareTo)))
+		}
+		if !asOf.IsZero() {
+			statsList = statsAsOf(tournamentID, userIDs, matchesBefore(matches, asOf))
+			for i, stats := range statsList {
+				userIDs[i] = stats.UserID
+			}
 		}
 	}
 
-	js, errJs := json.Marshal(userProfileToShows)
-	if errJs != nil {
-		http.Error(w, errJs.Error(), http.StatusInternalServerError)
-		return
+	profiles, err := readUserProfiles(ctx, userIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	// Create public user profile
+	userProfileToShows := make([]UserProfileToShow, len(statsList))
+	for i, stats := range statsList {
+		userProfileToShows[i] = createUserProfileToShow(profiles[i], stats, getUserBadges(ctx, profiles[i].Name))
+		if previousRanks != nil {
+			userProfileToShows[i].Rank = i + 1
+			userProfileToShows[i].PreviousRank = previousRanks[stats.UserID]
+			userProfileToShows[i].RankChange = userProfileToShows[i].PreviousRank - userProfileToShows[i].Rank
+		}
+	}
+	return userProfileToShows, nil
 }
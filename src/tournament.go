@@ -1,8 +1,6 @@
 package guestbook
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"path"
@@ -10,10 +8,16 @@ import (
 	"strings"
 
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
+// Pages used to add match results, set per tournament in Tournament.SubmitPage
+const (
+	SubmitPageFFA = "ffa"
+	SubmitPage2P  = "2p"
+	SubmitPageTTA = "tta"
+)
+
 func showTournaments(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join("static", "tournaments.html"))
 }
@@ -33,14 +37,12 @@ func showTournamentStats(w http.ResponseWriter, r *http.Request) {
 		action := tokens[3]
 
 		if action == "add_ffa_match_result" {
-			tournament := tokens[2]
-			//TODO: save specific UI information in datastore so we can serve different
-			//page for each tournament.
-			if tournament == "FunPingClub" {
-				http.ServeFile(w, r, path.Join("static", "add_2p_match_result.html"))
+			page, err := tournamentSubmitPage(newContext(r), tokens[2])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			http.ServeFile(w, r, path.Join("static", "add_ffa_match_result.html"))
+			http.ServeFile(w, r, path.Join("static", "add_"+page+"_match_result.html"))
 			return
 		}
 
@@ -59,20 +61,30 @@ func showTournamentStats(w http.ResponseWriter, r *http.Request) {
 
 // [START submit_tournament]
 func submitTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	if _, err := createTournament(ctx, r.FormValue("name")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/tournament", http.StatusFound)
+	return
+}
 
+// createTournament creates a tournament organized by the current login
+func createTournament(ctx context.Context, name string) (Tournament, error) {
 	// Check valid name
-	name := r.FormValue("name")
-
 	re, _ := regexp.Compile("^[A-Za-z0-9_]{3,20}$")
 
 	isValid := re.MatchString(name)
 	if !isValid {
-		http.Error(w, "Not a valid name for tournament", http.StatusBadRequest)
-		return
+		return Tournament{}, invalidArgumentError("Not a valid name for tournament")
 	}
 
-	ctx := appengine.NewContext(r)
-	err := datastore.RunInTransaction(ctx,
+	t := Tournament{
+		Name: name,
+	}
+	var tournamentKey *datastore.Key
+	err := runInTransaction(ctx,
 		func(ctx context.Context) error {
 			exist, _, _, err := findExistingTournament(ctx, name)
 			if err != nil {
@@ -80,27 +92,85 @@ func submitTournament(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if exist {
-				return errors.New("tournament name already exists")
-			}
-
-			t := Tournament{
-				Name: name,
+				return alreadyExistsError("tournament name already exists")
 			}
 
 			// [END getall]
 			key := datastore.NewIncompleteKey(ctx, "Tournament", guestbookKey(ctx))
-			_, err = datastore.Put(ctx, key, &t)
+			tournamentKey, err = datastore.Put(ctx, key, &t)
 
 			return err
 		},
 		nil)
 
+	if err != nil {
+		return Tournament{}, err
+	}
+
+	// The creator organizes the new tournament, service tokens have no email
+	if email := currentEmail(ctx); email != "" {
+		if err := assignRole(ctx, email, RoleOrganizer, tournamentKey.IntID()); err != nil {
+			return Tournament{}, err
+		}
+	}
+	return t, nil
+}
+
+// tournamentSubmitPage returns the page used to add match results to a
+// tournament
+func tournamentSubmitPage(ctx context.Context, name string) (string, error) {
+	_, _, tournament, err := findExistingTournament(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if tournament.SubmitPage != "" {
+		return tournament.SubmitPage, nil
+	}
+	// Default of tournaments created before the setting existed
+	if name == "FunPingClub" {
+		return SubmitPage2P, nil
+	}
+	return SubmitPageFFA, nil
+}
+
+// submitTournamentSettings updates settings of a tournament
+func submitTournamentSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	tournamentKey, err := findExistingTournamentKey(ctx, r.FormValue("tournament"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authorize(ctx, RoleOrganizer, tournamentKey.IntID()); err != nil {
+		http.Error(w, err.Error(), authorizationStatus(err))
+		return
+	}
+
+	submitPage := r.FormValue("submit_page")
+	switch submitPage {
+	case "", SubmitPageFFA, SubmitPage2P, SubmitPageTTA:
+	default:
+		http.Error(w, "Unknown submit page "+submitPage, http.StatusBadRequest)
+		return
+	}
+
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		var tournament Tournament
+		if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+			return err
+		}
+		tournament.SubmitPage = submitPage
+		_, err := datastore.Put(ctx, tournamentKey, &tournament)
+		return err
+	}, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/tournament", http.StatusFound)
-	return
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 func findExistingTournament(c context.Context, name string) (bool, *datastore.Key, Tournament, error) {
@@ -124,7 +194,7 @@ func findExistingTournamentKey(ctx context.Context, tournamentName string) (*dat
 	}
 
 	if !exist {
-		return nil, fmt.Errorf("tournament %s does not exist", tournamentName)
+		return nil, notFoundError("tournament %s does not exist", tournamentName)
 	}
 
 	return tournamentKey, nil
@@ -132,7 +202,7 @@ func findExistingTournamentKey(ctx context.Context, tournamentName string) (*dat
 
 func readTournaments(ctx context.Context) ([]Tournament, error) {
 	query := datastore.NewQuery("Tournament").Ancestor(guestbookKey(ctx))
-	var tournaments []Tournament
+	tournaments := []Tournament{}
 	if _, err := query.GetAll(ctx, &tournaments); err != nil {
 		return nil, err
 	}
@@ -140,144 +210,73 @@ func readTournaments(ctx context.Context) ([]Tournament, error) {
 	return tournaments, nil
 }
 
-func requestTournaments(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	tournaments, err := readTournaments(ctx)
-
+// readTournamentNames reads all tournaments, and returns a map from tournament
+// ID to tournament name
+func readTournamentNames(ctx context.Context) (map[int64]string, error) {
+	query := datastore.NewQuery("Tournament").Ancestor(guestbookKey(ctx))
+	var tournaments []Tournament
+	keys, err := query.GetAll(ctx, &tournaments)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	js, err := json.Marshal(tournaments)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	names := make(map[int64]string)
+	for i, t := range tournaments {
+		names[keys[i].IntID()] = t.Name
 	}
+	return names, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+func requestTournaments(w http.ResponseWriter, r *http.Request) {
+	tournaments, err := readTournaments(newContext(r))
+	writeAPIResponse(w, tournaments, err)
 }
 
 func requestDetailMatchResults(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
+
+	scope, err := tournamentCacheScope(ctx, r.FormValue("tournament"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeCachedResponse(w, r, ctx, scope, false, func() (interface{}, error) {
+		return readDetailMatchResults(ctx, r.FormValue("tournament"))
+	})
+}
 
-	tournamentName := r.FormValue("tournament")
+// readDetailMatchResults reads the head-to-head results of all players in a
+// tournament
+func readDetailMatchResults(ctx context.Context, tournamentName string) (MatchData, error) {
 	if tournamentName == "" {
 		tournamentName = "Default"
 	}
 
 	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
-	tournamentID := tournamentKey.IntID()
-
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return MatchData{}, err
 	}
+	tournamentID := tournamentKey.IntID()
 
-	// Get user tournament stats
-	statsList, err := readAllUserStatsForTournament(ctx, tournamentID)
+	h, stored, err := readHeadToHead(ctx, tournamentID)
 	if err != nil {
-		http.Error(w, "Failed to read tournament stats: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	users := make([]UserProfile, len(statsList))
-	for i, stats := range statsList {
-		users[i], err = readUserProfile(ctx, stats.UserID)
-		if err != nil {
-			http.Error(w, "Failed to read user profile: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Get all FFAMatches
-	query := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).Filter("TournamentID =", tournamentID)
-	var matches []FFAMatch
-	if _, err := query.GetAll(ctx, &matches); err != nil {
-		http.Error(w, "Failed to read FFAMatches: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// User IDs to index map
-	idMap := make(map[int64]int)
-	for index, stats := range statsList {
-		idMap[stats.UserID] = index
-	}
-
-	// Set usernames
-	usernames := make([]string, len(users))
-	for i, u := range users {
-		usernames[i] = u.Name
+		return MatchData{}, fmt.Errorf("Failed to read head-to-head results: %s", err.Error())
 	}
 
-	// Set resultTable
-	resultTable := make([][]DetailMatchResultEntry, len(users))
-	for i := range resultTable {
-		resultTable[i] = make([]DetailMatchResultEntry, len(users))
-		for j := range resultTable[i] {
-			resultTable[i][j].Wins = 0
-			resultTable[i][j].Draws = 0
-			resultTable[i][j].Losses = 0
-		}
-	}
-
-	// Generate wins and losses in resultTable
-	for _, match := range matches {
-		playerIndex := make([]int, len(match.Players))
-		for i, playerID := range match.Players {
-			index, exist := idMap[playerID]
-			if !exist {
-				http.Error(w,
-					fmt.Sprintf("User ID %d does not exist, cannot process FFAMatch: %+v", playerID, match),
-					http.StatusInternalServerError)
-				return
-			}
-			playerIndex[i] = index
-		}
-		for i := range playerIndex {
-			for j := i + 1; j < len(playerIndex); j++ {
-				isDraw := true
-				for d := i; d < j; d++ {
-					if match.Draws[d] == false {
-						isDraw = false
-						break
-					}
-				}
-
-				winner := playerIndex[i]
-				loser := playerIndex[j]
-
-				if isDraw {
-					resultTable[winner][loser].Draws++
-					resultTable[loser][winner].Draws++
-				} else {
-					resultTable[winner][loser].Wins++
-					resultTable[loser][winner].Losses++
-				}
+	// Store results of older tournaments built from their matches, in a
+	// transaction so that a concurrent submission is not lost
+	if !stored {
+		err = runInTransaction(ctx, func(ctx context.Context) error {
+			h, stored, err = readHeadToHead(ctx, tournamentID)
+			if err != nil || stored {
+				return err
 			}
+			return putHeadToHead(ctx, &h)
+		}, nil)
+		if err != nil {
+			return MatchData{}, fmt.Errorf("Failed to store head-to-head results: %s", err.Error())
 		}
 	}
 
-	// color-code wins and losses
-	for i := range resultTable {
-		for j := range resultTable[i] {
-			resultTable[i][j].Color = getColor(users[i], users[j], resultTable[i][j].Wins, resultTable[i][j].Losses)
-		}
-	}
-
-	// Return JSON
-	matchData := MatchData{
-		Usernames:   usernames,
-		ResultTable: resultTable,
-	}
-
-	js, err := json.Marshal(matchData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return h.matchData(), nil
 }
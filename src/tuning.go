@@ -0,0 +1,398 @@
+package guestbook
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+)
+
+// Functions about fitting the rating settings of a tournament to its FFA match
+// history. The history is replayed with every candidate of a grid, and
+// candidates are compared by the mean log-likelihood of their pre-game
+// predictions: the TrueSkill probability of the full result of each match, and
+// the Elo expected score of each emulated 1v1 game. TrueSkill and Elo ratings
+// do not depend on each other, so they are fitted separately.
+//
+// Fits run in a background task, since the TrueSkill grid has more than a
+// hundred candidates, and their reports are stored in one RatingFitJob entity
+// per tournament.
+
+// Multiples of the default TrueSkill beta, tau and Elo K tried by the fit
+var (
+	trueSkillBetaFactors = []float64{0.5, 0.75, 1, 1.5, 2}
+	trueSkillTauFactors  = []float64{0.25, 0.5, 1, 2, 4}
+	eloKFactors          = []float64{0.25, 0.375, 0.5, 0.75, 1, 1.25, 1.5, 2}
+)
+
+// Draw probabilities tried by the fit, in percent
+var drawProbabilities = []float64{1, 2.5, 5, 10, 20}
+
+// Number of best candidates in a report
+const ratingFitCandidates = 10
+
+// trueSkillGrid returns the candidate settings of a fit, current included,
+// with default values in place of unset settings
+func trueSkillGrid(current RatingSettings) []RatingSettings {
+	current = current.withDefaults()
+	grid := []RatingSettings{current}
+	for _, betaFactor := range trueSkillBetaFactors {
+		for _, tauFactor := range trueSkillTauFactors {
+			for _, drawProbability := range drawProbabilities {
+				candidate := RatingSettings{
+					TrueSkillBeta:   betaFactor * DefaultTrueSkillBeta,
+					TrueSkillTau:    tauFactor * DefaultTrueSkillTau,
+					DrawProbability: drawProbability,
+					EloK:            current.EloK,
+				}
+				if candidate != current {
+					grid = append(grid, candidate)
+				}
+			}
+		}
+	}
+	return grid
+}
+
+// trueSkillLogLikelihood replays FFA matches, ordered from first to last
+// played, from initial stats with the settings, and returns the mean
+// log-likelihood of their results
+func trueSkillLogLikelihood(settings RatingSettings, tournamentID int64, matches []FFAMatch) (float64, error) {
+	ts, err := settings.trueSkillConfig()
+	if err != nil {
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, nil
+	}
+
+	statsMap := make(map[int64]UserTournamentStats)
+	logLikelihood := 0.0
+	for _, match := range matches {
+		preGameUserStatsList := make([]UserTournamentStats, len(match.Players))
+		for i, userID := range match.Players {
+			stats, exist := statsMap[userID]
+			if !exist {
+				stats = createInitialUserStats(tournamentID, userID)
+			}
+			preGameUserStatsList[i] = stats
+		}
+
+		postGameUserStatsList, outcomeProbability := adjustFFAStats(ts, settings.eloK(), preGameUserStatsList, match.Draws, match.playedAt())
+		logLikelihood -= logLoss(outcomeProbability)
+
+		for i, userID := range match.Players {
+			statsMap[userID] = postGameUserStatsList[i]
+		}
+	}
+	return logLikelihood / float64(len(matches)), nil
+}
+
+// ffaEloLogLikelihood replays the Elo ratings of FFA matches, ordered from
+// first to last played, from initial ratings with the K-factor k, and returns
+// the mean log-likelihood of the results of their emulated 1v1 games
+func ffaEloLogLikelihood(k float64, matches []FFAMatch) float64 {
+	ratings := make(map[int64]float64)
+	logLikelihood := 0.0
+	games := 0
+	for _, match := range matches {
+		preGameRatings := make([]float64, len(match.Players))
+		for i, userID := range match.Players {
+			rating, exist := ratings[userID]
+			if !exist {
+				rating = InitialRating
+			}
+			preGameRatings[i] = rating
+		}
+
+		for _, result := range Generate1v1MatchResults(len(match.Players)) {
+			score := 1.0
+			if placement(match.Draws, result.winner) == placement(match.Draws, result.loser) {
+				score = 0.5
+			}
+			expected := expectedScore(preGameRatings[result.winner], preGameRatings[result.loser])
+			logLikelihood -= score*logLoss(expected) + (1-score)*logLoss(1-expected)
+			games++
+		}
+
+		for i, rating := range adjustFFAElo(k, preGameRatings, match.Draws) {
+			ratings[match.Players[i]] = rating
+		}
+	}
+	if games == 0 {
+		return 0
+	}
+	return logLikelihood / float64(games)
+}
+
+// sortRatingFits orders fits from the best, and keeps the best ones
+func sortRatingFits(fits []RatingFit) []RatingFit {
+	sort.SliceStable(fits, func(i, j int) bool {
+		return fits[i].LogLikelihood > fits[j].LogLikelihood
+	})
+	if len(fits) > ratingFitCandidates {
+		fits = fits[:ratingFitCandidates]
+	}
+	return fits
+}
+
+// fitTrueSkillSettings fits the TrueSkill settings of a tournament to its FFA
+// matches, ordered from first to last played
+func fitTrueSkillSettings(current RatingSettings, tournamentID int64, matches []FFAMatch) (RatingFitReport, error) {
+	report := RatingFitReport{Matches: len(matches)}
+
+	current = current.withDefaults()
+	var fits []RatingFit
+	for _, candidate := range trueSkillGrid(current) {
+		logLikelihood, err := trueSkillLogLikelihood(candidate, tournamentID, matches)
+		if err != nil {
+			return RatingFitReport{}, err
+		}
+		fit := RatingFit{
+			TrueSkillBeta:   candidate.TrueSkillBeta,
+			TrueSkillTau:    candidate.TrueSkillTau,
+			DrawProbability: candidate.DrawProbability,
+			LogLikelihood:   logLikelihood,
+		}
+		if candidate == current {
+			report.Current = fit
+		}
+		fits = append(fits, fit)
+	}
+
+	report.Candidates = sortRatingFits(fits)
+	report.Best = report.Candidates[0]
+	return report, nil
+}
+
+// fitFFAEloK fits the Elo K-factor of a tournament to its FFA matches, ordered
+// from first to last played. It returns the fits of the current K-factor and
+// of every candidate, from the best.
+func fitFFAEloK(current float64, matches []FFAMatch) (RatingFit, []RatingFit) {
+	currentFit := RatingFit{EloK: current, EloLogLikelihood: ffaEloLogLikelihood(current, matches)}
+
+	fits := []RatingFit{currentFit}
+	for _, factor := range eloKFactors {
+		if k := factor * DefaultEloK; k != current {
+			fits = append(fits, RatingFit{EloK: k, EloLogLikelihood: ffaEloLogLikelihood(k, matches)})
+		}
+	}
+	sort.SliceStable(fits, func(i, j int) bool {
+		return fits[i].EloLogLikelihood > fits[j].EloLogLikelihood
+	})
+	return currentFit, fits
+}
+
+// RatingFitJob is the latest fit of the rating settings of a tournament,
+// which runs as a background task. Its states are the ones of batch rating
+// jobs.
+type RatingFitJob struct {
+	TournamentID int64
+	// Not stored
+	Tournament     string `datastore:"-"`
+	Status         string
+	Error          string `datastore:",noindex"`
+	RequestTime    time.Time
+	CompletionTime time.Time
+	// Whether the best settings are saved if they predict better
+	Save bool
+	// JSON of Report, which has too many values to be stored as properties
+	ReportJSON []byte `json:"-"`
+
+	// Report of the last completed fit, nil if there is none
+	Report *RatingFitReport `datastore:"-"`
+}
+
+func ratingFitJobKey(ctx context.Context, tournamentID int64) *datastore.Key {
+	return datastore.NewKey(ctx, "RatingFitJob", "", tournamentID, guestbookKey(ctx))
+}
+
+// fitTournamentParameters fits the rating settings of a tournament. If save is
+// set and the best settings predict better than the current ones, they are
+// saved and a replay of the tournament with them is scheduled.
+func fitTournamentParameters(ctx context.Context, tournamentID int64, save bool) (RatingFitReport, error) {
+	var tournament Tournament
+	tournamentKey := datastore.NewKey(ctx, "Tournament", "", tournamentID, guestbookKey(ctx))
+	if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+		return RatingFitReport{}, err
+	}
+
+	var matches []FFAMatch
+	if _, err := datastore.NewQuery("FFAMatch").Ancestor(guestbookKey(ctx)).
+		Filter("TournamentID =", tournamentID).
+		Order("SubmissionTime").
+		GetAll(ctx, &matches); err != nil {
+		return RatingFitReport{}, err
+	}
+	sortFFAMatchesByPlayedAt(matches, nil)
+
+	report, err := fitTrueSkillSettings(tournament.RatingSettings, tournamentID, matches)
+	if err != nil {
+		return RatingFitReport{}, err
+	}
+	report.Tournament = tournament.Name
+
+	currentElo, eloFits := fitFFAEloK(tournament.RatingSettings.eloK(), matches)
+	report.Current.EloK = currentElo.EloK
+	report.Current.EloLogLikelihood = currentElo.EloLogLikelihood
+	report.Best.EloK = eloFits[0].EloK
+	report.Best.EloLogLikelihood = eloFits[0].EloLogLikelihood
+	report.EloCandidates = eloFits
+
+	better := report.Best.LogLikelihood > report.Current.LogLikelihood ||
+		report.Best.EloLogLikelihood > report.Current.EloLogLikelihood
+	if !save || len(matches) == 0 || !better {
+		return report, nil
+	}
+
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		var tournament Tournament
+		if err := datastore.Get(ctx, tournamentKey, &tournament); err != nil {
+			return err
+		}
+		tournament.RatingSettings = RatingSettings{
+			TrueSkillBeta:   report.Best.TrueSkillBeta,
+			TrueSkillTau:    report.Best.TrueSkillTau,
+			DrawProbability: report.Best.DrawProbability,
+			EloK:            report.Best.EloK,
+		}
+		if _, err := datastore.Put(ctx, tournamentKey, &tournament); err != nil {
+			return err
+		}
+		// Stored ratings are recalculated with the saved settings
+		return changeTournamentStats(ctx, tournamentID, true)
+	}, nil)
+	if err != nil {
+		return RatingFitReport{}, err
+	}
+	report.Saved = true
+	return report, nil
+}
+
+var fitRatingParametersLater = delay.Func("fitRatingParameters", computeRatingFit)
+
+// computeRatingFit fits the rating settings of a tournament and stores the
+// report, it runs as a background task started by startRatingFit. Failures are
+// stored in the job instead of retrying the task.
+func computeRatingFit(ctx context.Context, tournamentID int64, save bool) error {
+	var reportJSON []byte
+	report, fitErr := fitTournamentParameters(ctx, tournamentID, save)
+	if fitErr == nil {
+		reportJSON, fitErr = json.Marshal(report)
+	}
+
+	return runInTransaction(ctx, func(ctx context.Context) error {
+		key := ratingFitJobKey(ctx, tournamentID)
+		var job RatingFitJob
+		if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		job.TournamentID = tournamentID
+		job.CompletionTime = time.Now()
+		if fitErr != nil {
+			job.Status = BatchRatingsFailed
+			job.Error = fitErr.Error()
+		} else {
+			job.Status = BatchRatingsDone
+			job.Error = ""
+			job.ReportJSON = reportJSON
+		}
+		_, err := datastore.Put(ctx, key, &job)
+		return err
+	}, nil)
+}
+
+// startRatingFit starts a fit of the rating settings of a tournament in the
+// background, which needs the organizer role in it. The report of the previous
+// fit is kept until the new one is done.
+func startRatingFit(ctx context.Context, tournamentName string, save bool) (RatingFitJob, error) {
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return RatingFitJob{}, err
+	}
+	tournamentID := tournamentKey.IntID()
+	if err := authorize(ctx, RoleOrganizer, tournamentID); err != nil {
+		return RatingFitJob{}, err
+	}
+
+	var job RatingFitJob
+	err = runInTransaction(ctx, func(ctx context.Context) error {
+		key := ratingFitJobKey(ctx, tournamentID)
+		job = RatingFitJob{}
+		if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		if job.Status == BatchRatingsRunning && now.Sub(job.RequestTime) < batchRatingsTimeout {
+			return failedPreconditionError("rating parameters of %s are already being fitted", tournamentName)
+		}
+
+		job.TournamentID = tournamentID
+		job.Status = BatchRatingsRunning
+		job.Error = ""
+		job.RequestTime = now
+		job.Save = save
+		if _, err := datastore.Put(ctx, key, &job); err != nil {
+			return err
+		}
+		// The task is only added if the transaction commits
+		return fitRatingParametersLater.Call(ctx, tournamentID, save)
+	}, nil)
+	if err != nil {
+		return RatingFitJob{}, err
+	}
+
+	job.Tournament = tournamentName
+	return job, nil
+}
+
+// readRatingFit reads the latest fit of the rating settings of a
+// tournament, with the report of its last completed fit. It needs the
+// organizer role in the tournament.
+func readRatingFit(ctx context.Context, tournamentName string) (RatingFitJob, error) {
+	tournamentKey, err := findExistingTournamentKey(ctx, tournamentName)
+	if err != nil {
+		return RatingFitJob{}, err
+	}
+	if err := authorize(ctx, RoleOrganizer, tournamentKey.IntID()); err != nil {
+		return RatingFitJob{}, err
+	}
+
+	var job RatingFitJob
+	if err := datastore.Get(ctx, ratingFitJobKey(ctx, tournamentKey.IntID()), &job); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return RatingFitJob{}, notFoundError("rating parameters of %s were never fitted", tournamentName)
+		}
+		return RatingFitJob{}, err
+	}
+	job.Tournament = tournamentName
+
+	if len(job.ReportJSON) > 0 {
+		job.Report = &RatingFitReport{}
+		if err := json.Unmarshal(job.ReportJSON, job.Report); err != nil {
+			return RatingFitJob{}, err
+		}
+	}
+	return job, nil
+}
+
+// fitRatings starts a fit of the rating settings of a tournament, see
+// startRatingFit. With save=true, the best settings are saved if they predict
+// better than the current ones.
+func fitRatings(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, err := startRatingFit(ctx, r.FormValue("tournament"), r.FormValue("save") == "true")
+	writeAPIResponse(w, job, err)
+}
+
+// requestRatingFit responds the latest fit of the rating settings of a
+// tournament
+func requestRatingFit(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, err := readRatingFit(ctx, r.FormValue("tournament"))
+	writeAPIResponse(w, job, err)
+}
@@ -0,0 +1,74 @@
+package guestbook
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTrueSkillGrid(t *testing.T) {
+	current := RatingSettings{TrueSkillBeta: 1, TrueSkillTau: 2, DrawProbability: 3}
+	grid := trueSkillGrid(current)
+	if grid[0] != current.withDefaults() {
+		t.Errorf("Wanted current settings first, got %+v", grid[0])
+	}
+	want := 1 + len(trueSkillBetaFactors)*len(trueSkillTauFactors)*len(drawProbabilities)
+	if len(grid) != want {
+		t.Errorf("Wanted %d candidates, got %d", want, len(grid))
+	}
+
+	// Default settings are on the grid and not tried twice
+	grid = trueSkillGrid(RatingSettings{
+		TrueSkillBeta:   DefaultTrueSkillBeta,
+		TrueSkillTau:    DefaultTrueSkillTau,
+		DrawProbability: DrawProbability,
+	})
+	if len(grid) != want-1 {
+		t.Errorf("Wanted %d candidates, got %d", want-1, len(grid))
+	}
+
+	// Unset settings are the defaults
+	grid = trueSkillGrid(RatingSettings{})
+	if len(grid) != want-1 || grid[0].TrueSkillBeta != DefaultTrueSkillBeta || grid[0].DrawProbability != DrawProbability {
+		t.Errorf("Wanted %d candidates from the default settings, got %d from %+v", want-1, len(grid), grid[0])
+	}
+}
+
+func TestFFAEloLogLikelihood(t *testing.T) {
+	matches := []FFAMatch{
+		{Players: []int64{10, 11}, Draws: []bool{false}},
+		{Players: []int64{10, 11}, Draws: []bool{false}},
+	}
+	winnerRating, loserRating := newRatingsWithK(16, InitialRating, InitialRating)
+	want := (math.Log(0.5) + math.Log(expectedScore(winnerRating, loserRating))) / 2
+	if got := ffaEloLogLikelihood(16, matches); math.Abs(got-want) > 1e-9 {
+		t.Errorf("Wanted %f, got %f", want, got)
+	}
+	if got := ffaEloLogLikelihood(16, nil); got != 0 {
+		t.Errorf("Wanted 0 without matches, got %f", got)
+	}
+}
+
+func TestFitFFAEloK(t *testing.T) {
+	// Player 10 always wins, so larger K-factors predict better
+	var matches []FFAMatch
+	for i := 0; i < 10; i++ {
+		matches = append(matches, FFAMatch{Players: []int64{10, 11}, Draws: []bool{false}})
+	}
+
+	current, fits := fitFFAEloK(DefaultEloK, matches)
+	wantK := eloKFactors[len(eloKFactors)-1] * DefaultEloK
+	if fits[0].EloK != wantK {
+		t.Errorf("Wanted K-factor %f, got %f", wantK, fits[0].EloK)
+	}
+	if current.EloK != DefaultEloK || current.EloLogLikelihood >= fits[0].EloLogLikelihood {
+		t.Errorf("Wanted current K-factor to predict worse, got %+v", current)
+	}
+	if len(fits) != len(eloKFactors) {
+		t.Errorf("Wanted %d candidates, got %d", len(eloKFactors), len(fits))
+	}
+	for i := 1; i < len(fits); i++ {
+		if fits[i].EloLogLikelihood > fits[i-1].EloLogLikelihood {
+			t.Errorf("Wanted candidates from the best, got %+v", fits)
+		}
+	}
+}
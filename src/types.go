@@ -24,6 +24,8 @@ type Match struct {
 	Expected           bool
 	Note               string
 	Date               time.Time
+	// Idempotency key sent by the client, empty if there was none
+	RequestID string
 }
 
 // MatchWithKey wrapper struct for datastore
@@ -32,6 +34,12 @@ type MatchWithKey struct {
 	Key   string
 }
 
+// MatchPage is a page of legacy matches, with the cursor of the next page
+type MatchPage struct {
+	Matches    []MatchWithKey
+	NextCursor string
+}
+
 // UserProfile wrapper for datastore
 type UserProfile struct {
 	Tournament string
@@ -40,6 +48,81 @@ type UserProfile struct {
 	Wins       int
 	Losses     int
 	JoinDate   time.Time
+
+	// Login account linked to this profile, set when a ProfileClaim is
+	// approved. AccountID is the stable user.User.ID. Both are private, admins
+	// see the email in the claims they review.
+	AccountID    string `json:"-"`
+	AccountEmail string `json:"-"`
+}
+
+// RatingFitReport compares the current rating settings of a tournament with
+// the best ones found by replaying its history
+type RatingFitReport struct {
+	Tournament string
+	Matches    int
+	Current    RatingFit
+	Best       RatingFit
+	// Best TrueSkill candidates, from the best
+	Candidates []RatingFit
+	// Elo K-factor candidates, from the best
+	EloCandidates []RatingFit
+	// Whether Best was saved in the settings of the tournament
+	Saved bool
+}
+
+// RatingFit is the mean log-likelihood of the results of a history, replayed
+// with some rating settings: per match for TrueSkill, and per emulated 1v1
+// game for Elo
+type RatingFit struct {
+	TrueSkillBeta    float64 `json:",omitempty"`
+	TrueSkillTau     float64 `json:",omitempty"`
+	DrawProbability  float64 `json:",omitempty"`
+	LogLikelihood    float64 `json:",omitempty"`
+	EloK             float64 `json:",omitempty"`
+	EloLogLikelihood float64 `json:",omitempty"`
+}
+
+// PredictionReport measures how well pre-game ratings predicted the results of
+// the matches of a tournament. Predictions are the win probabilities of every
+// pair of players of a match who did not draw.
+type PredictionReport struct {
+	// Empty for 1v1 matches
+	Tournament string
+	Matches    int
+	// Matches won by the player with the best pre-game rating
+	FavoriteWins    int
+	FavoriteWinRate float64
+	Predictions     int
+	LogLoss         float64
+	BrierScore      float64
+	// Log-loss of the OutcomeProbability of FFA matches, the probability of
+	// their full result
+	OutcomeLogLoss float64 `json:",omitempty"`
+	// Buckets of the win probability of the favorite of each pair
+	Calibration []CalibrationBucket
+	// Matches with the least likely win, from the least likely
+	Upsets []Upset
+}
+
+// CalibrationBucket compares predicted and observed win rates of favorites
+// whose win probability is in [MinProbability, MaxProbability)
+type CalibrationBucket struct {
+	MinProbability  float64
+	MaxProbability  float64
+	Predictions     int
+	MeanProbability float64
+	FavoriteWinRate float64
+}
+
+// Upset is the least likely win of a match
+type Upset struct {
+	Note           string
+	SubmissionTime time.Time
+	Winner         string
+	Loser          string
+	// Predicted probability of the win
+	Probability float64
 }
 
 // UserProfileToShow wrapper for datastore
@@ -53,6 +136,19 @@ type UserProfileToShow struct {
 	Wins            int
 	Losses          int
 	Badges          []Badge
+
+	// Tallies of FFA matches, see UserTournamentStats
+	Games            int     `json:",omitempty"`
+	Podiums          int     `json:",omitempty"`
+	AveragePlacement float64 `json:",omitempty"`
+	Draws            int     `json:",omitempty"`
+	LastPlayed       time.Time
+
+	// Ranks are only set when the leaderboard is compared to another date.
+	// RankChange is positive if the player moved up since that date.
+	Rank         int `json:",omitempty"`
+	PreviousRank int `json:",omitempty"`
+	RankChange   int `json:",omitempty"`
 }
 
 // DetailMatchResultEntry wrapper for datastore
@@ -75,6 +171,8 @@ type Badge struct {
 	Description string
 	Author      string
 	Path        string
+	// Tournament the badge belongs to, 0 for site-wide badges
+	TournamentID int64
 }
 
 // UserBadge wrapper for datastore
@@ -86,15 +184,51 @@ type UserBadge struct {
 // Tournament object in datastore represents a particular tournament
 type Tournament struct {
 	Name string
+
+	// Settings, edited by organizers of the tournament
+
+	// Page used to add match results, one of SubmitPageFFA, SubmitPage2P and
+	// SubmitPageTTA. Empty means the default page.
+	SubmitPage string
+
+	RatingSettings
+
+	// Incremented by every change of the matches or stats of the tournament,
+	// see changeTournamentStats
+	StatsVersion int64
+	// Whether a replay was scheduled and has not completed yet, stats are
+	// then out of date
+	ReplayPending bool
+}
+
+// RatingSettings are the parameters of the ratings of a tournament. Zero
+// values mean the defaults in stats.go.
+type RatingSettings struct {
+	TrueSkillBeta float64
+	TrueSkillTau  float64
+	// Percentage from 0 to 100, like DrawProbability
+	DrawProbability float64
+	// K-factor of the Elo ratings of FFA matches
+	EloK float64
 }
 
 // UserTournamentStats object in datastore represents an user's performance in a particular tournament
 type UserTournamentStats struct {
-	UserID          int64
-	TournamentID    int64
-	FFAWins         int
-	Wins            int
-	Losses          int
+	UserID       int64
+	TournamentID int64
+
+	// Tallies of FFA matches. FFAWins counts first places, Wins, Draws and
+	// Losses count the players placed after, together with, and before the
+	// player in each match.
+	Games        int
+	FFAWins      int
+	Podiums      int
+	PlacementSum int
+	Wins         int
+	Draws        int
+	Losses       int
+	LastPlayed   time.Time
+
 	Rating          float64
 	TrueSkillMu     float64
 	TrueSkillSigma  float64
@@ -129,6 +263,12 @@ type FFAMatch struct {
 	PostGameTrueSkillSigma  []float64
 	PostGameTrueSkillRating []float64
 
+	// Pre-game and post-game Elo ratings for players in Players[], updated by
+	// the emulated 1v1 games of Generate1v1MatchResults. Matches recorded
+	// before Elo ratings were kept have none until the tournament is replayed.
+	PreGameEloRating  []float64
+	PostGameEloRating []float64
+
 	// Probability of this match result, calculated by Trueskill
 	OutcomeProbability float64
 
@@ -136,6 +276,25 @@ type FFAMatch struct {
 	Note           string
 	Submitter      string
 	SubmissionTime time.Time
+	// Time the match was played, before SubmissionTime if it was entered
+	// later. Matches recorded before it was kept have none, see playedAt.
+	PlayedAt time.Time
+
+	// Idempotency key sent by the client, empty if there was none. A retry
+	// of a submission with the same key returns this match.
+	RequestID string
+}
+
+// FFAMatchRetraction records a FFA match retracted by its submitter, so that
+// the retraction is shown in the match feed
+type FFAMatchRetraction struct {
+	TournamentID int64
+	// User ID of players of the retracted match
+	Players        []int64
+	Note           string
+	Submitter      string
+	SubmissionTime time.Time
+	RetractionTime time.Time
 }
 
 // FFAMatchWithKey wrapper struct for datastore
@@ -143,3 +302,95 @@ type FFAMatchWithKey struct {
 	Match FFAMatch
 	Key   string
 }
+
+// FFAMatchSubmission is the response to a submitted FFA match
+type FFAMatchSubmission struct {
+	Match FFAMatch
+	// True if a match with the same request ID was already recorded, Match
+	// is then that match and nothing was changed
+	Replayed bool
+	// Possible mistakes in the submission, which was recorded anyway
+	Warnings []string
+}
+
+// SimulatedGame is the outcome of a hypothetical game, which is not recorded
+type SimulatedGame struct {
+	// Probability of the result before the game
+	OutcomeProbability float64
+	// Players from first place to last place
+	Players []SimulatedPlayer
+}
+
+// SimulatedPlayer is the rating and leaderboard rank of a player before and
+// after a hypothetical game. Ratings are TrueSkill ratings in tournaments and
+// Elo ratings in 1v1 matches.
+type SimulatedPlayer struct {
+	Name           string
+	PreGameRating  float64
+	PostGameRating float64
+	// TrueSkill values and Elo ratings in tournaments, zero in 1v1 matches
+	PostGameTrueSkillMu    float64 `json:",omitempty"`
+	PostGameTrueSkillSigma float64 `json:",omitempty"`
+	PreGameEloRating       float64 `json:",omitempty"`
+	PostGameEloRating      float64 `json:",omitempty"`
+	PreviousRank           int
+	Rank                   int
+}
+
+// FFAMatchPage is a page of FFA matches, with the cursor of the next page
+type FFAMatchPage struct {
+	Matches    []FFAMatchWithKey
+	NextCursor string
+	// Keys of the matches the current login can still retract
+	RetractableKeys []string
+}
+
+// ProfileClaim is a request of a login account to be linked to a player
+// profile, which has to be approved by an admin
+type ProfileClaim struct {
+	UserID       int64
+	UserName     string
+	AccountID    string
+	AccountEmail string
+	Status       string
+	RequestTime  time.Time
+	Reviewer     string
+	ReviewTime   time.Time
+}
+
+// RoleAssignment gives a role to a login email, either site-wide
+// (TournamentID is 0) or in a single tournament
+type RoleAssignment struct {
+	Email        string
+	Role         string
+	TournamentID int64
+}
+
+// APIToken lets scripts call the site without a login. Only the hash of the
+// token is stored, the token itself is shown once when it is created.
+type APIToken struct {
+	Name string
+	// Hex SHA-256 of the token
+	Hash string `json:"-"`
+	// Beginning of the token, to tell tokens apart
+	Prefix string
+	// One of APITokenScopeRead, APITokenScopeSubmit and APITokenScopeAdmin
+	Scope string
+	// Tournaments the scope applies to, empty for all tournaments
+	TournamentIDs []int64
+
+	// Owner is recorded as Submitter of matches submitted with the token. It
+	// is the player or login of personal tokens, or the name of the service.
+	Owner          string
+	OwnerEmail     string
+	OwnerAccountID string
+	// Whether the owner was an admin of the app when the token was created,
+	// which cannot be looked up for another login
+	OwnerAdmin bool
+	Service    bool
+
+	Creator      string
+	CreationTime time.Time
+	LastUseTime  time.Time
+	Revoked      bool
+}
@@ -23,15 +23,7 @@ func readUserProfile(ctx context.Context, userID int64) (UserProfile, error) {
 }
 
 func readUserProfiles(ctx context.Context, userIDs []int64) ([]UserProfile, error) {
-	profiles := make([]UserProfile, len(userIDs))
-	for i, userID := range userIDs {
-		var err error
-		profiles[i], err = readUserProfile(ctx, userID)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return profiles, nil
+	return requestReadCache(ctx).readProfiles(ctx, userIDs)
 }
 
 func readUserIDAndProfileMapping(ctx context.Context, userIDs []int64) (map[int64]UserProfile, error) {